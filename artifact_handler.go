@@ -0,0 +1,168 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/phenomax/secnginx/util"
+	"github.com/urfave/cli"
+)
+
+// artifactPath is the directory artifacts are extracted to, relative to the working directory
+const artifactPath = "/build/artifact"
+
+// buildArtifact builds NginX and writes the staged install, the delivered configuration and a manifest into a
+// portable artifact, which can be installed on identical hosts without compilers
+func buildArtifact(c *cli.Context) error {
+	out := c.String("artifact")
+	if out == "" {
+		log.Fatalln("Please specify the artifact to write via --artifact, e.g. --artifact nginx.tar.gz")
+	}
+
+	// checked before the build, which takes a while
+	if err := util.CheckArtifactName(out); err != nil {
+		log.Fatalf("Fatal error: %s", err)
+	}
+
+	if c.Bool("upgrade") {
+		log.Fatalln("Artifacts always ship the NginX file structure, use --upgrade when installing the artifact instead")
+	}
+
+	platform, err := util.DetectPlatform()
+	if err != nil {
+		log.Fatalf("Can't determine the build platform: %s", err)
+	}
+
+	wd := workingDirectory()
+	plan := createPlan(c, wd)
+	plan.Print()
+
+	resolved, security := buildNginX(plan, wd)
+	staging := stagePackage(plan, wd)
+	writeLockfile(plan, resolved)
+
+	manifest := &util.ArtifactManifest{
+		Created:  time.Now(),
+		Platform: *platform,
+		Release:  *newRelease(plan, dynamicModules(plan, wd, staging)),
+		HTTP3:    plan.Provisioning.HTTP3,
+		Lock:     resolved,
+	}
+
+	entries, err := artifactEntries(staging, filepath.Dir(manifest.Release.ConfPath))
+	if err != nil {
+		log.Fatalf("Failed collecting the staged files in %s Error: %s", staging, err)
+	}
+
+	if err = util.WriteArtifact(out, manifest, entries); err != nil {
+		log.Fatalf("Failed writing artifact %s Error: %s", out, err)
+	}
+
+	digest, err := util.FileSHA256(out)
+	if err != nil {
+		log.Fatalf("Failed hashing artifact %s Error: %s", out, err)
+	}
+
+	log.Printf("Build summary: NginX %s with %s, build profile %s, hardening: %s", plan.Components[0].Version,
+		plan.TLSLibrary.Title, plan.Profile, security)
+	log.Printf("Artifact %s has been written (SHA-256 %s). Run 'secnginx install --from-artifact %s --artifact-sha256 %s' "+
+		"on hosts running %s %s (%s), or sign it and pass the signature via --artifact-signature", out, digest, out, digest,
+		platform.Distro, platform.DistroVersion, platform.Arch)
+
+	return nil
+}
+
+// artifactEntries maps the staging directory to the artifact layout, which mirrors the working directory:
+// the configuration directory is stored as nginx/, the systemd unit as files/nginx.service and everything else
+// below root/
+func artifactEntries(staging, confDir string) ([]util.ArtifactEntry, error) {
+	entries := []util.ArtifactEntry{}
+
+	err := filepath.Walk(staging, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == staging {
+			return err
+		}
+
+		rel, err := filepath.Rel(staging, path)
+		if err != nil {
+			return err
+		}
+		target := "/" + filepath.ToSlash(rel)
+
+		name := "root" + target
+		switch {
+		case target == util.SystemdUnitPath:
+			name = "files/nginx.service"
+		case target == confDir || strings.HasPrefix(target, confDir+"/"):
+			name = "nginx" + strings.TrimPrefix(target, confDir)
+		}
+
+		entries = append(entries, util.ArtifactEntry{Name: name, Source: path})
+		return nil
+	})
+
+	return entries, err
+}
+
+// installArtifact installs an artifact built by 'build --artifact' as versioned install after authenticating it
+// and verifying it against the host, without building anything. Only the post install steps are run
+func installArtifact(c *cli.Context, artifact string) error {
+	wd := workingDirectory()
+	dest := wd + artifactPath
+
+	config, err := util.GetConfig()
+	if err != nil {
+		log.Fatalf("Fatal error reading config file: %s \n", err)
+	}
+
+	if err = util.AuthenticateArtifact(artifact, c.String("artifact-sha256"), c.String("artifact-signature"), &config.PGP); err != nil {
+		log.Fatalf("Artifact %s can't be authenticated: %s", artifact, err)
+	}
+
+	if err = os.RemoveAll(dest); err != nil {
+		log.Fatalf("Failed cleaning %s Error: %s", dest, err)
+	}
+
+	log.Printf("Extracting and verifying %s", artifact)
+	manifest, err := util.ExtractArtifact(artifact, dest)
+	if err != nil {
+		log.Fatalf("Invalid artifact %s: %s", artifact, err)
+	}
+
+	host, err := util.DetectPlatform()
+	if err != nil {
+		log.Fatalf("Can't determine the platform of this host: %s", err)
+	}
+
+	if err = manifest.Platform.Compatible(host); err != nil {
+		log.Fatalf("Artifact %s can't be installed on this host: %s", artifact, err)
+	}
+
+	release := &manifest.Release
+	log.Printf("Installing NginX %s with %s %s, built on %s %s at %s", release.NginXVersion, release.TLSLibrary,
+		release.TLSVersion, manifest.Platform.Distro, manifest.Platform.DistroVersion,
+		manifest.Created.Format(time.RFC3339))
+
+	installRelease(release, dest+"/root", c.Bool("upgrade") && !c.Bool("skip-canary"))
+
+	if !c.Bool("upgrade") {
+		// the delivered files are part of the artifact, which mirrors the working directory
+		provisioning := util.PostInstallProvisioning()
+		provisioning.HTTP3 = manifest.HTTP3
+		provision(provisioning, dest)
+	}
+
+	registerDynamicModules(release.ConfPath, release.DynamicModules)
+	pruneReleases(config.KeepReleases)
+
+	if c.Bool("upgrade") {
+		log.Println("\nNginX successfully upgraded! Run 'secnginx upgrade --live' or 'service nginx restart' to start the new version.")
+	} else {
+		log.Println("\nNginX successfully installed! Run 'service nginx start' to start it.")
+	}
+
+	return nil
+}
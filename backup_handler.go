@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/phenomax/secnginx/util"
+	"github.com/urfave/cli"
+)
+
+func listBackups(c *cli.Context) error {
+	backups, err := util.Backups()
+	if err != nil {
+		return err
+	}
+
+	if len(backups) == 0 {
+		log.Printf("No backups below %s", util.BackupsDir)
+		return nil
+	}
+
+	for _, b := range backups {
+		fmt.Printf("%s\n  %s, %d files of %s\n", b.ID, b.Reason, len(b.Files), strings.Join(b.Paths, ", "))
+	}
+
+	return nil
+}
+
+// restoreBackup restores the paths of a backup, the current state is backed up first, so the restore can be
+// undone by restoring that backup
+func restoreBackup(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("please specify the backup to restore, see 'secnginx backup list'")
+	}
+
+	backup, err := util.GetBackup(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	current, err := util.CreateBackup("restoring "+backup.ID, util.BackupPaths)
+	if err != nil {
+		return fmt.Errorf("failed backing up the current state, nothing has been restored: %s", err)
+	}
+	if current != nil {
+		log.Printf("Backed up the current state as %s", current.ID)
+	}
+
+	if err = backup.Restore(); err != nil {
+		return err
+	}
+
+	// pruned after the restore, which may be one of the oldest backups
+	removed, err := util.PruneBackups(util.KeepBackups)
+	if err != nil {
+		log.Printf("Failed pruning old backups Error: %s", err)
+	}
+	for _, id := range removed {
+		log.Printf("Removed old backup %s", id)
+	}
+
+	log.Printf("Restored %s from backup %s. Run 'systemctl daemon-reload' and 'service nginx reload' to apply it",
+		strings.Join(backup.Paths, ", "), backup.ID)
+
+	return nil
+}
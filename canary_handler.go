@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/phenomax/secnginx/util"
+)
+
+// canaryTimeout limits the startup of a canary
+const canaryTimeout = 30 * time.Second
+
+// runCanary starts the release with the live configuration on loopback ports and runs the smoke suite against it.
+// The responses are compared with the ones of the running build, if it can be started as canary as well
+func runCanary(release *util.Release) error {
+	if _, err := os.Stat(release.ConfPath); err != nil {
+		return fmt.Errorf("no live configuration to verify the release with: %s", err)
+	}
+
+	var old []util.SmokeResult
+	if binary, active := activeBinary(release.SbinPath); binary != "" {
+		log.Printf("Starting the running build %s as canary for comparison", binary)
+		results, _, err := smokeCanary(binary, release.ConfPath, active)
+		if err != nil {
+			log.Printf("Warning: the running build can't be started as canary, skipping the comparison: %s", err)
+		}
+		old = results
+	}
+
+	log.Printf("Starting release %s as canary", release.ID)
+	results, canary, err := smokeCanary(release.Binary(), release.ConfPath, release)
+	if err != nil {
+		return err
+	}
+
+	report, failures := canary.Report(results, old)
+	log.Printf("Canary report of release %s:\n  %s", release.ID, strings.Join(report, "\n  "))
+
+	if len(failures) > 0 {
+		return fmt.Errorf("the canary failed:\n  %s", strings.Join(failures, "\n  "))
+	}
+
+	log.Println("Canary passed")
+
+	return nil
+}
+
+// activeBinary returns the binary installed at the sbin path and its release, which is nil for installs
+// predating the versioned installs
+func activeBinary(sbinPath string) (string, *util.Release) {
+	if current := util.CurrentRelease(); current != "" {
+		if release, err := util.GetRelease(current); err == nil {
+			return release.Binary(), release
+		}
+	}
+
+	if _, err := os.Stat(sbinPath); err == nil {
+		return sbinPath, nil
+	}
+
+	return "", nil
+}
+
+// smokeCanary runs the smoke suite against a canary of the binary and stops it afterwards
+func smokeCanary(binary, confPath string, release *util.Release) ([]util.SmokeResult, *util.Canary, error) {
+	canary, err := util.NewCanary(binary, confPath, release)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer canary.Stop()
+
+	if err = canary.Start(canaryTimeout); err != nil {
+		return nil, nil, err
+	}
+
+	return canary.Smoke(), canary, nil
+}
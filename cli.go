@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"os"
+	"time"
 
 	"github.com/urfave/cli"
 )
@@ -11,6 +12,46 @@ var (
 	version = "1.0.0"
 )
 
+// installFlags are shared by the install and plan commands
+var installFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "without-module",
+		Usage: "Compile NginX without the given third party module from config.toml (can be repeated)",
+	},
+	cli.BoolFlag{
+		Name:  "without-dynamic-tls-records",
+		Usage: "Compile NginX without applying the Dynamic TLS Records patch",
+	},
+	cli.BoolFlag{
+		Name:  "locked",
+		Usage: "Refuse to build anything that deviates from the sources and configure arguments in secnginx.lock",
+	},
+	cli.BoolFlag{
+		Name:  "offline",
+		Usage: "Build only from the source cache or the mirror directory, without any network access",
+	},
+	cli.StringFlag{
+		Name:  "mirror-dir",
+		Usage: "Pre-populated mirror directory, which is consulted after the source cache (overrides mirror_dir of config.toml)",
+	},
+	cli.BoolFlag{
+		Name:  "http3",
+		Usage: "Build NginX with HTTP/3 (QUIC) support, using a QUIC capable TLS library, and add QUIC listeners to the delivered configuration",
+	},
+	cli.BoolFlag{
+		Name:  "upgrade",
+		Usage: "Only compile and install NginX, do not change the nginx data",
+	},
+	cli.BoolFlag{
+		Name:  "skip-packages",
+		Usage: "Don't install missing build dependencies via the package manager, e.g. on unsupported distributions",
+	},
+	cli.BoolFlag{
+		Name:  "skip-canary",
+		Usage: "Activate upgrades without verifying them by a canary, which runs the live configuration on loopback ports",
+	},
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "SecNginX"
@@ -23,34 +64,184 @@ func main() {
 			Name:   "install",
 			Usage:  "Build and install NginX and create basic NginX file structure",
 			Action: start,
+			Flags: append(installFlags,
+				cli.StringFlag{
+					Name:  "from-artifact",
+					Usage: "Install an artifact created by 'build --artifact' instead of building NginX, only the post install steps are run",
+				},
+				cli.StringFlag{
+					Name:  "artifact-sha256",
+					Usage: "SHA-256 digest of the artifact as printed by 'build --artifact', obtained from a trusted source",
+				},
+				cli.StringFlag{
+					Name:  "artifact-signature",
+					Usage: "Detached PGP signature of the artifact, verified against the keyring and trusted fingerprints of the [pgp] table",
+				},
+			),
+		},
+		{
+			Name:   "build",
+			Usage:  "Build NginX once and write it into a portable artifact, which can be installed on identical hosts without compilers",
+			Action: buildArtifact,
+			Flags: append(installFlags, cli.StringFlag{
+				Name:  "artifact",
+				Usage: "Path of the gzip compressed artifact to write, e.g. nginx.tar.gz",
+			}),
+		},
+		{
+			Name:   "plan",
+			Usage:  "Compute everything 'install' would do and write it into a plan file, without touching the system",
+			Action: createPlanFile,
+			Flags: append(installFlags, cli.StringFlag{
+				Name:  "out",
+				Value: "secnginx.plan.json",
+				Usage: "Path of the plan file to write",
+			}),
+		},
+		{
+			Name:   "package",
+			Usage:  "Build NginX, install it into a staging directory and create native packages (deb, rpm, apk) from it",
+			Action: buildPackages,
+			Flags: append(installFlags,
+				cli.StringSliceFlag{
+					Name:  "format",
+					Usage: "Package format to create: deb, rpm or apk (can be repeated, defaults to the format of the running distribution)",
+				},
+				cli.StringFlag{
+					Name:  "out",
+					Value: "dist",
+					Usage: "Directory the packages are written to",
+				},
+				cli.IntFlag{
+					Name:  "release",
+					Value: 1,
+					Usage: "Release number of the packages, increase it when repackaging the same NginX version",
+				},
+				cli.StringFlag{
+					Name:  "maintainer",
+					Value: "SecNginX <root@localhost>",
+					Usage: "Maintainer recorded in the packages",
+				},
+			),
+		},
+		{
+			Name:   "versions",
+			Usage:  "List the versioned installs below /opt/secnginx",
+			Action: listReleases,
+		},
+		{
+			Name:      "switch",
+			Usage:     "Activate an installed release, the switch is reverted if NginX rejects the configuration",
+			ArgsUsage: "<release id>",
+			Action:    switchRelease,
+		},
+		{
+			Name:   "rollback",
+			Usage:  "Activate the previously active release",
+			Action: rollbackRelease,
+		},
+		{
+			Name:   "upgrade",
+			Usage:  "Hot swap the running NginX to the active release via USR2, WINCH and QUIT, reverting if the new binary isn't healthy",
+			Action: liveUpgrade,
 			Flags: []cli.Flag{
 				cli.BoolFlag{
-					Name:  "without-brotli-module",
-					Usage: "Compile NginX without the brotli module",
+					Name:  "live",
+					Usage: "Upgrade the running master without dropping connections",
 				},
-				cli.BoolFlag{
-					Name:  "without-cors-module",
-					Usage: "Compile NginX without the CORS filter module",
+				cli.StringFlag{
+					Name:  "pid-path",
+					Usage: "Pid file of the running NginX master (defaults to --pid-path of config.toml)",
 				},
-				cli.BoolFlag{
-					Name:  "without-dynamic-tls-records",
-					Usage: "Compile NginX without applying the Dynamic TLS Records patch",
+				cli.StringFlag{
+					Name:  "health-url",
+					Value: "http://127.0.0.1/",
+					Usage: "URL checked after the old workers have been shut down, any status code below 500 is healthy",
 				},
-				cli.BoolFlag{
-					Name:  "without-headers-more-module",
-					Usage: "Compile NginX without the headers-more module",
+				cli.DurationFlag{
+					Name:  "timeout",
+					Value: 30 * time.Second,
+					Usage: "Time to wait for the new master and a successful health check before reverting",
 				},
-				cli.BoolFlag{
-					Name:  "without-ct-module",
-					Usage: "Compile NginX without the CT module",
+			},
+		},
+		{
+			Name:   "prune",
+			Usage:  "Remove old releases, the active and the previous release are always kept",
+			Action: pruneReleasesCommand,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "keep",
+					Value: 3,
+					Usage: "Number of releases to keep",
 				},
+			},
+		},
+		{
+			Name:   "provision",
+			Usage:  "Reconcile the nginx user, directories, init scripts, configuration and DHParams with the desired state",
+			Action: provisionCommand,
+			Flags: []cli.Flag{
 				cli.BoolFlag{
-					Name:  "without-cookie-flag-module",
-					Usage: "Compile NginX without the cookie-flag module",
+					Name:  "check",
+					Usage: "Only report the drift from the desired state, without changing anything",
 				},
 				cli.BoolFlag{
-					Name:  "upgrade",
-					Usage: "Only compile and install NginX, do not change the nginx data",
+					Name:  "http3",
+					Usage: "Keep the QUIC listeners and Alt-Svc headers in newly installed configuration files",
+				},
+			},
+		},
+		{
+			Name:  "backup",
+			Usage: "List or restore the backups of /etc/nginx, the systemd unit and the init.d script",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "List the backups below /var/backups/secnginx",
+					Action: listBackups,
+				},
+				{
+					Name:      "restore",
+					Usage:     "Verify a backup and swap its paths back in, the current state is backed up first",
+					ArgsUsage: "<backup id>",
+					Action:    restoreBackup,
+				},
+			},
+		},
+		{
+			Name:      "apply",
+			Usage:     "Execute a plan file created by 'plan'",
+			ArgsUsage: "<plan file>",
+			Action:    applyPlanFile,
+		},
+		{
+			Name:  "modules",
+			Usage: "List, enable or disable the installed dynamic modules without rebuilding NginX",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "conf",
+					Value: "/etc/nginx/modules.conf",
+					Usage: "Path of the generated modules.conf",
+				},
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "List all dynamic modules and whether they are loaded",
+					Action: listModules,
+				},
+				{
+					Name:      "enable",
+					Usage:     "Load the given dynamic module",
+					ArgsUsage: "<module>",
+					Action:    enableModule,
+				},
+				{
+					Name:      "disable",
+					Usage:     "Stop loading the given dynamic module",
+					ArgsUsage: "<module>",
+					Action:    disableModule,
 				},
 			},
 		},
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+
+	"github.com/phenomax/secnginx/util"
+	"github.com/urfave/cli"
+)
+
+func listModules(c *cli.Context) error {
+	conf, err := util.ReadModulesConf(c.GlobalString("conf"))
+	if err != nil {
+		return err
+	}
+
+	if len(conf.Modules) == 0 {
+		log.Printf("No dynamic modules registered in %s", c.GlobalString("conf"))
+		return nil
+	}
+
+	for _, m := range conf.Modules {
+		fmt.Printf("%s\t%s\n", m.Name, moduleState(m.Enabled))
+	}
+
+	return nil
+}
+
+func enableModule(c *cli.Context) error {
+	return toggleModule(c, true)
+}
+
+func disableModule(c *cli.Context) error {
+	return toggleModule(c, false)
+}
+
+// toggleModule enables or disables the load_module directives of a dynamic module. The change is reverted,
+// if NginX rejects the resulting configuration
+func toggleModule(c *cli.Context, enabled bool) error {
+	if c.NArg() != 1 {
+		return errors.New("please specify the name of the module")
+	}
+
+	path := c.GlobalString("conf")
+	conf, err := util.ReadModulesConf(path)
+	if err != nil {
+		return err
+	}
+
+	module, ok := conf.Module(c.Args().First())
+	if !ok {
+		return fmt.Errorf("module %s isn't registered in %s. Only modules built with 'dynamic = true' can be toggled", c.Args().First(), path)
+	}
+
+	if module.Enabled == enabled {
+		log.Printf("Module %s is already %s", module.Name, moduleState(enabled))
+		return nil
+	}
+
+	module.Enabled = enabled
+	if err = conf.Write(path); err != nil {
+		return err
+	}
+
+	if _, err = exec.LookPath("nginx"); err != nil {
+		log.Printf("Warning: nginx not found, the configuration hasn't been tested")
+	} else if out, err := exec.Command("nginx", "-t").CombinedOutput(); err != nil {
+		module.Enabled = !enabled
+		if revertErr := conf.Write(path); revertErr != nil {
+			return fmt.Errorf("failed reverting %s: %s", path, revertErr)
+		}
+
+		return fmt.Errorf("NginX rejected the configuration, the change has been reverted:\n%s", out)
+	}
+
+	log.Printf("Module %s has been %s. Run 'service nginx reload' to apply the change.", module.Name, moduleState(enabled))
+
+	return nil
+}
+
+func moduleState(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+
+	return "disabled"
+}
@@ -1,65 +1,71 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
-	"sync"
+	"time"
 
-	"github.com/mholt/archiver"
 	"github.com/phenomax/secnginx/util"
 	"github.com/urfave/cli"
 )
 
 // CLIOptions wrapper for the parsed cli flags
 type CLIOptions struct {
-	Brotli, CORS, DynamicTLS, HeadersMore, CookieFlag, CT, Upgrade bool
+	DynamicTLS, Upgrade, Locked, Offline, HTTP3, SkipCanary, SkipPackages bool
+	WithoutModules                                                        []string
+	MirrorDir                                                             string
 }
 
-const brotliModulePath string = "/build/modules/ngx_brotli"
-const corsModulePath string = "/build/modules/ngx_http_cors_filter"
-const headersMoreModulePath string = "/build/modules/headers-more-nginx-module"
-const ctModulePath string = "/build/modules/nginx-ct"
-const cookieFlagModulePath string = "/build/modules/nginx_cookie_flag_module"
-
+const buildPath = "/build"
 const nginxPath = "/build/nginx"
-const pcrePath = "/build/pcre"
 const zlibPath = "/build/zlib"
-const openSSLPath = "/build/openssl"
 
-// Count - returns the amount of positive cli options in order to determine the amount of download goroutines
-func (cli CLIOptions) Count() int {
-	count := 0
-	if cli.Brotli {
-		count++
-	}
-	if cli.CORS {
-		count++
-	}
-	if cli.HeadersMore {
-		count++
-	}
-	if cli.CT {
-		count++
+// SelectedModules returns the third party modules of the config, which haven't been excluded via --without-module
+func (cli CLIOptions) SelectedModules(config *util.Config) []util.Module {
+	excluded := map[string]bool{}
+	for _, name := range cli.WithoutModules {
+		excluded[name] = true
 	}
-	if cli.CookieFlag {
-		count++
+
+	modules := []util.Module{}
+	for _, m := range config.ThirdPartyModules {
+		if !excluded[m.Name] {
+			modules = append(modules, m)
+		}
 	}
 
-	return count
+	return modules
 }
 
-func start(c *cli.Context) error {
-	config, err := util.GetConfig()
+// dynamicTLSRecordsPatch is the name of the [[patch]] skipped by --without-dynamic-tls-records
+const dynamicTLSRecordsPatch = "dynamic-tls-records"
 
-	if err != nil {
-		log.Fatalf("Fatal error reading config file: %s \n", err)
-		return nil
+// http3MinVersion is the first NginX release shipping ngx_http_v3_module
+const http3MinVersion = "1.25.0"
+
+func start(c *cli.Context) error {
+	if artifact := c.String("from-artifact"); artifact != "" {
+		return installArtifact(c, artifact)
 	}
 
+	wd := workingDirectory()
+	plan := createPlan(c, wd)
+	executePlan(plan, wd)
+
+	return nil
+}
+
+// workingDirectory determines the working directory and exports it as $WD
+func workingDirectory() string {
 	wd, err := os.Getwd()
 	// set working directory as environment variable
 	os.Setenv("WD", wd)
@@ -68,260 +74,388 @@ func start(c *cli.Context) error {
 		log.Fatalf("Can't determine working directory: %s \n", err)
 	}
 
-	cliOptions := &CLIOptions{
-		!c.Bool("without-brotli-module"),
-		!c.Bool("without-cors-module"),
-		!c.Bool("without-dynamic-tls-module"),
-		!c.Bool("without-headers-more-module"),
-		!c.Bool("without-cookie-flag-module"),
-		!c.Bool("without-ct-module"),
-		c.Bool("upgrade"),
-	}
+	return wd
+}
 
-	installRequiredPackages()
-	loadDependencies(config, cliOptions, wd)
-	configureNginX(config, cliOptions, wd)
+// createPlan computes everything an install with the given cli flags is going to do, without touching the system
+func createPlan(c *cli.Context, wd string) *util.Plan {
+	config, err := util.GetConfig()
 
-	if cliOptions.DynamicTLS {
-		applyDynamicTLSRecordsPatch(wd)
+	if err != nil {
+		log.Fatalf("Fatal error reading config file: %s \n", err)
 	}
 
-	makeAndInstallNginX(wd)
-
-	if !cliOptions.Upgrade {
-		log.Println("Setting up NginX user")
-		util.SetupNginxUser()
-		log.Println("Setting up Init.D script")
-		util.SetupInitD()
-		log.Println("Setting up SystemD")
-		util.SetupSystemd()
-		log.Println("Setting up NginX file structure")
-		util.SetupFileStructure()
-		log.Println("Generating strong DHParams")
-		util.GenerateDHParams()
-
-		log.Println("\nNginX successfully installed! Run 'service nginx start' to start it.")
-		log.Println("Don't forget to check the further steps, described in the README.me in order to deploy a secure NginX installation!")
-	} else {
-		log.Println("\nNginX successfully upgraded! Run 'service nginx restart' to start the new version.")
-		log.Println("Don't forget to check the further steps, described in the README.me in order to deploy a secure NginX installation!")
+	cliOptions := &CLIOptions{
+		DynamicTLS:     !c.Bool("without-dynamic-tls-records"),
+		Upgrade:        c.Bool("upgrade"),
+		Locked:         c.Bool("locked"),
+		Offline:        c.Bool("offline"),
+		HTTP3:          c.Bool("http3"),
+		SkipCanary:     c.Bool("skip-canary"),
+		SkipPackages:   c.Bool("skip-packages"),
+		WithoutModules: c.StringSlice("without-module"),
+		MirrorDir:      c.String("mirror-dir"),
 	}
 
-	return nil
-}
+	for _, name := range cliOptions.WithoutModules {
+		if !config.HasModule(name) {
+			log.Fatalf("Unknown module %s passed to --without-module. Check the [[module]] tables in config.toml", name)
+		}
+	}
 
-func installRequiredPackages() {
-	log.Println("Installing dependencies via apt")
+	selectTLSLibrary(config, cliOptions, wd)
 
-	exec.Command("apt", "update").Run()
-	exec.Command("apt", "install", "-y", "build-essential", "cmake", "git",
-	"libpcre3-dev", "curl", "libcurl4-openssl-dev", "zlib1g-dev", "automake").Run()
-}
+	// LibreSSL and BoringSSL don't understand OpenSSL's configure options
+	if config.Profile.Performance() && len(config.Profile.OpenSSLOptions) > 0 && config.TLSLibrary.Name != "openssl" && config.TLSLibrary.Name != "quictls" {
+		log.Fatalf("openssl_options of the [performance] table aren't supported by %s", config.TLSLibrary.Title)
+	}
 
-func loadDependencies(config *util.Config, cliOptions *CLIOptions, wd string) {
-	// clear previous builds
-	os.RemoveAll(wd + "/build/")
-	os.MkdirAll(wd+"/build/modules", os.ModePerm)
+	// CET is only available on x86
+	if config.Hardening.CET && runtime.GOARCH != "amd64" && runtime.GOARCH != "386" {
+		log.Printf("Warning: CET isn't supported on %s, skipping it", runtime.GOARCH)
+		config.Hardening.CET = false
+	}
 
-	var wg sync.WaitGroup
-	var err error
-	wg.Add(4 + cliOptions.Count())
+	plan := &util.Plan{
+		Components:      config.Components(),
+		TLSLibrary:      config.TLSLibrary,
+		Hardening:       config.Hardening,
+		Profile:         config.Profile,
+		Modules:         cliOptions.SelectedModules(config),
+		PGP:             config.PGP,
+		Cache:           util.Cache{Dir: config.CacheDir, MirrorDir: config.MirrorDir, Offline: cliOptions.Offline},
+		DownloadWorkers: config.DownloadWorkers,
+		KeepReleases:    config.KeepReleases,
+		Upgrade:         cliOptions.Upgrade,
+		Canary:          cliOptions.Upgrade && !cliOptions.SkipCanary,
+	}
 
-	// download nginx
-	go func() {
-		log.Println("Downloading NginX version " + config.NginXVersion)
-		err = util.DownloadFile(fmt.Sprintf("https://nginx.org/download/nginx-%s.tar.gz", config.NginXVersion), "build/nginx.tar.gz")
+	if !cliOptions.SkipPackages {
+		distro, err := util.DetectDistro()
+		if err == nil {
+			var pm *util.PackageManager
+			pm, err = distro.PackageManager()
+			if err == nil {
+				plan.PackageManager = pm.Name
+				dependencies := append(append([]string{}, util.BuildDependencies...),
+					util.TLSBuildDependencies(config.TLSLibrary, config.TLSVersions[config.TLSLibrary.Name])...)
+				plan.Packages = pm.Resolve(dependencies)
+			}
+		}
 
 		if err != nil {
-			log.Fatalf("Failed downloading selected NginX version! Is the version number valid?\n Error: %s", err)
-			os.Exit(0)
+			log.Fatalf("Fatal error: %s. Pass --skip-packages to build anyway, once all build dependencies are installed", err)
 		}
+	}
 
-		// extract archive
-		log.Println("Extracting NginX")
-		err = archiver.TarGz.Open("build/nginx.tar.gz", "build")
-		os.Rename("build/nginx-"+config.NginXVersion, "build/nginx")
+	if cliOptions.MirrorDir != "" {
+		plan.Cache.MirrorDir = cliOptions.MirrorDir
+	}
 
+	if cliOptions.Locked {
+		plan.Lock, err = util.ReadLockfile(util.LockfileName)
 		if err != nil {
-			log.Fatalf("Failed extracting NginX!\n Error: %s", err)
-			os.Exit(0)
+			log.Fatalf("Locked mode requires a valid %s: %s", util.LockfileName, err)
 		}
+	}
 
-		wg.Done()
-	}()
+	for _, arg := range configureArguments(config, cliOptions, wd) {
+		plan.ConfigureArguments = append(plan.ConfigureArguments, strings.Replace(arg, wd, "$WD", -1))
+	}
 
-	// download pcre
-	go func() {
-		log.Println("Downloading PCRE version " + config.PCREVersion)
-		err = util.DownloadFile(fmt.Sprintf("https://ftp.pcre.org/pub/pcre/pcre-%s.tar.gz", config.PCREVersion), "build/pcre.tar.gz")
+	if plan.Lock != nil {
+		if err = plan.Lock.VerifyConfigureArguments(&util.Lockfile{ConfigureArguments: plan.ConfigureArguments}); err != nil {
+			log.Fatalf("Refusing to build in locked mode: %s", err)
+		}
+	}
 
-		if err != nil {
-			log.Fatalf("Failed downloading selected PCRE version! Is the version number valid?\n Error: %s", err)
-			os.Exit(0)
+	for _, patch := range config.Patches {
+		if patch.Name == dynamicTLSRecordsPatch && !cliOptions.DynamicTLS {
+			continue
 		}
 
-		// extract archive
-		log.Println("Extracting PCRE")
-		err = archiver.TarGz.Open("build/pcre.tar.gz", "build")
-		os.Rename("build/pcre-"+config.PCREVersion, "build/pcre")
+		_, version, ok := plan.PatchTarget(patch.Component, "")
+		if !ok {
+			log.Printf("Skipping patch %s, because %s isn't part of this build", patch.Name, patch.Component)
+			continue
+		}
 
-		if err != nil {
-			log.Fatalf("Failed extracting PCRE!\n Error: %s", err)
-			os.Exit(0)
+		if !patch.Applies(version) {
+			log.Printf("Skipping patch %s, because it only supports %s %s", patch.Name, patch.Component, patch.Versions)
+			continue
 		}
 
-		// fix for "aclocal-1.15: command not found" error on NginX make
-		cmd := exec.Command("autoreconf", "-f", "-i")
-		cmd.Dir = wd + pcrePath
-		cmd.Run()
+		plan.Patches = append(plan.Patches, patch)
+	}
 
-		wg.Done()
-	}()
+	if !cliOptions.Upgrade {
+		plan.Provisioning = util.PostInstallProvisioning()
+		plan.Provisioning.HTTP3 = cliOptions.HTTP3
+	}
 
-	// download zlib
-	go func() {
-		log.Println("Downloading ZLib version " + config.ZLibVersion)
-		err = util.DownloadFile(fmt.Sprintf("https://zlib.net/zlib-%s.tar.gz", config.ZLibVersion), "build/zlib.tar.gz")
+	return plan
+}
 
-		if err != nil {
-			log.Fatalf("Failed downloading selected ZLib version! Is the version number valid?\n Error: %s", err)
-			os.Exit(0)
-		}
+// selectTLSLibrary checks the configured TLS library against the compatibility matrix. HTTP/3 builds switch to the
+// first configured QUIC capable library, if required
+func selectTLSLibrary(config *util.Config, cliOptions *CLIOptions, wd string) {
+	// fresh installs deploy the delivered configuration, upgrades keep the installed one
+	confDir := filepath.Dir(config.ConfigureArgument("--conf-path", "/usr/local/nginx/conf/nginx.conf"))
+	if !cliOptions.Upgrade {
+		confDir = wd + "/nginx"
+	}
 
-		// extract archive
-		log.Println("Extracting ZLib")
-		err = archiver.TarGz.Open("build/zlib.tar.gz", "build")
-		os.Rename("build/zlib-"+config.ZLibVersion, "build/zlib")
+	features := []string{}
+	if util.UsesDHE(confDir) {
+		features = append(features, util.FeatureDHE)
+	}
 
-		if err != nil {
-			log.Fatalf("Failed extracting ZLib!\n Error: %s", err)
-			os.Exit(0)
+	if cliOptions.HTTP3 {
+		if util.CompareVersions(config.NginXVersion, http3MinVersion) < 0 {
+			log.Fatalf("HTTP/3 requires NginX %s or newer, but %s is configured", http3MinVersion, config.NginXVersion)
 		}
+		features = append(features, util.FeatureHTTP3)
+	}
 
-		wg.Done()
-	}()
+	modules := cliOptions.SelectedModules(config)
+	err := util.CheckTLSCompatibility(config.TLSLibrary, modules, features)
+	if err == nil {
+		return
+	}
 
-	// download openssl
-	go func() {
-		log.Println("Downloading OpenSSL version " + config.OpenSSLVersion)
-		err = util.DownloadFile(fmt.Sprintf("https://www.openssl.org/source/openssl-%s.tar.gz", config.OpenSSLVersion), "build/openssl.tar.gz")
+	if !cliOptions.HTTP3 {
+		log.Fatalf("Fatal error: %s", err)
+	}
 
-		if err != nil {
-			log.Fatalf("Failed downloading OpenSSL ZLib version! Is the version number valid?\n Error: %s", err)
-			os.Exit(0)
-		}
+	library, ok := config.CompatibleTLSLibrary(modules, features)
+	if !ok {
+		log.Fatalf("Fatal error: %s\nNo compatible TLS library is configured, please set e.g. quictls_version and its checksum", err)
+	}
 
-		// extract archive
-		log.Println("Extracting OpenSSL")
-		err := archiver.TarGz.Open("build/openssl.tar.gz", "build")
-		os.Rename("build/openssl-"+config.OpenSSLVersion, "build/openssl")
+	if err = config.UseTLSLibrary(library); err != nil {
+		log.Fatalf("Fatal error reading config file: %s", err)
+	}
+	log.Printf("Using %s instead of the configured TLS library, because it supports HTTP/3", library.Title)
+}
+
+// executePlan builds and installs NginX exactly as described by the plan
+func executePlan(plan *util.Plan, wd string) {
+	resolved, security := buildNginX(plan, wd)
+
+	staging := stageNginX(wd)
+	release := newRelease(plan, dynamicModules(plan, wd, staging))
+	installRelease(release, staging, plan.Canary)
+	writeLockfile(plan, resolved)
+
+	if plan.Provisioning != nil {
+		provision(plan.Provisioning, wd)
+	}
+
+	registerDynamicModules(release.ConfPath, release.DynamicModules)
+	pruneReleases(plan.KeepReleases)
+
+	log.Printf("Build summary: NginX %s with %s, build profile %s, hardening: %s", plan.Components[0].Version,
+		plan.TLSLibrary.Title, plan.Profile, security)
+
+	if plan.Provisioning != nil {
+		log.Println("\nNginX successfully installed! Run 'service nginx start' to start it.")
+		log.Println("Don't forget to check the further steps, described in the README.me in order to deploy a secure NginX installation!")
+	} else {
+		log.Println("\nNginX successfully upgraded! Run 'secnginx upgrade --live' or 'service nginx restart' to start the new version.")
+		log.Println("Don't forget to check the further steps, described in the README.me in order to deploy a secure NginX installation!")
+	}
+}
 
+// writeLockfile records the resolved sources, unless the build has been locked to an existing lockfile
+func writeLockfile(plan *util.Plan, resolved *util.Lockfile) {
+	if plan.Lock != nil {
+		return
+	}
+
+	if err := resolved.Write(util.LockfileName); err != nil {
+		log.Printf("Failed writing %s Error: %s", util.LockfileName, err)
+	} else {
+		log.Printf("Resolved sources have been written to %s", util.LockfileName)
+	}
+}
+
+// provision reconciles the post install resources: the nginx user, the directories, init scripts, the delivered
+// configuration and DHParams. The delivered files are taken from dir, resources already in the desired state are
+// left untouched
+func provision(provisioning *util.Provisioning, dir string) {
+	log.Println("Provisioning the NginX user, file structure and init scripts")
+	if _, err := util.Reconcile(provisioning.Resources(dir), false); err != nil {
+		log.Fatalf("Fatal error: %s", err)
+	}
+}
+
+// buildNginX loads, patches, builds and verifies NginX as described by the plan, without installing it.
+// It returns the resolved sources and the verified security properties of the binary
+func buildNginX(plan *util.Plan, wd string) (*util.Lockfile, *util.ELFSecurity) {
+	installRequiredPackages(plan)
+
+	resolved, err := loadDependencies(plan, wd)
+	if err != nil {
+		log.Fatalf("Fatal error while loading sources: %s", err)
+	}
+	resolved.ConfigureArguments = plan.ConfigureArguments
+
+	// patches are applied before anything is built, so broken ones fail early
+	for _, patch := range plan.Patches {
+		dir, _, _ := plan.PatchTarget(patch.Component, wd+buildPath)
+
+		log.Printf("Applying patch %s to %s", patch.Name, patch.Component)
+		applied, err := patch.Apply(wd, dir)
 		if err != nil {
-			log.Fatalf("Failed extracting OpenSSL!\n Error: %s", err)
-			os.Exit(0)
+			log.Fatalf("Fatal error: %s", err)
 		}
+		resolved.Patches = append(resolved.Patches, applied)
+	}
 
-		wg.Done()
-	}()
+	if plan.Lock != nil {
+		if err = plan.Lock.VerifyPatches(resolved); err != nil {
+			log.Fatalf("Refusing to build in locked mode: %s", err)
+		}
+	}
 
-	if cliOptions.Brotli {
-		go func() {
-			log.Println("Downloading ngx_brotli module")
-			cmd := exec.Command("git", "clone", "https://github.com/google/ngx_brotli.git")
-			cmd.Dir = wd + "/build/modules/"
-			err := cmd.Run()
+	if plan.TLSLibrary.Prebuilt {
+		buildTLSLibrary(plan.TLSLibrary, wd)
+	}
 
-			if err != nil {
-				log.Fatalf("Failed downloading ngx_brotli!\n Error: %s", err)
-				os.Exit(0)
-			}
+	configureNginX(plan.Arguments(wd), wd)
 
-			cmd = exec.Command("git", "submodule", "update", "--init")
-			cmd.Dir = wd + brotliModulePath
-			err = cmd.Run()
+	if plan.TLSLibrary.Prebuilt {
+		// the prebuilt headers have to be newer than NginX's Makefile, otherwise make tries to build the library
+		now := time.Now()
+		os.Chtimes(wd+buildPath+"/"+plan.TLSLibrary.Name+"/.openssl/include/openssl/ssl.h", now, now)
+	}
 
-			if err != nil {
-				log.Fatalf("Failed updating submodules for ngx_brotli!\n Error: %s", err)
-				os.Exit(0)
-			}
+	makeNginX(wd, plan.Profile.Jobs)
 
-			wg.Done()
-		}()
+	security, err := plan.Hardening.Verify(wd + nginxPath + "/objs/nginx")
+	if err != nil {
+		log.Fatalf("Hardening verification failed, refusing to install NginX: %s", err)
 	}
+	log.Printf("Hardening verified: %s", security)
 
-	if cliOptions.CORS {
-		go func() {
-			log.Println("Downloading ngx_http_cors_filter module")
-			cmd := exec.Command("git", "clone", "https://github.com/x-v8/ngx_http_cors_filter.git")
-			cmd.Dir = wd + "/build/modules/"
-			err := cmd.Run()
+	if err = verifyBuild(plan, wd); err != nil {
+		log.Fatalf("Build verification failed, refusing to install NginX: %s", err)
+	}
 
-			if err != nil {
-				log.Fatalf("Failed downloading ngx_http_cors_filter!\n Error: %s", err)
-				os.Exit(0)
-			}
+	return resolved, security
+}
 
-			wg.Done()
-		}()
+// installRequiredPackages installs all missing build dependencies of the plan and aborts on failure
+func installRequiredPackages(plan *util.Plan) {
+	if plan.PackageManager == "" {
+		log.Println("Skipping package installation, make sure all build dependencies are installed")
+		return
 	}
 
-	if cliOptions.HeadersMore {
-		go func() {
-			log.Println("Downloading headers_more-nginx module")
-			cmd := exec.Command("git", "clone", "https://github.com/openresty/headers-more-nginx-module.git")
-			cmd.Dir = wd + "/build/modules/"
-			err := cmd.Run()
+	pm, err := util.GetPackageManager(plan.PackageManager)
+	if err != nil {
+		log.Fatalf("Fatal error while installing dependencies: %s", err)
+	}
 
-			if err != nil {
-				log.Fatalf("Failed downloading headers_more_nginx module!\n Error: %s", err)
-				os.Exit(0)
-			}
+	missing := pm.Missing(plan.Packages)
+	if len(missing) == 0 {
+		log.Println("All build dependencies are installed")
+		return
+	}
 
-			wg.Done()
-		}()
+	log.Printf("Missing packages: %s", strings.Join(missing, " "))
+
+	if plan.Cache.Offline {
+		log.Fatalf("Missing packages can't be installed in offline mode. Please install them manually: %s", strings.Join(missing, " "))
+	}
+
+	log.Printf("Installing dependencies via %s", pm.Name)
+	if err = pm.Install(missing); err != nil {
+		log.Fatalf("Failed installing the build dependencies, aborting!\n Error: %s", err)
 	}
+}
 
-	if cliOptions.CT {
-		go func() {
-			log.Println("Downloading nginx_ct module")
-			cmd := exec.Command("git", "clone", "https://github.com/grahamedgecombe/nginx-ct.git")
-			cmd.Dir = wd + "/build/modules/"
-			err := cmd.Run()
+// loadDependencies loads all components and selected modules using a pool of download workers and returns their
+// resolved sources. If a lockfile is given, modules are checked out at the locked commits and all sources must match it
+func loadDependencies(plan *util.Plan, wd string) (*util.Lockfile, error) {
+	// clear previous builds
+	os.RemoveAll(wd + "/build/")
+	os.MkdirAll(wd+"/build/modules", os.ModePerm)
+
+	cache := &plan.Cache
+	locked := plan.Lock
+	jobs := []util.FetchJob{}
 
+	for _, c := range plan.Components {
+		c := c
+		jobs = append(jobs, util.FetchJob{Name: c.Name, Run: func(ctx context.Context) (util.LockedSource, error) {
+			log.Printf("Loading %s version %s", c.Title, c.Version)
+			source, err := c.Fetch(ctx, wd+buildPath, cache)
 			if err != nil {
-				log.Fatalf("Failed downloading nginx_ct!\n Error: %s", err)
-				os.Exit(0)
+				return source, err
 			}
 
-			wg.Done()
-		}()
-	}
+			if c.Name == "pcre" {
+				// fix for "aclocal-1.15: command not found" error on NginX make, PCRE2 releases aren't affected
+				cmd := exec.Command("autoreconf", "-f", "-i")
+				cmd.Dir = c.Path(wd + buildPath)
+				cmd.Run()
+			}
 
-	if cliOptions.CookieFlag {
-		go func() {
-			log.Println("Downloading cookie_flag module")
-			cmd := exec.Command("git", "clone", "https://github.com/AirisX/nginx_cookie_flag_module.git")
-			cmd.Dir = wd + "/build/modules/"
-			err := cmd.Run()
+			return source, nil
+		}})
+	}
 
-			if err != nil {
-				log.Fatalf("Failed downloading cookie_flag!\n Error: %s", err)
-				os.Exit(0)
+	for _, m := range plan.Modules {
+		m := m
+		jobs = append(jobs, util.FetchJob{Name: m.Name, Run: func(ctx context.Context) (util.LockedSource, error) {
+			commit := ""
+			if locked != nil {
+				lockedSource, ok := locked.Source(m.Name)
+				if !ok || lockedSource.Ref != m.Ref {
+					return util.LockedSource{}, fmt.Errorf("module deviates from %s, refusing to build in locked mode", util.LockfileName)
+				}
+				commit = lockedSource.Commit
 			}
 
-			wg.Done()
-		}()
+			log.Printf("Loading %s module", m.Name)
+			return m.Fetch(ctx, wd+buildPath, commit, cache)
+		}})
 	}
 
-	wg.Wait()
+	// cancel all downloads on CTRL+C
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	go func() {
+		select {
+		case <-interrupt:
+			log.Println("Interrupted, cancelling all downloads")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	resolved, err := util.FetchAll(ctx, plan.DownloadWorkers, jobs)
 	if err != nil {
-		log.Fatalf("Fatal error while downloading files: %s", err)
+		return nil, err
 	}
-}
 
-func configureNginX(config *util.Config, cliOptions *CLIOptions, wd string) {
-	log.Println("Configuring NginX\n")
+	if locked != nil {
+		if err = locked.VerifySources(resolved); err != nil {
+			return nil, fmt.Errorf("refusing to build in locked mode: %s", err)
+		}
+	}
+
+	return resolved, nil
+}
 
+// configureArguments assembles the NginX configure arguments from the config and the selected modules
+func configureArguments(config *util.Config, cliOptions *CLIOptions, wd string) []string {
 	// configure NginX with the specified parameters
 	configParams := append(regexp.MustCompile("\n").Split(config.Configuration, -1), regexp.MustCompile("\n").Split(config.Modules, -1)...)
 
@@ -339,55 +473,275 @@ func configureNginX(config *util.Config, cliOptions *CLIOptions, wd string) {
 		if strings.Contains(e, "--with-openssl=") || strings.Contains(e, "--with-pcre=") || strings.Contains(e, " --with-zlib=") {
 			log.Fatalf("Illegal config parameter %s found! Please remove, because SecNginX will set it.", e)
 		}
-		configParams[i] = strings.Replace(e, " ", "", -1)
+		configParams[i] = strings.TrimSpace(e)
 	}
 
-	if cliOptions.Brotli {
-		configParams = append(configParams, "--add-module="+wd+brotliModulePath)
+	for _, m := range cliOptions.SelectedModules(config) {
+		configParams = append(configParams, m.ConfigureFlag(wd+buildPath))
 	}
-	if cliOptions.CORS {
-		configParams = append(configParams, "--add-module="+wd+corsModulePath)
+
+	if cliOptions.HTTP3 && !strings.Contains(config.Configuration+config.Modules, "--with-http_v3_module") {
+		configParams = append(configParams, "--with-http_v3_module")
 	}
-	if cliOptions.HeadersMore {
-		configParams = append(configParams, "--add-module="+wd+headersMoreModulePath)
+
+	for _, opt := range config.Hardening.CCOptions() {
+		configParams = appendConfigureOption(configParams, "--with-cc-opt", opt)
 	}
-	if cliOptions.CT {
-		configParams = append(configParams, "--add-module="+wd+ctModulePath)
+	for _, opt := range config.Hardening.LDOptions() {
+		configParams = appendConfigureOption(configParams, "--with-ld-opt", opt)
 	}
-	if cliOptions.CookieFlag {
-		configParams = append(configParams, "--add-module="+wd+cookieFlagModulePath)
+	for _, opt := range config.Hardening.LibraryOptions() {
+		configParams = appendConfigureOption(configParams, "--with-pcre-opt", opt)
+		configParams = appendConfigureOption(configParams, "--with-zlib-opt", opt)
+		if !config.TLSLibrary.Prebuilt {
+			configParams = appendConfigureOption(configParams, "--with-openssl-opt", opt)
+		}
 	}
 
-	// append OpenSSL, PCRE and ZLib
-	configParams = append(configParams, "--with-openssl="+wd+openSSLPath, "--with-pcre="+wd+pcrePath, "--with-zlib="+wd+zlibPath)
+	// the profile's options are appended after the hardening ones, so its optimization level wins
+	for _, opt := range config.Profile.CCOptions() {
+		configParams = appendConfigureOption(configParams, "--with-cc-opt", opt)
+	}
+	for _, opt := range config.Profile.LDOptions() {
+		configParams = appendConfigureOption(configParams, "--with-ld-opt", opt)
+	}
+	for _, opt := range config.Profile.LibraryOptions() {
+		configParams = appendConfigureOption(configParams, "--with-pcre-opt", opt)
+		configParams = appendConfigureOption(configParams, "--with-zlib-opt", opt)
+		if !config.TLSLibrary.Prebuilt {
+			configParams = appendConfigureOption(configParams, "--with-openssl-opt", opt)
+		}
+	}
+	if config.Profile.Performance() {
+		for _, opt := range config.Profile.OpenSSLOptions {
+			configParams = appendConfigureOption(configParams, "--with-openssl-opt", opt)
+		}
+	}
 
-	cmd := exec.Command("./configure", configParams...)
-	cmd.Dir = wd + nginxPath
+	// BoringSSL is partly written in C++
+	if config.TLSLibrary.Name == "boringssl" {
+		configParams = appendConfigureOption(configParams, "--with-ld-opt", "-lstdc++")
+	}
+
+	// NginX prefers PCRE2 since 1.21.5
+	if config.PCREFlavor == "pcre" && util.CompareVersions(config.NginXVersion, util.PCRE2MinNginXVersion) >= 0 {
+		configParams = append(configParams, "--without-pcre2")
+	}
+
+	// append the TLS library, PCRE and ZLib
+	configParams = append(configParams, "--with-openssl="+wd+buildPath+"/"+config.TLSLibrary.Name, "--with-pcre="+wd+buildPath+"/"+config.PCREFlavor, "--with-zlib="+wd+zlibPath)
+
+	return configParams
+}
+
+// appendConfigureOption adds value to the given compiler or linker option (e.g. --with-cc-opt), keeping configured values
+func appendConfigureOption(configParams []string, name, value string) []string {
+	for i, param := range configParams {
+		if strings.HasPrefix(param, name+"=") {
+			configParams[i] = param + " " + value
+			return configParams
+		}
+	}
+
+	return append(configParams, name+"="+value)
+}
+
+// buildTLSLibrary builds TLS libraries, which NginX can't build itself, and lays them out the way NginX expects
+// a built OpenSSL: <dir>/.openssl/include and <dir>/.openssl/lib
+func buildTLSLibrary(library util.TLSLibrary, wd string) {
+	log.Printf("Building %s", library.Title)
+	dir := wd + buildPath + "/" + library.Name
+
+	cmd := exec.Command("cmake", "-B", "build", "-DCMAKE_BUILD_TYPE=Release", "-DCMAKE_POSITION_INDEPENDENT_CODE=ON")
+	cmd.Dir = dir
+	util.RunAndPrintCommandOutput(cmd)
+
+	cmd = exec.Command("make", "-C", "build", "ssl", "crypto")
+	cmd.Dir = dir
 	util.RunAndPrintCommandOutput(cmd)
+
+	if err := os.MkdirAll(dir+"/.openssl/lib", os.ModePerm); err != nil {
+		log.Fatalf("Fatal error while building %s: %s", library.Title, err)
+	}
+
+	if err := os.Symlink("../include", dir+"/.openssl/include"); err != nil {
+		log.Fatalf("Fatal error while building %s: %s", library.Title, err)
+	}
+
+	// older releases place the libraries into subdirectories of the build directory
+	for _, lib := range []string{"libssl.a", "libcrypto.a"} {
+		matches, _ := filepath.Glob(dir + "/build/" + lib)
+		if len(matches) == 0 {
+			matches, _ = filepath.Glob(dir + "/build/*/" + lib)
+		}
+
+		if len(matches) == 0 {
+			log.Fatalf("Fatal error while building %s: %s hasn't been built", library.Title, lib)
+		}
+
+		util.CopyFile(matches[0], dir+"/.openssl/lib/"+lib)
+	}
 }
 
-func applyDynamicTLSRecordsPatch(wd string) {
-	log.Println("Applying Dynamic TLS Records patch to NginX")
+func configureNginX(configParams []string, wd string) {
+	log.Println("Configuring NginX\n")
+
+	// source checkouts of NginX ship the configure script in auto/, release tarballs in the root directory
+	script := "./configure"
+	if _, err := os.Stat(wd + nginxPath + "/configure"); os.IsNotExist(err) {
+		script = "./auto/configure"
+	}
 
-	cmd := exec.Command("patch", "-p1", fmt.Sprintf("<%s/files/NginX-Dynamic-TLS-Records.patch", wd))
+	cmd := exec.Command(script, configParams...)
 	cmd.Dir = wd + nginxPath
-	err := cmd.Run()
+	util.RunAndPrintCommandOutput(cmd)
+}
+
+// dynamicModules returns the shared objects of all dynamic modules and checks whether 'make install' installed them
+// into the modules path. root is the DESTDIR of the install
+func dynamicModules(plan *util.Plan, wd, root string) []util.DynamicModule {
+	modulesPath := plan.ConfigureArgument("--modules-path", "/usr/local/nginx/modules")
 
+	modules := []util.DynamicModule{}
+	for _, m := range plan.Modules {
+		if !m.Dynamic {
+			continue
+		}
+
+		files, err := m.SharedObjects(wd+buildPath, wd+nginxPath+"/objs")
+		if err != nil {
+			log.Fatalf("Fatal error while installing dynamic modules: %s", err)
+		}
+
+		module := util.DynamicModule{Name: m.Name, Enabled: true}
+		for _, file := range files {
+			installed := filepath.Join(modulesPath, file)
+			if _, err = os.Stat(filepath.Join(root, installed)); err != nil {
+				log.Fatalf("Dynamic module %s hasn't been installed: %s", m.Name, err)
+			}
+			module.Files = append(module.Files, installed)
+		}
+		modules = append(modules, module)
+	}
+
+	return modules
+}
+
+// registerDynamicModules adds the modules to the modules.conf next to nginxConf, keeping disabled modules disabled
+func registerDynamicModules(nginxConf string, modules []util.DynamicModule) {
+	modulesConf := filepath.Join(filepath.Dir(nginxConf), util.ModulesConfName)
+
+	conf, err := util.ReadModulesConf(modulesConf)
 	if err != nil {
-		log.Fatalf("Fatal error while applying Dynamic TLS Records patch to NginX: %s", err)
+		log.Fatalf("Fatal error reading %s: %s", modulesConf, err)
+	}
+	conf.Update(modules)
+
+	if err = conf.Write(modulesConf); err != nil {
+		log.Fatalf("Failed writing %s Error: %s", modulesConf, err)
+	}
+
+	if len(modules) == 0 {
+		return
+	}
+
+	log.Printf("Dynamic modules have been registered in %s", modulesConf)
+
+	// configurations of previous installs don't include modules.conf yet
+	if data, err := ioutil.ReadFile(nginxConf); err == nil && !strings.Contains(string(data), util.ModulesConfName) {
+		log.Printf("Warning: %s doesn't include %s, please add 'include %s;' to its main context", nginxConf, util.ModulesConfName, util.ModulesConfName)
 	}
 }
 
-func makeAndInstallNginX(wd string) {
-	log.Println("Running 'make' NginX")
+func makeNginX(wd string, jobs int) {
+	log.Printf("Running 'make -j%d' NginX", jobs)
 
-	cmd := exec.Command("make")
+	cmd := exec.Command("make", fmt.Sprintf("-j%d", jobs))
 	cmd.Dir = wd + nginxPath
 	util.RunAndPrintCommandOutput(cmd)
+}
 
+// verifyBuild compares the output of the built binary's 'nginx -V' with the plan: the NginX and TLS library versions,
+// all configure arguments and the symbols of the applied patches
+func verifyBuild(plan *util.Plan, wd string) error {
+	binary := wd + nginxPath + "/objs/nginx"
+	build, err := util.InspectNginX(binary)
+	if err != nil {
+		return err
+	}
+
+	mismatches := []string{}
+	nginx, tls := plan.Components[0], plan.Components[len(plan.Components)-1]
+
+	if build.Version != nginx.Version {
+		mismatches = append(mismatches, fmt.Sprintf("NginX version %s requested, but %s built", nginx.Version, build.Version))
+	}
+
+	// QuicTLS reports itself as OpenSSL without the -quic suffix, BoringSSL isn't versioned
+	expected := "OpenSSL " + strings.Split(tls.Version, "-")[0]
+	switch plan.TLSLibrary.Name {
+	case "libressl":
+		expected = "LibreSSL " + tls.Version
+	case "boringssl":
+		expected = "BoringSSL"
+	}
+	if !strings.Contains(build.TLSLibrary, expected) {
+		mismatches = append(mismatches, fmt.Sprintf("%s requested, but built with %s", expected, build.TLSLibrary))
+	}
+
+	requested := map[string]bool{}
+	for _, arg := range plan.Arguments(wd) {
+		requested[arg] = true
+		if !build.HasArgument(arg) {
+			mismatches = append(mismatches, "configure argument missing: "+arg)
+		}
+	}
+	for _, arg := range build.ConfigureArguments {
+		if !requested[arg] {
+			mismatches = append(mismatches, "unexpected configure argument: "+arg)
+		}
+	}
+
+	for _, patch := range plan.Patches {
+		missing, err := util.MissingStrings(binary, patch.Symbols)
+		if err != nil {
+			return err
+		}
+
+		if len(missing) > 0 {
+			mismatches = append(mismatches, fmt.Sprintf("patch %s hasn't been applied, missing %s", patch.Name, strings.Join(missing, ", ")))
+		}
+	}
+
+	if len(mismatches) > 0 {
+		return fmt.Errorf("the built NginX deviates from the requested one:\n  %s", strings.Join(mismatches, "\n  "))
+	}
+
+	log.Printf("Build verified: NginX %s built with %s", build.Version, build.TLSLibrary)
+
+	return nil
+}
+
+// stageNginX runs 'make install' into the empty staging directory and returns it
+func stageNginX(wd string) string {
+	staging := wd + stagingPath
+	if err := os.RemoveAll(staging); err != nil {
+		log.Fatalf("Failed cleaning %s Error: %s", staging, err)
+	}
+
+	installNginX(wd, staging)
+
+	return staging
+}
+
+// installNginX runs 'make install', root is used as DESTDIR if set
+func installNginX(wd, root string) {
 	log.Println("Running 'make install' NginX")
 
-	cmd = exec.Command("make", "install")
+	cmd := exec.Command("make", "install")
+	if root != "" {
+		cmd.Args = append(cmd.Args, "DESTDIR="+root)
+	}
 	cmd.Dir = wd + nginxPath
 	util.RunAndPrintCommandOutput(cmd)
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/phenomax/secnginx/util"
+	"github.com/urfave/cli"
+)
+
+// stagingPath is the DESTDIR NginX is installed into before it's moved into a release or a package, relative to
+// the working directory
+const stagingPath = "/build/staging"
+
+func buildPackages(c *cli.Context) error {
+	formats := c.StringSlice("format")
+	if len(formats) == 0 {
+		distro, err := util.DetectDistro()
+		if err != nil {
+			log.Fatalf("Can't determine the native package format, please specify --format: %s", err)
+		}
+
+		format := util.NativePackageFormat(distro.Family())
+		if format == "" {
+			log.Fatalf("%s has no supported package format, please specify --format", distro.Name)
+		}
+		formats = []string{format}
+	}
+
+	for _, format := range formats {
+		if !isPackageFormat(format) {
+			log.Fatalf("Unsupported package format %s, supported are: deb, rpm, apk", format)
+		}
+	}
+
+	if c.Bool("upgrade") {
+		log.Fatalln("Packages always ship the NginX file structure, --upgrade can't be used with 'package'")
+	}
+
+	wd := workingDirectory()
+	plan := createPlan(c, wd)
+	plan.Print()
+
+	resolved, security := buildNginX(plan, wd)
+	staging := stagePackage(plan, wd)
+	writeLockfile(plan, resolved)
+
+	pkg, err := util.NewPackage(staging, plan.Components[0].Version, c.Int("release"), c.String("maintainer"))
+	if err != nil {
+		log.Fatalf("Failed collecting the staged files in %s Error: %s", staging, err)
+	}
+
+	out := c.String("out")
+	if err = os.MkdirAll(out, 0755); err != nil {
+		log.Fatalf("Failed creating %s Error: %s", out, err)
+	}
+
+	for _, format := range formats {
+		path := filepath.Join(out, pkg.FileName(format))
+		if err = writePackage(pkg, format, path); err != nil {
+			log.Fatalf("Failed building the %s package Error: %s", format, err)
+		}
+		log.Printf("Package %s has been written", path)
+	}
+
+	log.Printf("Build summary: NginX %s with %s, build profile %s, hardening: %s", plan.Components[0].Version,
+		plan.TLSLibrary.Title, plan.Profile, security)
+
+	return nil
+}
+
+// isPackageFormat checks whether the given format is supported
+func isPackageFormat(format string) bool {
+	for _, f := range util.PackageFormats {
+		if f == format {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writePackage writes the package in the given format to path
+func writePackage(pkg *util.Package, format, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err = pkg.Write(format, f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+
+	return f.Close()
+}
+
+// stagePackage installs NginX into the staging directory and adds everything the post install steps would set up:
+// the delivered configuration, the dynamic modules, the systemd unit and the NginX directories
+func stagePackage(plan *util.Plan, wd string) string {
+	staging := stageNginX(wd)
+
+	// replace the default configuration installed by 'make install' with the delivered one
+	confDir := filepath.Join(staging, filepath.Dir(plan.ConfigureArgument("--conf-path", "/usr/local/nginx/conf/nginx.conf")))
+	if err := os.RemoveAll(confDir); err != nil {
+		log.Fatalf("Failed removing %s Error: %s", confDir, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(confDir), 0755); err != nil {
+		log.Fatalf("Failed creating %s Error: %s", filepath.Dir(confDir), err)
+	}
+	if out, err := exec.Command("cp", "-r", "nginx", confDir).CombinedOutput(); err != nil {
+		log.Fatalf("Failed copying 'nginx' folder to %s Error: %s\n%s", confDir, err, out)
+	}
+	filepath.Walk(confDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Name() == ".gitkeep" {
+			os.Remove(path)
+		}
+		return nil
+	})
+	if err := util.RenderConfigTemplates(confDir, plan.Provisioning.HTTP3); err != nil {
+		log.Fatalf("Failed preparing the NginX configuration Error: %s", err)
+	}
+
+	registerDynamicModules(filepath.Join(staging, plan.ConfigureArgument("--conf-path", "/usr/local/nginx/conf/nginx.conf")),
+		dynamicModules(plan, wd, staging))
+
+	unit := filepath.Join(staging, util.SystemdUnitPath)
+	if err := os.MkdirAll(filepath.Dir(unit), 0755); err != nil {
+		log.Fatalf("Failed creating %s Error: %s", filepath.Dir(unit), err)
+	}
+	util.CopyFile("files/nginx.service", unit)
+	if err := os.Chmod(unit, 0644); err != nil {
+		log.Fatalf("Failed changing the mode of %s Error: %s", unit, err)
+	}
+
+	for _, dir := range plan.Provisioning.Directories {
+		if err := os.MkdirAll(filepath.Join(staging, dir), 0755); err != nil {
+			log.Fatalf("Failed creating %s Error: %s", dir, err)
+		}
+	}
+
+	return staging
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/phenomax/secnginx/util"
+	"github.com/urfave/cli"
+)
+
+func createPlanFile(c *cli.Context) error {
+	wd := workingDirectory()
+	plan := createPlan(c, wd)
+	plan.Print()
+
+	if err := plan.Write(c.String("out")); err != nil {
+		return err
+	}
+
+	log.Printf("Plan has been written to %s. Run 'secnginx apply %s' to execute it.", c.String("out"), c.String("out"))
+
+	return nil
+}
+
+func applyPlanFile(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("please specify the plan file to apply")
+	}
+
+	plan, err := util.ReadPlan(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	wd := workingDirectory()
+	plan.Print()
+	executePlan(plan, wd)
+
+	return nil
+}
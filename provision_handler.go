@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/phenomax/secnginx/util"
+	"github.com/urfave/cli"
+)
+
+// provisionCommand reconciles the post install resources, with --check the drift is only reported
+func provisionCommand(c *cli.Context) error {
+	provisioning := util.PostInstallProvisioning()
+	provisioning.HTTP3 = c.Bool("http3")
+
+	drifted, err := util.Reconcile(provisioning.Resources(workingDirectory()), c.Bool("check"))
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !drifted:
+		log.Println("The system is in sync, nothing to do")
+	case c.Bool("check"):
+		return errors.New("the system has drifted from the desired state, run 'secnginx provision' to reconcile it")
+	default:
+		log.Println("The system has been provisioned")
+	}
+
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/phenomax/secnginx/util"
+	"github.com/urfave/cli"
+)
+
+// newRelease describes the release of the planned build, its ID is set once the binary has been installed
+func newRelease(plan *util.Plan, modules []util.DynamicModule) *util.Release {
+	release := &util.Release{
+		NginXVersion:   plan.Components[0].Version,
+		TLSLibrary:     plan.TLSLibrary.Name,
+		SbinPath:       plan.ConfigureArgument("--sbin-path", "/usr/local/nginx/sbin/nginx"),
+		ModulesPath:    plan.ConfigureArgument("--modules-path", "/usr/local/nginx/modules"),
+		ConfPath:       plan.ConfigureArgument("--conf-path", "/usr/local/nginx/conf/nginx.conf"),
+		DynamicModules: modules,
+	}
+
+	for _, c := range plan.Components {
+		if c.Name == plan.TLSLibrary.Name {
+			release.TLSVersion = c.Version
+		}
+	}
+
+	return release
+}
+
+// installRelease moves the NginX binary and the dynamic modules from the staging directory into a new release
+// below /opt/secnginx, merges the remaining files into the system without overwriting existing ones and
+// activates the release. With canary set, the release has to pass a canary run first
+func installRelease(release *util.Release, staging string, canary bool) {
+	binary := filepath.Join(staging, release.SbinPath)
+	if err := release.SetID(binary); err != nil {
+		log.Fatalf("Failed determining the release ID Error: %s", err)
+	}
+	release.Created = time.Now()
+
+	_, err := os.Stat(release.Dir())
+	existed := err == nil
+
+	log.Printf("Installing release %s", release.ID)
+
+	if err := os.MkdirAll(filepath.Dir(release.Binary()), 0755); err != nil {
+		log.Fatalf("Failed creating %s Error: %s", release.Dir(), err)
+	}
+	if err := copyReplacing(binary, release.Binary()); err != nil {
+		log.Fatalf("Failed installing the NginX binary Error: %s", err)
+	}
+
+	modules := filepath.Join(staging, release.ModulesPath)
+	if err := os.MkdirAll(release.Modules(), 0755); err != nil {
+		log.Fatalf("Failed creating %s Error: %s", release.Modules(), err)
+	}
+	files, _ := ioutil.ReadDir(modules)
+	for _, file := range files {
+		if err := copyReplacing(filepath.Join(modules, file.Name()), filepath.Join(release.Modules(), file.Name())); err != nil {
+			log.Fatalf("Failed installing the dynamic modules Error: %s", err)
+		}
+	}
+
+	if err := release.Write(); err != nil {
+		log.Fatalf("Failed writing the release description Error: %s", err)
+	}
+
+	if canary {
+		if err := runCanary(release); err != nil {
+			// rebuilds of an installed release keep it
+			if !existed {
+				os.RemoveAll(release.Dir())
+			}
+			log.Fatalf("Canary of release %s failed, the current NginX hasn't been replaced: %s", release.ID, err)
+		}
+	}
+
+	// the binary and the modules are served from the release, everything else is installed like 'make install' does
+	for _, path := range []string{binary, modules} {
+		if err := os.RemoveAll(path); err != nil {
+			log.Fatalf("Failed removing %s Error: %s", path, err)
+		}
+	}
+	if err := util.MergeTree(staging, "/"); err != nil {
+		log.Fatalf("Failed installing NginX Error: %s", err)
+	}
+
+	if err := release.Activate(); err != nil {
+		log.Fatalf("Failed activating release %s Error: %s", release.ID, err)
+	}
+
+	log.Printf("Release %s is active, %s points to %s", release.ID, release.SbinPath, release.Binary())
+}
+
+// copyReplacing copies source next to dest and renames it over dest. Reinstalling the active release must not
+// write into the running binary or loaded modules, the running NginX keeps the replaced files open instead
+func copyReplacing(source, dest string) error {
+	tmp := dest + ".part"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+
+	if out, err := exec.Command("cp", "-a", source, tmp).CombinedOutput(); err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("%s %s", err, out)
+	}
+
+	// directories can't be renamed over existing ones
+	if info, err := os.Lstat(dest); err == nil && info.IsDir() {
+		if err = os.RemoveAll(dest); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(tmp, dest)
+}
+
+// pruneReleases removes all but the newest releases after an install, keep 0 disables pruning
+func pruneReleases(keep int) {
+	if keep == 0 {
+		return
+	}
+
+	removed, err := util.PruneReleases(keep)
+	if err != nil {
+		log.Printf("Failed pruning old releases Error: %s", err)
+	}
+
+	for _, id := range removed {
+		log.Printf("Removed old release %s", id)
+	}
+}
+
+func listReleases(c *cli.Context) error {
+	releases, err := util.Releases()
+	if err != nil {
+		return err
+	}
+
+	if len(releases) == 0 {
+		log.Printf("No releases installed below %s", util.ReleasesDir)
+		return nil
+	}
+
+	current, previous := util.CurrentRelease(), util.PreviousRelease()
+	for _, r := range releases {
+		marker := ""
+		switch r.ID {
+		case current:
+			marker = " (current)"
+		case previous:
+			marker = " (previous)"
+		}
+
+		fmt.Printf("%s%s\n  NginX %s with %s %s, installed %s\n", r.ID, marker, r.NginXVersion, r.TLSLibrary,
+			r.TLSVersion, r.Created.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func switchRelease(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("please specify the release to switch to, see 'secnginx versions'")
+	}
+
+	release, err := util.GetRelease(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	return activateRelease(release)
+}
+
+func rollbackRelease(c *cli.Context) error {
+	previous := util.PreviousRelease()
+	if previous == "" {
+		return errors.New("there is no previous release to roll back to")
+	}
+
+	release, err := util.GetRelease(previous)
+	if err != nil {
+		return err
+	}
+
+	return activateRelease(release)
+}
+
+func pruneReleasesCommand(c *cli.Context) error {
+	keep := c.Int("keep")
+	if keep < 1 {
+		return errors.New("at least one release has to be kept")
+	}
+
+	removed, err := util.PruneReleases(keep)
+	for _, id := range removed {
+		log.Printf("Removed release %s", id)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(removed) == 0 {
+		log.Println("Nothing to prune")
+	}
+
+	return nil
+}
+
+// activateRelease switches to an installed release and tests the configuration with its binary.
+// If NginX rejects the configuration, e.g. because of missing modules, the switch is reverted
+func activateRelease(release *util.Release) error {
+	current, previous := util.CurrentRelease(), util.PreviousRelease()
+	if release.ID == current {
+		log.Printf("Release %s is already active", release.ID)
+		return nil
+	}
+
+	var active *util.Release
+	if current != "" {
+		active, _ = util.GetRelease(current)
+	}
+
+	if err := release.Activate(); err != nil {
+		return err
+	}
+	registerDynamicModules(release.ConfPath, release.DynamicModules)
+
+	if out, err := exec.Command(release.Binary(), "-t").CombinedOutput(); err != nil {
+		if active != nil {
+			if revertErr := util.RestoreReleases(current, previous); revertErr != nil {
+				return fmt.Errorf("failed reverting to release %s: %s", current, revertErr)
+			}
+			registerDynamicModules(active.ConfPath, active.DynamicModules)
+		}
+
+		return fmt.Errorf("NginX %s rejected the configuration, the switch has been reverted:\n%s", release.ID, out)
+	}
+
+	log.Printf("Release %s is active. Run 'secnginx upgrade --live' or 'service nginx restart' to start it.", release.ID)
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+
+	"github.com/phenomax/secnginx/util"
+	"github.com/urfave/cli"
+)
+
+// liveUpgrade hot swaps the running NginX master to the binary of the active release. If the new master doesn't
+// start or fails the health check, the old master keeps serving and the release it runs is activated again
+func liveUpgrade(c *cli.Context) error {
+	if !c.Bool("live") {
+		return errors.New("only live upgrades are supported, pass --live or run 'service nginx restart'")
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		log.Fatalf("Fatal error reading config file: %s \n", err)
+	}
+
+	pidPath := c.String("pid-path")
+	if pidPath == "" {
+		pidPath = config.ConfigureArgument("--pid-path", "/usr/local/nginx/logs/nginx.pid")
+	}
+
+	upgrade := &util.LiveUpgrade{
+		PidPath:     pidPath,
+		Timeout:     c.Duration("timeout"),
+		HealthCheck: util.HTTPHealthCheck(c.String("health-url")),
+	}
+
+	pid, err := upgrade.Check()
+	if err == util.ErrNginXNotRunning {
+		return fmt.Errorf("%s (no master in %s), run 'service nginx start' instead", err, pidPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the binary of the running master tells which release is serving right now
+	running := ""
+	if binary, err := util.ProcessBinary(pid); err == nil {
+		running = util.ReleaseOfBinary(binary)
+	}
+
+	current := util.CurrentRelease()
+	if running != "" && running == current {
+		log.Printf("NginX already runs the active release %s", current)
+		return nil
+	}
+
+	// the new master is started from the sbin path, so its configuration test must pass before touching anything
+	sbin := config.ConfigureArgument("--sbin-path", "/usr/local/nginx/sbin/nginx")
+	if out, err := exec.Command(sbin, "-t").CombinedOutput(); err != nil {
+		return fmt.Errorf("%s rejected the configuration, the running NginX hasn't been touched:\n%s", sbin, out)
+	}
+
+	log.Printf("Upgrading the NginX master (pid %d) from release %s to %s", pid, releaseName(running), releaseName(current))
+
+	if err = upgrade.Run(); err != nil {
+		if running != "" && running != current {
+			reactivateRelease(running)
+		}
+
+		return err
+	}
+
+	log.Printf("NginX has been upgraded without downtime and runs release %s", releaseName(current))
+
+	return nil
+}
+
+// reactivateRelease activates the release the running master has been started from, after the upgrade to
+// another release failed
+func reactivateRelease(id string) {
+	release, err := util.GetRelease(id)
+	if err != nil {
+		log.Printf("Warning: NginX still runs release %s, but it can't be activated again: %s", id, err)
+		return
+	}
+
+	if err = release.Activate(); err != nil {
+		log.Printf("Warning: NginX still runs release %s, but activating it failed Error: %s", id, err)
+		return
+	}
+	registerDynamicModules(release.ConfPath, release.DynamicModules)
+
+	log.Printf("Release %s, which NginX still runs, is active again", id)
+}
+
+// releaseName describes releases, binaries installed before versioned installs don't belong to a release
+func releaseName(id string) string {
+	if id == "" {
+		return "(none)"
+	}
+
+	return id
+}
@@ -0,0 +1,136 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// writeAPK writes the package as Alpine package: the gzip compressed control and data tar streams, concatenated.
+// The package is unsigned and has to be installed with 'apk add --allow-untrusted'
+func (p *Package) writeAPK(w io.Writer) error {
+	data, err := p.apkDataArchive()
+	if err != nil {
+		return err
+	}
+
+	dataHash := sha256.Sum256(data)
+	control, err := p.apkControlArchive(hex.EncodeToString(dataHash[:]))
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.Write(control); err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// apkPkgInfo returns the content of .PKGINFO, dataHash is the SHA-256 digest of the data stream
+func (p *Package) apkPkgInfo(dataHash string) string {
+	info := &strings.Builder{}
+	fields := [][2]string{
+		{"pkgname", p.Name},
+		{"pkgver", fmt.Sprintf("%s-r%d", p.Version, p.Release)},
+		{"pkgdesc", p.Summary},
+		{"url", p.URL},
+		{"builddate", fmt.Sprint(p.BuildTime.Unix())},
+		{"packager", p.Maintainer},
+		{"size", fmt.Sprint(p.InstalledSize())},
+		{"arch", PackageArch("apk")},
+		{"origin", p.Name},
+		{"license", p.License},
+		{"datahash", dataHash},
+	}
+
+	fmt.Fprintln(info, "# Generated by secnginx")
+	for _, field := range fields {
+		fmt.Fprintf(info, "%s = %s\n", field[0], field[1])
+	}
+
+	return info.String()
+}
+
+// apkControlArchive returns the control stream: .PKGINFO and the install scripts. apk expects the stream to be
+// a tar archive without the end of archive blocks
+func (p *Package) apkControlArchive(dataHash string) ([]byte, error) {
+	entries := []struct {
+		name    string
+		content string
+		mode    int64
+	}{
+		{".PKGINFO", p.apkPkgInfo(dataHash), 0644},
+		{".pre-install", p.PreInstall, 0755},
+		{".pre-upgrade", p.PreInstall, 0755},
+		{".post-install", p.PostInstall, 0755},
+		{".post-upgrade", p.PostInstall, 0755},
+		{".post-deinstall", p.PostRemove, 0755},
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for _, e := range entries {
+		if err := writeTarFile(tw, e.name, e.mode, p.BuildTime, []byte(e.content)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Flush pads the last entry, but unlike Close doesn't write the end of archive blocks
+	if err := tw.Flush(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// apkDataArchive returns the data stream, regular files carry their SHA-1 digest as pax header
+func (p *Package) apkDataArchive() ([]byte, error) {
+	return gzipTar(func(tw *tar.Writer) error {
+		for _, f := range p.Files {
+			var records map[string]string
+			if f.Mode.IsRegular() {
+				digest, err := fileSHA1(p.Source(f))
+				if err != nil {
+					return err
+				}
+				records = map[string]string{"APK-TOOLS.checksum.SHA1": digest}
+			}
+
+			if err := p.writeTarEntry(tw, strings.TrimPrefix(f.Path, "/"), f, records); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// fileSHA1 returns the hex encoded SHA-1 digest of the given file, as used by apk
+func fileSHA1(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha1.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
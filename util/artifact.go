@@ -0,0 +1,434 @@
+package util
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// ArtifactManifestName is the name of the manifest inside build artifacts
+const ArtifactManifestName = "manifest.json"
+
+// artifactFormat is increased on incompatible changes of the artifact layout
+const artifactFormat = 1
+
+// Platform describes the system a build artifact has been built on
+type Platform struct {
+	OS            string `json:"os"`
+	Arch          string `json:"arch"`
+	Distro        string `json:"distro"`
+	DistroVersion string `json:"distro_version"`
+	// Libc is either glibc or musl
+	Libc        string `json:"libc"`
+	LibcVersion string `json:"libc_version"`
+}
+
+// ArtifactManifest describes the content of a build artifact and the build it has been created from
+type ArtifactManifest struct {
+	Format   int       `json:"format"`
+	Created  time.Time `json:"created"`
+	Platform Platform  `json:"platform"`
+	// Release describes the build, it's installed as versioned install. The configuration directory of
+	// Release.ConfPath is stored below nginx/ in the artifact
+	Release Release   `json:"release"`
+	HTTP3   bool      `json:"http3"`
+	Lock    *Lockfile `json:"lock"`
+	// Files maps the path of all regular files in the artifact to their SHA-256 digest
+	Files map[string]string `json:"files"`
+}
+
+// ArtifactEntry is a file or directory added to an artifact
+type ArtifactEntry struct {
+	// Name is the path inside the artifact
+	Name   string
+	Source string
+}
+
+// DetectPlatform determines the platform of the running system
+func DetectPlatform() (*Platform, error) {
+	platform := &Platform{OS: runtime.GOOS, Arch: runtime.GOARCH}
+
+	distro, err := DetectDistro()
+	if err != nil {
+		return nil, err
+	}
+	platform.Distro = distro.ID
+	platform.DistroVersion = distro.VersionID
+
+	platform.Libc, platform.LibcVersion, err = detectLibc()
+	if err != nil {
+		return nil, err
+	}
+
+	return platform, nil
+}
+
+// detectLibc determines the C library NginX is linked against, glibc reports its version via getconf
+func detectLibc() (string, string, error) {
+	if out, err := exec.Command("getconf", "GNU_LIBC_VERSION").Output(); err == nil {
+		fields := strings.Fields(string(out))
+		if len(fields) == 2 {
+			return "glibc", fields[1], nil
+		}
+	}
+
+	if matches, _ := filepath.Glob("/lib/ld-musl-*.so.1"); len(matches) > 0 {
+		// musl's ldd prints its version to stderr and exits with 1
+		out, _ := exec.Command(matches[0]).CombinedOutput()
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(line, "Version ") {
+				return "musl", strings.TrimSpace(strings.TrimPrefix(line, "Version ")), nil
+			}
+		}
+		return "musl", "", nil
+	}
+
+	return "", "", fmt.Errorf("can't determine the C library of the system")
+}
+
+// Compatible checks whether binaries built on the platform run on the host. Binaries linked against a libc
+// run on the same or a newer version of it
+func (p Platform) Compatible(host *Platform) error {
+	if p.OS != host.OS || p.Arch != host.Arch {
+		return fmt.Errorf("artifact has been built for %s/%s, host is %s/%s", p.OS, p.Arch, host.OS, host.Arch)
+	}
+
+	if p.Distro != host.Distro || p.DistroVersion != host.DistroVersion {
+		return fmt.Errorf("artifact has been built on %s %s, host is %s %s", p.Distro, p.DistroVersion, host.Distro,
+			host.DistroVersion)
+	}
+
+	if p.Libc != host.Libc {
+		return fmt.Errorf("artifact has been linked against %s, host uses %s", p.Libc, host.Libc)
+	}
+
+	if p.LibcVersion != "" && host.LibcVersion != "" && CompareVersions(host.LibcVersion, p.LibcVersion) < 0 {
+		return fmt.Errorf("artifact requires %s %s, host has %s", p.Libc, p.LibcVersion, host.LibcVersion)
+	}
+
+	return nil
+}
+
+// artifactExtensions are the accepted file extensions of artifacts, which are always gzip compressed
+var artifactExtensions = []string{".tar.gz", ".tgz"}
+
+// CheckArtifactName refuses artifact paths, whose extension doesn't match the gzip compression (e.g. .tar.zst)
+func CheckArtifactName(path string) error {
+	for _, ext := range artifactExtensions {
+		if strings.HasSuffix(path, ext) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("artifacts are gzip compressed tar archives, please name %s *.tar.gz or *.tgz (zstd isn't supported)", filepath.Base(path))
+}
+
+// WriteArtifact writes the manifest and the entries as gzip compressed tar archive to path. The digests of
+// all regular files are added to the manifest
+func WriteArtifact(path string, manifest *ArtifactManifest, entries []ArtifactEntry) error {
+	if err := CheckArtifactName(path); err != nil {
+		return err
+	}
+
+	manifest.Format = artifactFormat
+	manifest.Files = map[string]string{}
+	for _, e := range entries {
+		info, err := os.Lstat(e.Source)
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			if manifest.Files[e.Name], err = FileSHA256(e.Source); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	err = writeTarFile(tw, ArtifactManifestName, 0644, manifest.Created, data)
+	for i := 0; err == nil && i < len(entries); i++ {
+		err = writeArtifactEntry(tw, entries[i])
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(path)
+	}
+
+	return err
+}
+
+func writeArtifactEntry(tw *tar.Writer, e ArtifactEntry) error {
+	info, err := os.Lstat(e.Source)
+	if err != nil {
+		return err
+	}
+
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(e.Source); err != nil {
+			return err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = e.Name
+	header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "root", "root"
+
+	if err = tw.WriteHeader(header); err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+
+	f, err := os.Open(e.Source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// writeTarGz writes the entries into a gzip compressed tar archive, which only appears at path once complete
+func writeTarGz(path string, entries []ArtifactEntry) error {
+	f, err := os.OpenFile(path+".part", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path + ".part")
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for i := 0; err == nil && i < len(entries); i++ {
+		err = writeArtifactEntry(tw, entries[i])
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".part", path)
+}
+
+// extractTarGz extracts the gzip compressed tar archive into dest, see extractTar
+func extractTarGz(path, dest string, confineLinks bool) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't gzip compressed: %s", path, err)
+	}
+
+	return extractTar(tar.NewReader(gz), dest, confineLinks)
+}
+
+// AuthenticateArtifact verifies the artifact against a SHA-256 digest or a detached PGP signature of a trusted
+// key, before anything is extracted. The digests of the manifest are part of the artifact and prove nothing
+func AuthenticateArtifact(path, digest, signature string, pgp *PGPConfig) error {
+	if digest == "" && signature == "" {
+		return fmt.Errorf("refusing to install an unauthenticated artifact, pass its SHA-256 digest via --artifact-sha256 or a detached signature via --artifact-signature")
+	}
+
+	if digest != "" {
+		if !IsSHA256(digest) {
+			return fmt.Errorf("%s isn't a SHA-256 digest", digest)
+		}
+		if _, err := VerifySHA256(path, digest); err != nil {
+			return err
+		}
+	}
+
+	if signature != "" {
+		if !pgp.Enabled() {
+			return fmt.Errorf("verifying %s requires a keyring in the [pgp] table of config.toml", signature)
+		}
+		if _, err := pgp.VerifySignature(path, signature); err != nil {
+			return fmt.Errorf("%s: %s", signature, err)
+		}
+	}
+
+	return nil
+}
+
+// ExtractArtifact extracts the gzip compressed artifact into dest and verifies the extracted files against
+// the digests of the manifest
+func ExtractArtifact(path, dest string) (*ArtifactManifest, error) {
+	files, err := extractTarGz(path, dest, true)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(dest, ArtifactManifestName))
+	if err != nil {
+		return nil, fmt.Errorf("%s contains no manifest: %s", path, err)
+	}
+	defer f.Close()
+
+	manifest := &ArtifactManifest{}
+	if err = json.NewDecoder(f).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest in %s: %s", path, err)
+	}
+
+	if manifest.Format != artifactFormat {
+		return nil, fmt.Errorf("unsupported artifact format %d, expected %d", manifest.Format, artifactFormat)
+	}
+
+	pending := map[string]string{}
+	for name, digest := range manifest.Files {
+		pending[name] = digest
+	}
+
+	for _, name := range files {
+		digest, ok := pending[name]
+		if !ok && name != ArtifactManifestName {
+			return nil, fmt.Errorf("%s isn't listed in the manifest", name)
+		}
+		if ok {
+			if _, err = VerifySHA256(filepath.Join(dest, name), digest); err != nil {
+				return nil, err
+			}
+		}
+		delete(pending, name)
+	}
+
+	for name := range pending {
+		return nil, fmt.Errorf("%s is missing in the artifact", name)
+	}
+
+	return manifest, nil
+}
+
+// extractTar extracts regular files, directories and symlinks into dest, refusing paths outside of it and
+// entries below symlinks, so nothing is written through a link. With confineLinks set, symlinks have to be
+// relative and point into dest. It returns the names of the extracted regular files
+func extractTar(tr *tar.Reader, dest string, confineLinks bool) ([]string, error) {
+	dest = filepath.Clean(dest)
+	files := []string{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		target := filepath.Join(dest, filepath.FromSlash(header.Name))
+		if !withinDir(dest, target) {
+			return nil, fmt.Errorf("archive entry %s points outside of %s", header.Name, dest)
+		}
+
+		if err = checkNoSymlinkParent(dest, target); err != nil {
+			return nil, fmt.Errorf("archive entry %s: %s", header.Name, err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, os.FileMode(header.Mode).Perm())
+		case tar.TypeSymlink:
+			if confineLinks {
+				link := filepath.FromSlash(header.Linkname)
+				if filepath.IsAbs(link) || !withinDir(dest, filepath.Join(filepath.Dir(target), link)) {
+					return nil, fmt.Errorf("archive entry %s links to %s outside of the archive", header.Name, header.Linkname)
+				}
+			}
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+				err = os.Symlink(header.Linkname, target)
+			}
+		case tar.TypeReg:
+			err = extractTarFile(tr, target, os.FileMode(header.Mode).Perm())
+			files = append(files, header.Name)
+		default:
+			err = fmt.Errorf("unsupported archive entry %s", header.Name)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// withinDir reports whether the cleaned path is dir or below it
+func withinDir(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+}
+
+// checkNoSymlinkParent refuses targets, which already exist as symlink or whose parent directories below dest are
+// symlinks
+func checkNoSymlinkParent(dest, target string) error {
+	for dir := target; dir != dest; dir = filepath.Dir(dir) {
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", dir)
+		}
+	}
+
+	return nil
+}
+
+func extractTarFile(r io.Reader, target string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,124 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tarEntry is a regular file, or a symlink if link is set
+type tarEntry struct {
+	name, link, content string
+}
+
+func buildTar(t *testing.T, entries []tarEntry) *tar.Reader {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.content))}
+		if e.link != "" {
+			header = &tar.Header{Name: e.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: e.link}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return tar.NewReader(&buf)
+}
+
+func TestExtractTar(t *testing.T) {
+	tests := []struct {
+		name         string
+		entries      []tarEntry
+		confineLinks bool
+		wantErr      bool
+	}{
+		{"regular files", []tarEntry{{name: "a"}, {name: "dir/b"}}, true, false},
+		{"path traversal", []tarEntry{{name: "../evil"}}, true, true},
+		{"relative link inside", []tarEntry{{name: "a"}, {name: "link", link: "a"}}, true, false},
+		{"absolute link", []tarEntry{{name: "x", link: "/etc"}}, true, true},
+		{"relative link outside", []tarEntry{{name: "dir/x", link: "../../etc"}}, true, true},
+		{"file below link", []tarEntry{{name: "x", link: "dir"}, {name: "x/cron.d/evil"}}, true, true},
+		{"file below absolute link", []tarEntry{{name: "x", link: "/etc"}, {name: "x/cron.d/evil"}}, false, true},
+		{"file replacing link", []tarEntry{{name: "a"}, {name: "x", link: "a"}, {name: "x"}}, true, true},
+		{"absolute link unconfined", []tarEntry{{name: "x", link: "/etc/nginx/a"}}, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dest := filepath.Join(root, "dest")
+			if err := os.Mkdir(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := extractTar(buildTar(t, tt.entries), dest, tt.confineLinks)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractTar() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if _, err = os.Lstat(filepath.Join(root, "evil")); err == nil {
+				t.Fatal("file written outside of dest")
+			}
+		})
+	}
+}
+
+func TestCheckArtifactName(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{"nginx.tar.gz", false},
+		{"/tmp/nginx.tgz", false},
+		{"nginx.tar.zst", true},
+		{"nginx.tar", true},
+		{"nginx.tar.gz.sig", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if err := CheckArtifactName(tt.path); (err != nil) != tt.wantErr {
+				t.Fatalf("CheckArtifactName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestArtifactRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "nginx")
+	if err := ioutil.WriteFile(source, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	artifact := filepath.Join(dir, "nginx.tar.gz")
+	entries := []ArtifactEntry{{Name: "root/usr/sbin/nginx", Source: source}}
+	if err := WriteArtifact(artifact, &ArtifactManifest{}, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := ExtractArtifact(artifact, filepath.Join(dir, "extracted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifest.Files) != 1 || manifest.Files["root/usr/sbin/nginx"] == "" {
+		t.Fatalf("unexpected manifest files %v", manifest.Files)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "extracted", "root/usr/sbin/nginx"))
+	if err != nil || string(data) != "binary" {
+		t.Fatalf("extracted %q, %v", data, err)
+	}
+}
@@ -0,0 +1,288 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BackupsDir holds the backups, they contain private keys and are only readable by root
+var BackupsDir = "/var/backups/secnginx"
+
+// KeepBackups is the number of backups kept by PruneBackups
+var KeepBackups = 10
+
+// BackupPaths are archived before a post install step replaces or moves existing files
+var BackupPaths = []string{"/etc/nginx", installedUnitPath, "/etc/init.d/nginx"}
+
+const (
+	// restoreSuffix and replacedSuffix name the siblings of a path while it's swapped during a restore
+	restoreSuffix  = ".secnginx-restore"
+	replacedSuffix = ".secnginx-replaced"
+)
+
+// Backup is a gzip compressed tar archive below BackupsDir, described by a manifest next to it
+type Backup struct {
+	// ID is the creation time, e.g. 20191231-235959
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	// Reason describes the step the backup has been created for
+	Reason string `json:"reason"`
+	// Paths are the archived paths, paths missing at backup time aren't part of the backup
+	Paths []string `json:"paths"`
+	// SHA256 is the digest of the archive, Files maps the archived regular files to their SHA-256 digest
+	SHA256 string            `json:"sha256"`
+	Files  map[string]string `json:"files"`
+}
+
+// Archive returns the path of the archive
+func (b *Backup) Archive() string {
+	return filepath.Join(BackupsDir, b.ID+".tar.gz")
+}
+
+func (b *Backup) manifest() string {
+	return filepath.Join(BackupsDir, b.ID+".json")
+}
+
+// CreateBackup archives the existing paths. It returns nil if none of the paths exists
+func CreateBackup(reason string, paths []string) (*Backup, error) {
+	created := time.Now()
+	b := &Backup{ID: created.Format("20060102-150405"), Created: created, Reason: reason, Files: map[string]string{}}
+	for i := 2; pathExists(b.manifest()); i++ {
+		b.ID = fmt.Sprintf("%s-%d", created.Format("20060102-150405"), i)
+	}
+
+	entries := []ArtifactEntry{}
+	for _, path := range paths {
+		if !pathExists(path) {
+			continue
+		}
+		b.Paths = append(b.Paths, path)
+
+		err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			name := strings.TrimPrefix(file, "/")
+			entries = append(entries, ArtifactEntry{Name: name, Source: file})
+			if info.Mode().IsRegular() {
+				b.Files[name], err = FileSHA256(file)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(b.Paths) == 0 {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(BackupsDir, 0700); err != nil {
+		return nil, err
+	}
+
+	if err := writeTarGz(b.Archive(), entries); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if b.SHA256, err = FileSHA256(b.Archive()); err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return b, ioutil.WriteFile(b.manifest(), data, 0600)
+}
+
+// PruneBackups removes all but the newest keep backups and returns the IDs of the removed ones
+func PruneBackups(keep int) ([]string, error) {
+	backups, err := Backups()
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+	for i := 0; i < len(backups)-keep; i++ {
+		if err = backups[i].Remove(); err != nil {
+			return removed, err
+		}
+		removed = append(removed, backups[i].ID)
+	}
+
+	return removed, nil
+}
+
+// Remove deletes the archive and the manifest of the backup
+func (b *Backup) Remove() error {
+	if err := os.Remove(b.Archive()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Remove(b.manifest())
+}
+
+// Backups returns all backups, oldest first
+func Backups() ([]*Backup, error) {
+	manifests, err := filepath.Glob(filepath.Join(BackupsDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []*Backup{}
+	for _, manifest := range manifests {
+		data, err := ioutil.ReadFile(manifest)
+		if err != nil {
+			return nil, err
+		}
+
+		b := &Backup{}
+		if err = json.Unmarshal(data, b); err != nil {
+			return nil, fmt.Errorf("invalid backup manifest %s: %s", manifest, err)
+		}
+		backups = append(backups, b)
+	}
+
+	sort.SliceStable(backups, func(i, j int) bool { return backups[i].Created.Before(backups[j].Created) })
+	return backups, nil
+}
+
+// GetBackup returns the backup with the given ID
+func GetBackup(id string) (*Backup, error) {
+	backups, err := Backups()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range backups {
+		if b.ID == id {
+			return b, nil
+		}
+	}
+
+	return nil, fmt.Errorf("backup %s doesn't exist, see 'secnginx backup list'", id)
+}
+
+// Restore replaces the archived paths by their content in the backup. The archive is verified and copied next
+// to the paths first, then every path is swapped in via rename. If a swap fails, the swapped paths are reverted
+func (b *Backup) Restore() error {
+	if _, err := VerifySHA256(b.Archive(), b.SHA256); err != nil {
+		return err
+	}
+
+	stage, err := ioutil.TempDir(BackupsDir, b.ID+".restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stage)
+
+	if err = b.extract(stage); err != nil {
+		return err
+	}
+
+	// the copies are created next to the paths, so the swap is a rename on the same file system
+	for _, path := range b.Paths {
+		tmp := path + restoreSuffix
+		defer os.RemoveAll(tmp)
+
+		if err = os.RemoveAll(tmp); err != nil {
+			return err
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if out, err := exec.Command("cp", "-a", filepath.Join(stage, path), tmp).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed copying %s: %s %s", path, err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	swapped := []string{}
+	for _, path := range b.Paths {
+		if err = swap(path); err != nil {
+			for _, s := range swapped {
+				revertSwap(s)
+			}
+			return fmt.Errorf("failed restoring %s, nothing has been changed: %s", path, err)
+		}
+		swapped = append(swapped, path)
+	}
+
+	for _, path := range swapped {
+		os.RemoveAll(path + replacedSuffix)
+	}
+
+	return nil
+}
+
+// extract extracts the archive into dest and verifies the files against the manifest
+func (b *Backup) extract(dest string) error {
+	// the configuration may contain absolute symlinks, e.g. sites-enabled/default -> /etc/nginx/sites-available/default
+	files, err := extractTarGz(b.Archive(), dest, false)
+	if err != nil {
+		return err
+	}
+
+	if len(files) != len(b.Files) {
+		return fmt.Errorf("backup %s contains %d files, but its manifest lists %d", b.ID, len(files), len(b.Files))
+	}
+
+	for _, name := range files {
+		digest, ok := b.Files[name]
+		if !ok {
+			return fmt.Errorf("%s isn't listed in the manifest of backup %s", name, b.ID)
+		}
+		if _, err = VerifySHA256(filepath.Join(dest, name), digest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// swap is swapPath, replaceable to simulate failures
+var swap = swapPath
+
+// swapPath replaces path by its restored copy, keeping the replaced content until the restore is complete
+func swapPath(path string) error {
+	replaced := path + replacedSuffix
+	if err := os.RemoveAll(replaced); err != nil {
+		return err
+	}
+
+	if pathExists(path) {
+		if err := os.Rename(path, replaced); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(path+restoreSuffix, path); err != nil {
+		os.Rename(replaced, path)
+		return err
+	}
+
+	return nil
+}
+
+// revertSwap puts the replaced content of path back
+func revertSwap(path string) {
+	if !pathExists(path + replacedSuffix) {
+		os.RemoveAll(path)
+		return
+	}
+
+	if err := os.RemoveAll(path); err == nil {
+		os.Rename(path+replacedSuffix, path)
+	}
+}
@@ -0,0 +1,193 @@
+package util
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testBackupPaths points BackupsDir below dir and creates a configuration directory and a unit file to back up
+func testBackupPaths(t *testing.T, dir string) (string, string) {
+	backupsDir := BackupsDir
+	BackupsDir = filepath.Join(dir, "backups")
+	t.Cleanup(func() { BackupsDir = backupsDir })
+
+	conf := filepath.Join(dir, "etc", "nginx")
+	unit := filepath.Join(dir, "nginx.service")
+	writeTestFile(t, filepath.Join(conf, "nginx.conf"), "worker_processes auto;")
+	writeTestFile(t, filepath.Join(conf, "sites-available", "default"), "server {}")
+	writeTestFile(t, unit, "[Unit]")
+	if err := os.Symlink(filepath.Join(conf, "sites-available", "default"), filepath.Join(conf, "default")); err != nil {
+		t.Fatal(err)
+	}
+
+	return conf, unit
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertFile(t *testing.T, path, content string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil || string(data) != content {
+		t.Fatalf("%s contains %q, %v, want %q", path, data, err, content)
+	}
+}
+
+func assertNoSwapLeftovers(t *testing.T, paths ...string) {
+	for _, path := range paths {
+		for _, suffix := range []string{restoreSuffix, replacedSuffix} {
+			if pathExists(path + suffix) {
+				t.Fatalf("%s has been left behind", path+suffix)
+			}
+		}
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	conf, unit := testBackupPaths(t, dir)
+
+	b, err := CreateBackup("test", []string{conf, unit, filepath.Join(dir, "missing")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Paths) != 2 {
+		t.Fatalf("backed up %v, want the existing paths only", b.Paths)
+	}
+
+	writeTestFile(t, filepath.Join(conf, "nginx.conf"), "broken")
+	writeTestFile(t, filepath.Join(conf, "conf.d", "new.conf"), "server {}")
+	if err = os.Remove(unit); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.Restore(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertFile(t, filepath.Join(conf, "nginx.conf"), "worker_processes auto;")
+	assertFile(t, filepath.Join(conf, "default"), "server {}")
+	assertFile(t, unit, "[Unit]")
+	if pathExists(filepath.Join(conf, "conf.d")) {
+		t.Fatal("files created after the backup haven't been removed")
+	}
+	assertNoSwapLeftovers(t, conf, unit)
+}
+
+func TestBackupRestoreCorrupted(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, b *Backup)
+	}{
+		{"corrupted archive", func(t *testing.T, b *Backup) {
+			writeTestFile(t, b.Archive(), "corrupted")
+		}},
+		{"file not in manifest", func(t *testing.T, b *Backup) {
+			delete(b.Files, firstKey(b.Files))
+		}},
+		{"modified file", func(t *testing.T, b *Backup) {
+			b.Files[firstKey(b.Files)] = "0000000000000000000000000000000000000000000000000000000000000000"
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			conf, unit := testBackupPaths(t, dir)
+
+			b, err := CreateBackup("test", []string{conf, unit})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			writeTestFile(t, filepath.Join(conf, "nginx.conf"), "current")
+			tt.corrupt(t, b)
+
+			if err = b.Restore(); err == nil {
+				t.Fatal("Restore() of a corrupted backup succeeded")
+			}
+
+			assertFile(t, filepath.Join(conf, "nginx.conf"), "current")
+			assertNoSwapLeftovers(t, conf, unit)
+		})
+	}
+}
+
+func TestBackupRestoreFailedSwap(t *testing.T) {
+	dir := t.TempDir()
+	conf, unit := testBackupPaths(t, dir)
+
+	b, err := CreateBackup("test", []string{conf, unit})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, filepath.Join(conf, "nginx.conf"), "current")
+	writeTestFile(t, unit, "[Service]")
+
+	// the configuration is swapped in, the unit fails
+	swap = func(path string) error {
+		if path == unit {
+			return errors.New("simulated failure")
+		}
+		return swapPath(path)
+	}
+	defer func() { swap = swapPath }()
+
+	if err = b.Restore(); err == nil {
+		t.Fatal("Restore() succeeded despite the failed swap")
+	}
+
+	assertFile(t, filepath.Join(conf, "nginx.conf"), "current")
+	assertFile(t, unit, "[Service]")
+	assertNoSwapLeftovers(t, conf, unit)
+}
+
+func TestPruneBackups(t *testing.T) {
+	dir := t.TempDir()
+	conf, _ := testBackupPaths(t, dir)
+
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		b, err := CreateBackup("test", []string{conf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, b.ID)
+	}
+
+	removed, err := PruneBackups(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != ids[0] {
+		t.Fatalf("PruneBackups() removed %v, want %s", removed, ids[0])
+	}
+
+	backups, err := Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 || backups[0].ID != ids[1] || backups[1].ID != ids[2] {
+		t.Fatalf("unexpected backups left %v", backups)
+	}
+	if pathExists(filepath.Join(BackupsDir, ids[0]+".tar.gz")) {
+		t.Fatal("archive of the pruned backup hasn't been removed")
+	}
+}
+
+func firstKey(m map[string]string) string {
+	for k := range m {
+		return k
+	}
+	return ""
+}
@@ -0,0 +1,361 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Cache is a persistent, content addressed store of downloaded sources.
+//
+// Release archives are stored as <dir>/<component>/<version>/<sha256>/<file>, their signatures next to them.
+// Git checkouts are stored as snapshot keyed by their commit: <dir>/<module>/git/<commit>.tar.gz, together with
+// the digest of the snapshot (<commit>.tar.gz.sha256) and the commits tags resolved to (<dir>/<module>/git/refs/<tag>).
+// The optional mirror directory uses the same layout (e.g. a copy of another host's cache), release
+// archives may also be placed directly into it using their upstream file name.
+type Cache struct {
+	Dir       string `json:"dir"`
+	MirrorDir string `json:"mirror_dir,omitempty"`
+	// Offline disables all network access, sources must be available in the cache or mirror directory
+	Offline bool `json:"offline"`
+}
+
+// DefaultCacheDir returns $XDG_CACHE_HOME/secnginx, falling back to ~/.cache/secnginx
+func DefaultCacheDir() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "secnginx")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "secnginx-cache")
+	}
+
+	return filepath.Join(home, ".cache", "secnginx")
+}
+
+// Archive returns the path of a cached copy of the archive with the given SHA-256 digest.
+// Missing archives are taken from the mirror directory or downloaded from the given URLs, tried in order
+func (c *Cache) Archive(ctx context.Context, name, version, digest, file string, urls []string) (string, error) {
+	rel := filepath.Join(name, version, strings.ToLower(digest), file)
+	verify := func(file string) error {
+		_, err := VerifySHA256(file, digest)
+		return err
+	}
+
+	return c.get(ctx, rel, urls, verify)
+}
+
+// Signature returns the path of a cached copy of the signature of the given cached archive and the fingerprint of
+// the signing key. Signatures, which don't verify the archive (e.g. error pages), are dropped and the next URL is tried
+func (c *Cache) Signature(ctx context.Context, archive string, urls []string, pgp *PGPConfig) (string, string, error) {
+	rel, err := filepath.Rel(c.Dir, archive+".sig")
+	if err != nil {
+		return "", "", err
+	}
+
+	signedBy := ""
+	verify := func(signature string) error {
+		fingerprint, err := pgp.VerifySignature(archive, signature)
+		signedBy = fingerprint
+		return err
+	}
+
+	signature, err := c.get(ctx, rel, urls, verify)
+	return signature, signedBy, err
+}
+
+// get looks up the file in the cache and the mirror directory and downloads it if required
+func (c *Cache) get(ctx context.Context, rel string, urls []string, verify func(string) error) (string, error) {
+	target := filepath.Join(c.Dir, rel)
+
+	if fileExists(target) {
+		if err := verify(target); err == nil {
+			return target, nil
+		}
+		// drop corrupted cache entries
+		os.Remove(target)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return "", err
+	}
+
+	if c.MirrorDir != "" {
+		candidates := []string{filepath.Join(c.MirrorDir, rel), filepath.Join(c.MirrorDir, filepath.Base(rel))}
+		for _, url := range urls {
+			candidates = append(candidates, filepath.Join(c.MirrorDir, path.Base(url)))
+		}
+
+		for _, candidate := range candidates {
+			if !fileExists(candidate) {
+				continue
+			}
+
+			if err := verify(candidate); err != nil {
+				return "", fmt.Errorf("mirrored file %s is invalid: %s", candidate, err)
+			}
+
+			if err := copyFile(candidate, target); err != nil {
+				return "", err
+			}
+
+			return target, nil
+		}
+	}
+
+	if c.Offline {
+		return "", fmt.Errorf("%s is neither cached nor mirrored, but network access is disabled in offline mode", filepath.Base(rel))
+	}
+
+	// try all mirrors in order, partial downloads are resumed
+	errs := []string{}
+	for _, url := range urls {
+		err := DownloadWithRetry(ctx, url, target+".part")
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
+		if err == nil {
+			err = verify(target + ".part")
+			if err != nil {
+				os.Remove(target + ".part")
+			}
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", url, err))
+			continue
+		}
+
+		return target, os.Rename(target+".part", target)
+	}
+
+	return "", fmt.Errorf("all mirrors failed:\n  %s", strings.Join(errs, "\n  "))
+}
+
+// GitCheckout places the repository at ref into dir and returns the commit it resolved to. Checkouts are cached
+// as snapshots keyed by their commit, so tags are resolved via 'git ls-remote' first (offline, the last resolution
+// is used). A snapshot is only used, if its archive matches the digest recorded next to it and git verifies the
+// extracted checkout against the commit
+func (c *Cache) GitCheckout(ctx context.Context, name, repository, ref, dir string, submodules bool) (string, error) {
+	commit := c.resolveRef(ctx, name, repository, ref)
+	if commit != "" {
+		ok, err := c.extractGitSnapshot(name, commit, dir)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return commit, nil
+		}
+	}
+
+	if c.Offline {
+		return "", fmt.Errorf("%s at %s is neither cached nor mirrored, but network access is disabled in offline mode", name, ref)
+	}
+
+	commit, err := gitCheckout(ctx, repository, ref, dir, submodules)
+	if err != nil {
+		return "", err
+	}
+
+	return commit, c.storeGitSnapshot(name, ref, dir, commit)
+}
+
+// resolveRef returns the commit ref points to, or "" if it can't be resolved
+func (c *Cache) resolveRef(ctx context.Context, name, repository, ref string) string {
+	if isCommitHash(ref) {
+		return strings.ToLower(ref)
+	}
+
+	if !c.Offline {
+		out, err := exec.CommandContext(ctx, "git", "ls-remote", repository, "refs/tags/"+ref, "refs/tags/"+ref+"^{}").Output()
+		if err != nil {
+			return ""
+		}
+
+		commit := ""
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Fields(line)
+			// annotated tags are peeled to the commit they point to
+			if len(fields) == 2 && (commit == "" || strings.HasSuffix(fields[1], "^{}")) {
+				commit = fields[0]
+			}
+		}
+		return commit
+	}
+
+	for _, base := range []string{c.Dir, c.MirrorDir} {
+		if base == "" {
+			continue
+		}
+
+		if data, err := ioutil.ReadFile(filepath.Join(base, gitRefIndex(name, ref))); err == nil {
+			return strings.TrimSpace(string(data))
+		}
+	}
+
+	return ""
+}
+
+// extractGitSnapshot extracts the snapshot of the commit from the cache or the mirror directory into dir.
+// It reports whether a snapshot has been found
+func (c *Cache) extractGitSnapshot(name, commit, dir string) (bool, error) {
+	for _, base := range []string{c.Dir, c.MirrorDir} {
+		if base == "" {
+			continue
+		}
+
+		snapshot := filepath.Join(base, name, "git", commit+".tar.gz")
+		digest, err := ioutil.ReadFile(snapshot + ".sha256")
+		if err != nil || !fileExists(snapshot) {
+			continue
+		}
+
+		os.RemoveAll(dir)
+		if err = verifyGitSnapshot(snapshot, strings.TrimSpace(string(digest)), dir, commit); err == nil {
+			return true, nil
+		}
+		os.RemoveAll(dir)
+
+		if base == c.MirrorDir {
+			return false, fmt.Errorf("mirrored snapshot %s is invalid: %s", snapshot, err)
+		}
+
+		// drop corrupted cache entries
+		os.Remove(snapshot)
+		os.Remove(snapshot + ".sha256")
+	}
+
+	return false, nil
+}
+
+// verifyGitSnapshot checks the snapshot against its digest, extracts it into dir and verifies the checkout
+func verifyGitSnapshot(snapshot, digest, dir, commit string) error {
+	if _, err := VerifySHA256(snapshot, digest); err != nil {
+		return err
+	}
+
+	if _, err := extractTarGz(snapshot, dir, false); err != nil {
+		return err
+	}
+
+	return verifyCheckout(dir, commit)
+}
+
+// verifyCheckout checks that the checkout in dir is exactly the commit: git verifies the hashes of all objects,
+// including the ones of submodules, and the working tree has to match HEAD
+func verifyCheckout(dir, commit string) error {
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("git %s failed: %s %s", args[0], err, strings.TrimSpace(string(out)))
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	head, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	if head != commit {
+		return fmt.Errorf("checkout is at %s, expected %s", head, commit)
+	}
+
+	if _, err = git("fsck", "--no-dangling", "--no-progress"); err != nil {
+		return err
+	}
+
+	if fileExists(filepath.Join(dir, ".gitmodules")) {
+		if _, err = git("submodule", "foreach", "--quiet", "--recursive", "git fsck --no-dangling --no-progress"); err != nil {
+			return err
+		}
+	}
+
+	status, err := git("status", "--porcelain", "--ignored", "--untracked-files=all", "--ignore-submodules=none")
+	if err != nil {
+		return err
+	}
+	if status != "" {
+		return fmt.Errorf("checkout differs from commit %s:\n%s", commit, status)
+	}
+
+	return nil
+}
+
+// storeGitSnapshot stores the checkout in dir as snapshot of the commit, together with the digest of the snapshot
+// and the resolution of ref for offline builds
+func (c *Cache) storeGitSnapshot(name, ref, dir, commit string) error {
+	snapshot := filepath.Join(c.Dir, name, "git", commit+".tar.gz")
+	if err := os.MkdirAll(filepath.Dir(snapshot), os.ModePerm); err != nil {
+		return err
+	}
+
+	entries := []ArtifactEntry{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		entries = append(entries, ArtifactEntry{Name: filepath.ToSlash(rel), Source: path})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = writeTarGz(snapshot, entries); err != nil {
+		return err
+	}
+
+	digest, err := FileSHA256(snapshot)
+	if err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(snapshot+".sha256", []byte(digest+"\n"), 0644); err != nil {
+		return err
+	}
+
+	if strings.EqualFold(ref, commit) {
+		return nil
+	}
+
+	index := filepath.Join(c.Dir, gitRefIndex(name, ref))
+	if err = os.MkdirAll(filepath.Dir(index), os.ModePerm); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(index, []byte(commit+"\n"), 0644)
+}
+
+// gitRefIndex returns the path of the file recording the commit of ref, relative to the cache directory
+func gitRefIndex(name, ref string) string {
+	return filepath.Join(name, "git", "refs", strings.Replace(ref, "/", "_", -1))
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+func copyFile(source, dest string) error {
+	data, err := ioutil.ReadFile(source)
+	if err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(dest+".part", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(dest+".part", dest)
+}
@@ -0,0 +1,181 @@
+package util
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGitCheckoutCache(t *testing.T) {
+	dir := t.TempDir()
+	repo, first := testRepository(t, dir)
+	ctx := context.Background()
+	cache := &Cache{Dir: filepath.Join(dir, "cache")}
+
+	commit, err := cache.GitCheckout(ctx, "ngx_test", repo, "v1.0.0", filepath.Join(dir, "a"), false)
+	if err != nil || commit != first {
+		t.Fatalf("GitCheckout() = %s, %v, want %s", commit, err, first)
+	}
+
+	snapshot := filepath.Join(cache.Dir, "ngx_test", "git", first+".tar.gz")
+	if !fileExists(snapshot) || !fileExists(snapshot+".sha256") {
+		t.Fatal("snapshot hasn't been stored by commit")
+	}
+
+	// a moved tag isn't frozen by the cached snapshot
+	git := func(args ...string) string {
+		args = append([]string{"-C", repo, "-c", "user.name=SecNginX", "-c", "user.email=test@example.org"}, args...)
+		out, err := exec.Command("git", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s failed: %s %s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("commit", "--quiet", "--allow-empty", "-m", "fix")
+	git("tag", "-f", "v1.0.0")
+	second := git("rev-parse", "HEAD")
+
+	commit, err = cache.GitCheckout(ctx, "ngx_test", repo, "v1.0.0", filepath.Join(dir, "b"), false)
+	if err != nil || commit != second {
+		t.Fatalf("GitCheckout() after moving the tag = %s, %v, want %s", commit, err, second)
+	}
+
+	// offline, the last resolution of the tag and its snapshot are used
+	offline := &Cache{Dir: cache.Dir, Offline: true}
+	commit, err = offline.GitCheckout(ctx, "ngx_test", repo, "v1.0.0", filepath.Join(dir, "c"), false)
+	if err != nil || commit != second {
+		t.Fatalf("offline GitCheckout() = %s, %v, want %s", commit, err, second)
+	}
+
+	commit, err = offline.GitCheckout(ctx, "ngx_test", repo, first, filepath.Join(dir, "d"), false)
+	if err != nil || commit != first {
+		t.Fatalf("offline GitCheckout() of the commit = %s, %v, want %s", commit, err, first)
+	}
+}
+
+func TestGitSnapshotIntegrity(t *testing.T) {
+	dir := t.TempDir()
+	repo, commit := testRepository(t, dir)
+	ctx := context.Background()
+	cache := &Cache{Dir: filepath.Join(dir, "cache")}
+
+	if _, err := cache.GitCheckout(ctx, "ngx_test", repo, commit, filepath.Join(dir, "checkout"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// a mirror with a modified checkout, whose snapshot digest has been updated accordingly
+	mirror := filepath.Join(dir, "mirror")
+	tampered := filepath.Join(mirror, "ngx_test", "git", commit+".tar.gz")
+	if err := ioutil.WriteFile(filepath.Join(dir, "checkout", "config"), []byte("evil\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(tampered), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Cache{Dir: mirror}).storeGitSnapshot("ngx_test", commit, filepath.Join(dir, "checkout"), commit); err != nil {
+		t.Fatal(err)
+	}
+
+	offline := &Cache{Dir: filepath.Join(dir, "empty"), MirrorDir: mirror, Offline: true}
+	if _, err := offline.GitCheckout(ctx, "ngx_test", repo, commit, filepath.Join(dir, "a"), false); err == nil ||
+		!strings.Contains(err.Error(), "differs from commit") {
+		t.Fatalf("GitCheckout() of a tampered mirror snapshot error = %v", err)
+	}
+
+	// corrupted cache entries are dropped
+	snapshot := filepath.Join(cache.Dir, "ngx_test", "git", commit+".tar.gz")
+	if err := ioutil.WriteFile(snapshot, []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	offline = &Cache{Dir: cache.Dir, Offline: true}
+	if _, err := offline.GitCheckout(ctx, "ngx_test", repo, commit, filepath.Join(dir, "b"), false); err == nil ||
+		!strings.Contains(err.Error(), "offline mode") {
+		t.Fatalf("GitCheckout() of a corrupted snapshot error = %v", err)
+	}
+	if fileExists(snapshot) {
+		t.Fatal("corrupted snapshot hasn't been dropped")
+	}
+}
+
+func TestSignatureCache(t *testing.T) {
+	dir := t.TempDir()
+	home, keyring, fingerprint := testKeyring(t, dir)
+	pgp := &PGPConfig{Keyring: keyring, TrustedFingerprints: []string{fingerprint}}
+
+	tarball := filepath.Join(dir, "nginx-1.17.0.tar.gz")
+	testTarball(t, tarball)
+	digest, err := FileSHA256(tarball)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature := filepath.Join(dir, "nginx-1.17.0.tar.gz.asc")
+	out, err := exec.Command("gpg", "--homedir", home, "--batch", "--pinentry-mode", "loopback", "--passphrase", "",
+		"--armor", "--output", signature, "--detach-sign", tarball).CombinedOutput()
+	if err != nil {
+		t.Fatalf("signing failed: %s %s", err, out)
+	}
+	good, err := ioutil.ReadFile(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		if r.URL.Path == "/good.asc" {
+			w.Write(good)
+			return
+		}
+		w.Write([]byte("<html>mirror maintenance</html>"))
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	cache := &Cache{Dir: filepath.Join(dir, "cache"), MirrorDir: dir}
+	archive, err := cache.Archive(ctx, "nginx", "1.17.0", digest, "nginx-1.17.0.tar.gz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a bad signature cached by an earlier run
+	if err = ioutil.WriteFile(archive+".sig", []byte("<html>not found</html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	urls := []string{server.URL + "/error.asc", server.URL + "/good.asc"}
+	cached, signedBy, err := cache.Signature(ctx, archive, urls, pgp)
+	if err != nil || !strings.EqualFold(signedBy, fingerprint) {
+		t.Fatalf("Signature() = %q, %v, want %s", signedBy, err, fingerprint)
+	}
+	if data, _ := ioutil.ReadFile(cached); string(data) != string(good) {
+		t.Fatal("the valid signature hasn't been cached")
+	}
+	if strings.Join(requests, " ") != "/error.asc /good.asc" {
+		t.Fatalf("requested %v, want the next mirror to be tried after the error page", requests)
+	}
+
+	// the valid signature is reused
+	requests = nil
+	if _, _, err = cache.Signature(ctx, archive, urls, pgp); err != nil || len(requests) != 0 {
+		t.Fatalf("Signature() of the cached signature = %v with requests %v", err, requests)
+	}
+
+	// no mirror serves a valid signature
+	if err = os.Remove(cached); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = cache.Signature(ctx, archive, urls[:1], pgp); err == nil {
+		t.Fatal("Signature() accepted an error page")
+	}
+	if fileExists(cached) || fileExists(cached+".part") {
+		t.Fatal("the invalid signature has been kept")
+	}
+}
@@ -0,0 +1,517 @@
+package util
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// sslBasicConf holds the TLS settings and security headers of the delivered configuration
+const sslBasicConf = "assets/ssl_basic.conf"
+
+var (
+	// canaryDirective matches the directives rewritten in the canary's copy of the configuration
+	canaryDirective = regexp.MustCompile(`(?m)^([ \t]*)(listen|pid|daemon|error_log|access_log|include|load_module)\s+([^;]*);`)
+	addHeader       = regexp.MustCompile(`(?m)^\s*add_header\s+(\S+)`)
+	moreSetHeaders  = regexp.MustCompile(`(?m)^\s*more_set_headers\s+["']?([^:"']+):`)
+	sslProtocols    = regexp.MustCompile(`(?m)^\s*ssl_protocols\s+([^;]+);`)
+)
+
+// tlsVersions are the protocols probed by the smoke suite, named like in ssl_protocols
+var tlsVersions = []struct {
+	Name    string
+	Version uint16
+}{
+	{"TLSv1", tls.VersionTLS10},
+	{"TLSv1.1", tls.VersionTLS11},
+	{"TLSv1.2", tls.VersionTLS12},
+	{"TLSv1.3", tls.VersionTLS13},
+}
+
+// CanaryListener is a listen directive of the live configuration, moved to a loopback port
+type CanaryListener struct {
+	// Listen is the address of the live configuration, e.g. [::]:443
+	Listen string
+	// Address is the loopback address the canary listens on instead
+	Address string
+	SSL     bool
+}
+
+// Canary is an NginX binary running the live configuration under a temporary prefix. The copied configuration
+// only listens on loopback ports and writes its pid and logs below the prefix, so the running NginX isn't affected
+type Canary struct {
+	Binary string
+	// Dir is the temporary prefix, the configuration is copied to Dir/conf
+	Dir       string
+	ConfPath  string
+	Listeners []CanaryListener
+	// SecurityHeaders and Protocols are the headers and TLS protocols configured in assets/ssl_basic.conf
+	SecurityHeaders []string
+	Protocols       []string
+
+	cmd    *exec.Cmd
+	output bytes.Buffer
+	exited chan error
+}
+
+// SmokeResult is the outcome of the smoke suite for one listener
+type SmokeResult struct {
+	Listener CanaryListener
+	Status   int
+	Header   http.Header
+	// Protocols are the TLS protocols the listener negotiated, ALPN the protocol selected via ALPN
+	Protocols []string
+	ALPN      string
+	Err       error
+}
+
+// NewCanary copies the configuration directory of confPath and rewrites the copy for the binary. If release is
+// set, its dynamic modules are loaded from the release instead of the live modules path
+func NewCanary(binary, confPath string, release *Release) (*Canary, error) {
+	dir, err := ioutil.TempDir("", "secnginx-canary")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Canary{Binary: binary, Dir: dir, ConfPath: filepath.Join(dir, "conf", filepath.Base(confPath))}
+	if err = c.prepare(filepath.Dir(confPath), release); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Canary) prepare(confDir string, release *Release) error {
+	conf := filepath.Join(c.Dir, "conf")
+	if out, err := exec.Command("cp", "-a", confDir+"/.", conf).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed copying %s: %s %s", confDir, err, strings.TrimSpace(string(out)))
+	}
+
+	if release != nil {
+		modulesConf := filepath.Join(conf, ModulesConfName)
+		modules, err := ReadModulesConf(modulesConf)
+		if err != nil {
+			return err
+		}
+		modules.Update(append([]DynamicModule{}, release.DynamicModules...))
+		if err = modules.Write(modulesConf); err != nil {
+			return err
+		}
+	}
+
+	ipv6 := true
+	if l, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		l.Close()
+	} else {
+		ipv6 = false
+	}
+
+	r := &canaryRewriter{Dir: c.Dir, ConfDir: confDir, Release: release, IPv6: ipv6, FreePort: freePort}
+	err := filepath.Walk(conf, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		rewritten := r.Rewrite(string(data))
+		if rewritten == string(data) {
+			return nil
+		}
+
+		return ioutil.WriteFile(path, []byte(rewritten), info.Mode().Perm())
+	})
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		return err
+	}
+	c.Listeners = r.Listeners
+
+	if len(c.Listeners) == 0 {
+		return fmt.Errorf("the configuration in %s has no listen directives", confDir)
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(conf, sslBasicConf)); err == nil {
+		for _, match := range addHeader.FindAllStringSubmatch(string(data), -1) {
+			c.SecurityHeaders = append(c.SecurityHeaders, match[1])
+		}
+		for _, match := range moreSetHeaders.FindAllStringSubmatch(string(data), -1) {
+			c.SecurityHeaders = append(c.SecurityHeaders, strings.TrimSpace(match[1]))
+		}
+		if match := sslProtocols.FindStringSubmatch(string(data)); match != nil {
+			c.Protocols = strings.Fields(match[1])
+		}
+	}
+
+	return nil
+}
+
+// canaryRewriter rewrites the configuration files copied to Dir/conf, so they don't touch the live NginX
+type canaryRewriter struct {
+	Dir     string
+	ConfDir string
+	Release *Release
+	// IPv6 is whether an IPv6 loopback is available, IPv6 listeners are disabled otherwise
+	IPv6 bool
+	// FreePort returns an unused loopback port
+	FreePort func() (string, error)
+	// Listeners are the rewritten listen directives, in order of appearance
+	Listeners []CanaryListener
+
+	ports map[string]string
+	seen  map[string]bool
+	err   error
+}
+
+// Rewrite rewrites the directives of one configuration file. The first error is kept in r.err
+func (r *canaryRewriter) Rewrite(data string) string {
+	return canaryDirective.ReplaceAllStringFunc(data, func(s string) string {
+		return r.rewrite(canaryDirective.FindStringSubmatch(s))
+	})
+}
+
+func (r *canaryRewriter) rewrite(match []string) string {
+	indent, name, args := match[1], match[2], strings.Fields(match[3])
+	if len(args) == 0 {
+		return match[0]
+	}
+
+	conf := filepath.Join(r.Dir, "conf")
+	switch name {
+	case "pid", "daemon":
+		// both are passed via -g
+		return indent + "# " + strings.TrimSpace(match[0]) + " # disabled by the canary"
+	case "error_log":
+		args[0] = filepath.Join(r.Dir, "error.log")
+	case "access_log":
+		if args[0] != "off" {
+			args[0] = filepath.Join(r.Dir, "access.log")
+		}
+	case "include":
+		if strings.HasPrefix(args[0], r.ConfDir+"/") {
+			args[0] = filepath.Join(conf, strings.TrimPrefix(args[0], r.ConfDir+"/"))
+		}
+	case "load_module":
+		if r.Release != nil && strings.HasPrefix(args[0], r.Release.ModulesPath+"/") {
+			args[0] = filepath.Join(r.Release.Modules(), strings.TrimPrefix(args[0], r.Release.ModulesPath+"/"))
+		}
+	case "listen":
+		port, v6, ok := listenPort(args[0])
+		if !ok {
+			r.fail(fmt.Errorf("unsupported listen address %s", args[0]))
+			return match[0]
+		}
+		if v6 && !r.IPv6 {
+			return indent + "# " + strings.TrimSpace(match[0]) + " # disabled by the canary, no IPv6 loopback"
+		}
+
+		if r.ports == nil {
+			r.ports, r.seen = map[string]string{}, map[string]bool{}
+		}
+		if r.ports[port] == "" {
+			free, err := r.FreePort()
+			if err != nil {
+				r.fail(err)
+				return match[0]
+			}
+			r.ports[port] = free
+		}
+
+		listener := CanaryListener{Listen: args[0], Address: "127.0.0.1:" + r.ports[port]}
+		if v6 {
+			listener.Address = "[::1]:" + r.ports[port]
+		}
+		args[0] = listener.Address
+
+		quic := false
+		for _, param := range args[1:] {
+			listener.SSL = listener.SSL || param == "ssl"
+			quic = quic || param == "quic"
+		}
+
+		// QUIC listeners share the port of the TCP ones and aren't probed
+		if !quic && !r.seen[listener.Address] {
+			r.seen[listener.Address] = true
+			r.Listeners = append(r.Listeners, listener)
+		}
+	}
+
+	return indent + name + " " + strings.Join(args, " ") + ";"
+}
+
+func (r *canaryRewriter) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// listenPort returns the port of a listen address and whether it is an IPv6 address
+func listenPort(addr string) (string, bool, bool) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "", false, false
+	}
+
+	if strings.HasPrefix(addr, "[") {
+		i := strings.Index(addr, "]:")
+		if i < 0 {
+			return "80", true, true
+		}
+		return addr[i+2:], true, true
+	}
+
+	if i := strings.LastIndex(addr, ":"); i >= 0 {
+		return addr[i+1:], false, true
+	}
+
+	// either a port or an address using the default port
+	if strings.Trim(addr, "0123456789") == "" {
+		return addr, false, true
+	}
+
+	return "80", false, true
+}
+
+// freePort returns a currently unused loopback port
+func freePort() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	return port, err
+}
+
+// Start runs the canary in the foreground and waits until all listeners accept connections
+func (c *Canary) Start(timeout time.Duration) error {
+	c.cmd = exec.Command(c.Binary, "-p", c.Dir+"/", "-c", c.ConfPath,
+		"-g", fmt.Sprintf("daemon off; pid %s;", filepath.Join(c.Dir, "nginx.pid")))
+	c.cmd.Stdout = &c.output
+	c.cmd.Stderr = &c.output
+
+	if err := c.cmd.Start(); err != nil {
+		return err
+	}
+
+	c.exited = make(chan error, 1)
+	go func() { c.exited <- c.cmd.Wait() }()
+
+	deadline := time.Now().Add(timeout)
+	for _, l := range c.Listeners {
+		for {
+			select {
+			case err := <-c.exited:
+				c.exited <- err
+				return fmt.Errorf("canary exited (%v): %s%s", err, c.output.String(), c.errorLog())
+			default:
+			}
+
+			conn, err := net.DialTimeout("tcp", l.Address, time.Second)
+			if err == nil {
+				conn.Close()
+				break
+			}
+
+			if time.Now().After(deadline) {
+				return fmt.Errorf("canary doesn't listen on %s after %s: %s", l.Address, timeout, c.errorLog())
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	return nil
+}
+
+// errorLog returns the error log of the canary
+func (c *Canary) errorLog() string {
+	data, _ := ioutil.ReadFile(filepath.Join(c.Dir, "error.log"))
+	return strings.TrimSpace(string(data))
+}
+
+// Stop shuts the canary down gracefully, killing it after 10 seconds, and removes its prefix
+func (c *Canary) Stop() {
+	defer os.RemoveAll(c.Dir)
+
+	if c.cmd == nil || c.cmd.Process == nil {
+		return
+	}
+
+	c.cmd.Process.Signal(syscall.SIGQUIT)
+	select {
+	case <-c.exited:
+	case <-time.After(10 * time.Second):
+		c.cmd.Process.Kill()
+		<-c.exited
+	}
+}
+
+// Smoke requests / from every listener and probes the TLS protocols of the SSL listeners
+func (c *Canary) Smoke() []SmokeResult {
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	client := &http.Client{
+		Timeout:       5 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+		Transport:     &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true},
+	}
+
+	results := []SmokeResult{}
+	for _, l := range c.Listeners {
+		result := SmokeResult{Listener: l}
+
+		scheme := "http"
+		if l.SSL {
+			scheme = "https"
+		}
+
+		resp, err := client.Get(scheme + "://" + l.Address + "/")
+		if err != nil {
+			result.Err = err
+			results = append(results, result)
+			continue
+		}
+		resp.Body.Close()
+		result.Status, result.Header = resp.StatusCode, resp.Header
+
+		if l.SSL {
+			dialer := &net.Dialer{Timeout: 5 * time.Second}
+			for _, v := range tlsVersions {
+				conn, err := tls.DialWithDialer(dialer, "tcp", l.Address, &tls.Config{
+					InsecureSkipVerify: true,
+					MinVersion:         v.Version,
+					MaxVersion:         v.Version,
+					NextProtos:         []string{"h2", "http/1.1"},
+				})
+				if err != nil {
+					continue
+				}
+				result.Protocols = append(result.Protocols, v.Name)
+				result.ALPN = conn.ConnectionState().NegotiatedProtocol
+				conn.Close()
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// Report checks the smoke results of the new build against the configuration and the results of the old
+// build, which may be nil. It returns the differences between both builds and the failed checks
+func (c *Canary) Report(results, old []SmokeResult) ([]string, []string) {
+	previous := map[string]SmokeResult{}
+	for _, r := range old {
+		previous[r.Listener.Listen] = r
+	}
+
+	report, failures := []string{}, []string{}
+	for _, r := range results {
+		o, compare := previous[r.Listener.Listen]
+		compare = compare && o.Err == nil
+
+		name := fmt.Sprintf("listen %s", r.Listener.Listen)
+		if r.Err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, r.Err))
+			continue
+		}
+
+		summary := fmt.Sprintf("%s: HTTP %d", name, r.Status)
+		if compare {
+			summary = fmt.Sprintf("%s: HTTP %d -> %d", name, o.Status, r.Status)
+		}
+		if r.Listener.SSL {
+			summary += fmt.Sprintf(", %s, ALPN %s", strings.Join(r.Protocols, " "), r.ALPN)
+		}
+		report = append(report, summary)
+
+		if r.Status >= 500 {
+			failures = append(failures, fmt.Sprintf("%s: HTTP Status Code %d", name, r.Status))
+		} else if compare && o.Status != r.Status {
+			failures = append(failures, fmt.Sprintf("%s: HTTP Status Code changed from %d to %d", name, o.Status, r.Status))
+		}
+
+		for _, h := range c.SecurityHeaders {
+			if r.Header.Get(h) == "" && (!compare || o.Header.Get(h) != "") {
+				failures = append(failures, fmt.Sprintf("%s: security header %s is missing", name, h))
+			}
+		}
+
+		if r.Listener.SSL {
+			expected := c.Protocols
+			if len(expected) == 0 && compare {
+				expected = o.Protocols
+			}
+			if len(expected) > 0 && strings.Join(r.Protocols, " ") != strings.Join(expected, " ") {
+				failures = append(failures, fmt.Sprintf("%s: negotiated %s, but %s is configured", name,
+					strings.Join(r.Protocols, " "), strings.Join(expected, " ")))
+			}
+			if compare && o.ALPN != r.ALPN {
+				report = append(report, fmt.Sprintf("  ~ ALPN: %s -> %s", o.ALPN, r.ALPN))
+			}
+			if compare && strings.Join(o.Protocols, " ") != strings.Join(r.Protocols, " ") {
+				report = append(report, fmt.Sprintf("  ~ TLS protocols: %s -> %s", strings.Join(o.Protocols, " "),
+					strings.Join(r.Protocols, " ")))
+			}
+		}
+
+		if compare {
+			report = append(report, headerDiff(o.Header, r.Header)...)
+		}
+	}
+
+	return report, failures
+}
+
+// headerDiff lists the response headers added (+), removed (-) and changed (~) by the new build
+func headerDiff(old, new http.Header) []string {
+	names := map[string]bool{}
+	for name := range old {
+		names[name] = true
+	}
+	for name := range new {
+		names[name] = true
+	}
+
+	sorted := []string{}
+	for name := range names {
+		// differs on every response
+		if name != "Date" {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+
+	diff := []string{}
+	for _, name := range sorted {
+		o, n := strings.Join(old[name], ", "), strings.Join(new[name], ", ")
+		switch {
+		case o == n:
+		case o == "":
+			diff = append(diff, fmt.Sprintf("  + %s: %s", name, n))
+		case n == "":
+			diff = append(diff, fmt.Sprintf("  - %s: %s", name, o))
+		default:
+			diff = append(diff, fmt.Sprintf("  ~ %s: %s -> %s", name, o, n))
+		}
+	}
+
+	return diff
+}
@@ -0,0 +1,153 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCanaryRewrite(t *testing.T) {
+	release := &Release{ID: "1.17.0-openssl-1.1.1c-abcdef", ModulesPath: "/usr/lib/nginx/modules"}
+
+	tests := []struct {
+		name      string
+		conf      string
+		ipv6      bool
+		want      string
+		listeners []CanaryListener
+		wantErr   bool
+	}{
+		{"pid and daemon", "pid /run/nginx.pid;\ndaemon on;", false,
+			"# pid /run/nginx.pid; # disabled by the canary\n# daemon on; # disabled by the canary", nil, false},
+		{"logs", "error_log /var/log/nginx/error.log warn;\n  access_log /var/log/nginx/access.log main;\naccess_log off;", false,
+			"error_log /tmp/canary/error.log warn;\n  access_log /tmp/canary/access.log main;\naccess_log off;", nil, false},
+		{"include", "include /etc/nginx/conf.d/*.conf;\ninclude mime.types;\ninclude /usr/share/nginx/modules.conf;", false,
+			"include /tmp/canary/conf/conf.d/*.conf;\ninclude mime.types;\ninclude /usr/share/nginx/modules.conf;", nil, false},
+		{"load_module", "load_module /usr/lib/nginx/modules/ngx_http_brotli_filter_module.so;\nload_module /opt/other/ngx_test.so;", false,
+			"load_module /opt/secnginx/1.17.0-openssl-1.1.1c-abcdef/modules/ngx_http_brotli_filter_module.so;\nload_module /opt/other/ngx_test.so;", nil, false},
+		{"listen", "    listen 80;\n    listen 443 ssl http2;\n    listen 443 quic reuseport;", false,
+			"    listen 127.0.0.1:10001;\n    listen 127.0.0.1:10002 ssl http2;\n    listen 127.0.0.1:10002 quic reuseport;",
+			[]CanaryListener{
+				{Listen: "80", Address: "127.0.0.1:10001"},
+				{Listen: "443", Address: "127.0.0.1:10002", SSL: true},
+			}, false},
+		{"listen address", "listen 192.0.2.1:8080 default_server;\nlisten localhost;", false,
+			"listen 127.0.0.1:10001 default_server;\nlisten 127.0.0.1:10002;",
+			[]CanaryListener{
+				{Listen: "192.0.2.1:8080", Address: "127.0.0.1:10001"},
+				{Listen: "localhost", Address: "127.0.0.1:10002"},
+			}, false},
+		{"listen IPv6", "listen [::]:443 ssl;\nlisten 443 ssl;", true,
+			"listen [::1]:10001 ssl;\nlisten 127.0.0.1:10001 ssl;",
+			[]CanaryListener{
+				{Listen: "[::]:443", Address: "[::1]:10001", SSL: true},
+				{Listen: "443", Address: "127.0.0.1:10001", SSL: true},
+			}, false},
+		{"listen IPv6 without loopback", "listen [::]:443 ssl;", false,
+			"# listen [::]:443 ssl; # disabled by the canary, no IPv6 loopback", nil, false},
+		{"listen unix socket", "listen unix:/run/nginx.sock;", false, "listen unix:/run/nginx.sock;", nil, true},
+		{"untouched", "server_name example.org;\n# listen 80;\nworker_processes auto;", false,
+			"server_name example.org;\n# listen 80;\nworker_processes auto;", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := 10000
+			r := &canaryRewriter{Dir: "/tmp/canary", ConfDir: "/etc/nginx", Release: release, IPv6: tt.ipv6,
+				FreePort: func() (string, error) {
+					port++
+					return fmt.Sprint(port), nil
+				}}
+
+			if got := r.Rewrite(tt.conf); got != tt.want {
+				t.Fatalf("Rewrite() =\n%s\nwant\n%s", got, tt.want)
+			}
+			if (r.err != nil) != tt.wantErr {
+				t.Fatalf("Rewrite() error = %v, wantErr %v", r.err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(r.Listeners, tt.listeners) {
+				t.Fatalf("Listeners = %v, want %v", r.Listeners, tt.listeners)
+			}
+		})
+	}
+}
+
+func TestHeaderDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new http.Header
+		want     []string
+	}{
+		{"equal", http.Header{"Server": {"nginx"}}, http.Header{"Server": {"nginx"}}, []string{}},
+		{"date ignored", http.Header{"Date": {"Mon, 01 Jul 2019 10:00:00 GMT"}}, http.Header{"Date": {"Mon, 01 Jul 2019 10:00:01 GMT"}}, []string{}},
+		{"added", http.Header{}, http.Header{"Alt-Svc": {`h3=":443"`}}, []string{`  + Alt-Svc: h3=":443"`}},
+		{"removed", http.Header{"X-Powered-By": {"PHP"}}, http.Header{}, []string{"  - X-Powered-By: PHP"}},
+		{"changed", http.Header{"Server": {"nginx/1.16.1"}}, http.Header{"Server": {"nginx/1.17.0"}}, []string{"  ~ Server: nginx/1.16.1 -> nginx/1.17.0"}},
+		{"multiple values", http.Header{"Vary": {"Accept-Encoding"}}, http.Header{"Vary": {"Accept-Encoding", "Origin"}}, []string{"  ~ Vary: Accept-Encoding -> Accept-Encoding, Origin"}},
+		{"sorted", http.Header{"X-B": {"1"}}, http.Header{"X-A": {"1"}}, []string{"  + X-A: 1", "  - X-B: 1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := headerDiff(tt.old, tt.new); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("headerDiff() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanaryReport(t *testing.T) {
+	https := CanaryListener{Listen: "443", Address: "127.0.0.1:10001", SSL: true}
+	secure := http.Header{"Strict-Transport-Security": {"max-age=63072000"}}
+	ok := SmokeResult{Listener: https, Status: 200, Header: secure, Protocols: []string{"TLSv1.2", "TLSv1.3"}, ALPN: "h2"}
+
+	with := func(change func(r *SmokeResult)) SmokeResult {
+		r := ok
+		change(&r)
+		return r
+	}
+
+	tests := []struct {
+		name         string
+		results, old []SmokeResult
+		wantReport   []string
+		wantFailures []string
+	}{
+		{"healthy", []SmokeResult{ok}, nil,
+			[]string{"listen 443: HTTP 200, TLSv1.2 TLSv1.3, ALPN h2"}, nil},
+		{"unchanged", []SmokeResult{ok}, []SmokeResult{ok},
+			[]string{"listen 443: HTTP 200 -> 200, TLSv1.2 TLSv1.3, ALPN h2"}, nil},
+		{"request failed", []SmokeResult{with(func(r *SmokeResult) { r.Err = errors.New("connection refused") })}, nil,
+			nil, []string{"listen 443: connection refused"}},
+		{"server error", []SmokeResult{with(func(r *SmokeResult) { r.Status = 502 })}, nil,
+			[]string{"listen 443: HTTP 502, TLSv1.2 TLSv1.3, ALPN h2"}, []string{"listen 443: HTTP Status Code 502"}},
+		{"status changed", []SmokeResult{with(func(r *SmokeResult) { r.Status = 404 })}, []SmokeResult{ok},
+			[]string{"listen 443: HTTP 200 -> 404, TLSv1.2 TLSv1.3, ALPN h2"},
+			[]string{"listen 443: HTTP Status Code changed from 200 to 404"}},
+		{"security header missing", []SmokeResult{with(func(r *SmokeResult) { r.Header = http.Header{} })}, []SmokeResult{ok},
+			[]string{"listen 443: HTTP 200 -> 200, TLSv1.2 TLSv1.3, ALPN h2", "  - Strict-Transport-Security: max-age=63072000"},
+			[]string{"listen 443: security header Strict-Transport-Security is missing"}},
+		{"protocols differ", []SmokeResult{with(func(r *SmokeResult) { r.Protocols = []string{"TLSv1.2"}; r.ALPN = "http/1.1" })}, []SmokeResult{ok},
+			[]string{"listen 443: HTTP 200 -> 200, TLSv1.2, ALPN http/1.1", "  ~ ALPN: h2 -> http/1.1", "  ~ TLS protocols: TLSv1.2 TLSv1.3 -> TLSv1.2"},
+			[]string{"listen 443: negotiated TLSv1.2, but TLSv1.2 TLSv1.3 is configured"}},
+		{"failed before", []SmokeResult{ok}, []SmokeResult{with(func(r *SmokeResult) { r.Err = errors.New("timeout") })},
+			[]string{"listen 443: HTTP 200, TLSv1.2 TLSv1.3, ALPN h2"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Canary{SecurityHeaders: []string{"Strict-Transport-Security"}, Protocols: []string{"TLSv1.2", "TLSv1.3"}}
+
+			report, failures := c.Report(tt.results, tt.old)
+			if strings.Join(report, "\n") != strings.Join(tt.wantReport, "\n") {
+				t.Fatalf("report =\n%s\nwant\n%s", strings.Join(report, "\n"), strings.Join(tt.wantReport, "\n"))
+			}
+			if strings.Join(failures, "\n") != strings.Join(tt.wantFailures, "\n") {
+				t.Fatalf("failures =\n%s\nwant\n%s", strings.Join(failures, "\n"), strings.Join(tt.wantFailures, "\n"))
+			}
+		})
+	}
+}
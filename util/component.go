@@ -0,0 +1,183 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Component is one of the source releases NginX is built from: NginX itself, PCRE, ZLib and the TLS library
+type Component struct {
+	// Name of the component, also used as directory name below the build directory
+	Name string `json:"name"`
+	// Title is the human readable name of the component
+	Title   string `json:"title"`
+	Version string `json:"version"`
+	// URLs of the release tarball, which are tried in order
+	URLs []string `json:"urls"`
+	// SHA256 is the expected digest of the release tarball or UpstreamChecksum
+	SHA256 string `json:"sha256,omitempty"`
+	// PGP is used to verify the detached signature of the tarball, if enabled
+	PGP *PGPConfig `json:"-"`
+	// Source replaces the release tarball, if set
+	Source *Source `json:"source,omitempty"`
+}
+
+// UpstreamChecksum can be configured instead of a digest to use the .sha256 file published next to the tarball.
+// It is fetched from the same mirror as the tarball, so it's only accepted together with pgp verification
+const UpstreamChecksum = "upstream"
+
+// defaultMirrors are used for components without entry in the [mirrors] table
+var defaultMirrors = map[string][]string{
+	"nginx":     {"https://nginx.org/download/nginx-{version}.tar.gz"},
+	"pcre":      {"https://ftp.exim.org/pub/pcre/pcre-{version}.tar.gz", "https://sourceforge.net/projects/pcre/files/pcre/{version}/pcre-{version}.tar.gz/download"},
+	"pcre2":     {"https://github.com/PCRE2Project/pcre2/releases/download/pcre2-{version}/pcre2-{version}.tar.gz"},
+	"zlib":      {"https://zlib.net/zlib-{version}.tar.gz", "https://zlib.net/fossils/zlib-{version}.tar.gz"},
+	"openssl":   {"https://www.openssl.org/source/openssl-{version}.tar.gz"},
+	"quictls":   {"https://github.com/quictls/openssl/archive/refs/tags/openssl-{version}.tar.gz"},
+	"libressl":  {"https://cdn.openbsd.org/pub/OpenBSD/LibreSSL/libressl-{version}.tar.gz", "https://ftp.openbsd.org/pub/OpenBSD/LibreSSL/libressl-{version}.tar.gz"},
+	"boringssl": {"https://github.com/google/boringssl/archive/{version}.tar.gz"},
+}
+
+// Components returns the source releases configured in the toml config
+func (c *Config) Components() []Component {
+	return []Component{
+		c.component("nginx", "NginX", c.NginXVersion),
+		c.component(c.PCREFlavor, strings.ToUpper(c.PCREFlavor), c.PCREVersion),
+		c.component("zlib", "ZLib", c.ZLibVersion),
+		c.component(c.TLSLibrary.Name, c.TLSLibrary.Title, c.TLSVersions[c.TLSLibrary.Name]),
+	}
+}
+
+func (c *Config) component(name, title, version string) Component {
+	templates := c.Mirrors[name]
+	if len(templates) == 0 {
+		templates = defaultMirrors[name]
+	}
+
+	urls := make([]string, len(templates))
+	for i, t := range templates {
+		urls[i] = strings.Replace(t, "{version}", version, -1)
+	}
+
+	return Component{
+		Name:    name,
+		Title:   title,
+		Version: version,
+		URLs:    urls,
+		SHA256:  c.Checksums[name],
+		PGP:     &c.PGP,
+		Source:  c.Sources[name],
+	}
+}
+
+// Validate checks whether a checksum and download URLs or a valid source have been configured for the component
+func (c Component) Validate() error {
+	if c.Source != nil {
+		if err := c.Source.Validate(); err != nil {
+			return fmt.Errorf("invalid source of %s: %s", c.Title, err)
+		}
+
+		return nil
+	}
+
+	if c.SHA256 == "" {
+		return fmt.Errorf("no SHA-256 checksum configured for %s, please add it to the [checksums] table", c.Title)
+	}
+
+	if c.SHA256 != UpstreamChecksum && !IsSHA256(c.SHA256) {
+		return fmt.Errorf("invalid SHA-256 checksum configured for %s: %s", c.Title, c.SHA256)
+	}
+
+	if len(c.URLs) == 0 {
+		return fmt.Errorf("no download URL configured for %s, please add it to the [mirrors] table", c.Title)
+	}
+
+	return nil
+}
+
+// ExpectedSHA256 returns the configured digest or fetches the upstream one
+func (c Component) ExpectedSHA256(ctx context.Context, cache *Cache) (string, error) {
+	if c.SHA256 != UpstreamChecksum {
+		return c.SHA256, nil
+	}
+
+	if cache.Offline {
+		return "", fmt.Errorf("upstream checksums can't be fetched in offline mode, please configure the SHA-256 checksum of %s", c.Title)
+	}
+
+	errs := []string{}
+	for _, url := range c.URLs {
+		digest, err := FetchSHA256(ctx, url+".sha256")
+		if err == nil {
+			return digest, nil
+		}
+		errs = append(errs, err.Error())
+	}
+
+	return "", fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// FileName returns the file name of the release tarball, taken from the first URL with a known archive extension
+func (c Component) FileName() string {
+	for _, url := range c.URLs {
+		name := path.Base(url)
+		for _, ext := range archiveExtensions {
+			if strings.HasSuffix(name, ext) {
+				return name
+			}
+		}
+	}
+
+	return fmt.Sprintf("%s-%s.tar.gz", c.Name, c.Version)
+}
+
+// Path returns the directory the release is extracted to
+func (c Component) Path(buildDir string) string {
+	return filepath.Join(buildDir, c.Name)
+}
+
+// Fetch loads the release tarball from the cache (or downloads it), verifies it and extracts it into the build directory.
+// Components with a configured source are taken from there instead
+func (c Component) Fetch(ctx context.Context, buildDir string, cache *Cache) (LockedSource, error) {
+	if c.Source != nil {
+		source, err := c.Source.Fetch(ctx, c.Name, c.Path(buildDir), cache)
+		if err != nil {
+			return source, fmt.Errorf("failed loading %s from its configured source!\n Error: %s", c.Title, err)
+		}
+		source.Version = c.Version
+
+		return source, nil
+	}
+
+	source := LockedSource{Name: c.Name, Version: c.Version, URL: c.URLs[0]}
+
+	expected, err := c.ExpectedSHA256(ctx, cache)
+	if err != nil {
+		return source, fmt.Errorf("failed fetching upstream checksum of %s!\n Error: %s", c.Title, err)
+	}
+
+	// the cache verifies the checksum of every archive it returns
+	archive, err := cache.Archive(ctx, c.Name, c.Version, expected, c.FileName(), c.URLs)
+	if err != nil {
+		return source, fmt.Errorf("failed loading selected %s version! Is the version number and checksum valid?\n Error: %s", c.Title, err)
+	}
+	source.SHA256 = expected
+
+	if c.PGP.Enabled() {
+		// the cache only returns signatures verifying the archive
+		_, source.SignedBy, err = cache.Signature(ctx, archive, c.PGP.SignatureURLs(c), c.PGP)
+		if err != nil {
+			return source, fmt.Errorf("PGP signature verification of %s failed, refusing to extract it!\n Error: %s", c.Title, err)
+		}
+	}
+
+	err = ExtractArchive(archive, c.Path(buildDir))
+	if err != nil {
+		return source, fmt.Errorf("failed extracting %s!\n Error: %s", c.Title, err)
+	}
+
+	return source, nil
+}
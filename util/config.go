@@ -1,17 +1,42 @@
 package util
 
 import (
+	"fmt"
+	"runtime"
+	"strings"
+
 	"github.com/spf13/viper"
 )
 
+// PCRE2MinNginXVersion is the first NginX release supporting PCRE2
+const PCRE2MinNginXVersion = "1.21.5"
+
 // Config - Wrapper for the toml config
 type Config struct {
-	NginXVersion   string
-	PCREVersion    string
-	ZLibVersion    string
-	OpenSSLVersion string
-	Configuration  string
-	Modules        string
+	NginXVersion string
+	// PCREFlavor is the selected PCRE library, either pcre or pcre2
+	PCREFlavor  string
+	PCREVersion string
+	ZLibVersion string
+	TLSLibrary  TLSLibrary
+	// TLSVersions maps the names of the TLS libraries to their configured version
+	TLSVersions       map[string]string
+	Configuration     string
+	Modules           string
+	ThirdPartyModules []Module
+	// Patches are sorted by their order
+	Patches         []Patch
+	Checksums       map[string]string
+	PGP             PGPConfig
+	CacheDir        string
+	MirrorDir       string
+	Mirrors         map[string][]string
+	Sources         map[string]*Source
+	DownloadWorkers int
+	// KeepReleases is the number of versioned installs kept after an install, 0 disables pruning
+	KeepReleases int
+	Hardening    Hardening
+	Profile      BuildProfile
 }
 
 // GetConfig from the toml config
@@ -27,12 +52,196 @@ func GetConfig() (*Config, error) {
 		return nil, err
 	}
 
-	return &Config{
-		viper.GetString("nginx_version"),
-		viper.GetString("pcre_version"),
-		viper.GetString("zlib_version"),
-		viper.GetString("openssl_version"),
-		viper.GetString("nginx_configuration"),
-		viper.GetString("nginx_modules"),
-	}, nil
+	config := &Config{
+		NginXVersion:  viper.GetString("nginx_version"),
+		ZLibVersion:   viper.GetString("zlib_version"),
+		Configuration: viper.GetString("nginx_configuration"),
+		Modules:       viper.GetString("nginx_modules"),
+		Checksums:     viper.GetStringMapString("checksums"),
+		CacheDir:      viper.GetString("cache_dir"),
+		MirrorDir:     viper.GetString("mirror_dir"),
+		Mirrors:       viper.GetStringMapStringSlice("mirrors"),
+	}
+
+	viper.SetDefault("pcre_flavor", "auto")
+	config.PCREFlavor, err = selectPCREFlavor(viper.GetString("pcre_flavor"), config.NginXVersion)
+	if err != nil {
+		return nil, err
+	}
+	config.PCREVersion = viper.GetString(config.PCREFlavor + "_version")
+
+	viper.SetDefault("tls_library", "openssl")
+	config.TLSLibrary, err = GetTLSLibrary(viper.GetString("tls_library"))
+	if err != nil {
+		return nil, err
+	}
+
+	config.TLSVersions = map[string]string{}
+	for _, l := range TLSLibraries {
+		config.TLSVersions[l.Name] = viper.GetString(l.Name + "_version")
+	}
+
+	viper.SetDefault("download_workers", 4)
+	config.DownloadWorkers = viper.GetInt("download_workers")
+
+	viper.SetDefault("keep_releases", DefaultKeepReleases)
+	config.KeepReleases = viper.GetInt("keep_releases")
+	if config.KeepReleases < 0 {
+		return nil, fmt.Errorf("keep_releases can't be negative")
+	}
+
+	if config.CacheDir == "" {
+		config.CacheDir = DefaultCacheDir()
+	}
+
+	if err = viper.UnmarshalKey("sources", &config.Sources); err != nil {
+		return nil, err
+	}
+
+	for name := range config.Sources {
+		if _, err = GetTLSLibrary(name); err != nil && name != "nginx" && name != "pcre" && name != "pcre2" && name != "zlib" {
+			return nil, fmt.Errorf("unknown component %s in [sources] table", name)
+		}
+	}
+
+	if err = viper.UnmarshalKey("pgp", &config.PGP); err != nil {
+		return nil, err
+	}
+
+	for _, c := range config.Components() {
+		if err = c.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = config.PGP.Validate(config.Components()); err != nil {
+		return nil, err
+	}
+
+	// third party modules are declared as [[module]] tables
+	if err = viper.UnmarshalKey("module", &config.ThirdPartyModules); err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for _, m := range config.ThirdPartyModules {
+		if err = m.Validate(); err != nil {
+			return nil, err
+		}
+
+		if names[m.Name] {
+			return nil, fmt.Errorf("module %s is declared more than once", m.Name)
+		}
+		names[m.Name] = true
+	}
+
+	// NginX is hardened unless disabled explicitly
+	for _, property := range []string{"pie", "stack_protector", "fortify_source", "nx"} {
+		viper.SetDefault("hardening."+property, true)
+	}
+	viper.SetDefault("hardening.relro", "full")
+
+	if err = viper.UnmarshalKey("hardening", &config.Hardening); err != nil {
+		return nil, err
+	}
+
+	if err = config.Hardening.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err = viper.UnmarshalKey("performance", &config.Profile); err != nil {
+		return nil, err
+	}
+
+	viper.SetDefault("build_profile", "default")
+	config.Profile.Name = viper.GetString("build_profile")
+	// 0 uses all CPUs
+	config.Profile.Jobs = viper.GetInt("make_jobs")
+	if config.Profile.Jobs == 0 {
+		config.Profile.Jobs = runtime.NumCPU()
+	}
+
+	if err = config.Profile.Validate(); err != nil {
+		return nil, err
+	}
+
+	// patches are declared as [[patch]] tables
+	if err = viper.UnmarshalKey("patch", &config.Patches); err != nil {
+		return nil, err
+	}
+
+	names = map[string]bool{}
+	for _, p := range config.Patches {
+		if err = p.Validate(); err != nil {
+			return nil, err
+		}
+
+		if names[p.Name] {
+			return nil, fmt.Errorf("patch %s is declared more than once", p.Name)
+		}
+		names[p.Name] = true
+	}
+	SortPatches(config.Patches)
+
+	return config, nil
+}
+
+// selectPCREFlavor resolves the pcre_flavor setting. auto selects PCRE2 for all NginX versions supporting it
+func selectPCREFlavor(flavor, nginxVersion string) (string, error) {
+	supported := CompareVersions(nginxVersion, PCRE2MinNginXVersion) >= 0
+
+	switch flavor {
+	case "auto":
+		if supported {
+			return "pcre2", nil
+		}
+		return "pcre", nil
+	case "pcre":
+		return flavor, nil
+	case "pcre2":
+		if !supported {
+			return "", fmt.Errorf("PCRE2 requires NginX %s or newer, but %s is configured", PCRE2MinNginXVersion, nginxVersion)
+		}
+		return flavor, nil
+	}
+
+	return "", fmt.Errorf("unknown pcre_flavor %s, supported are: auto, pcre, pcre2", flavor)
+}
+
+// ConfigureArgument returns the value of the given argument of nginx_configuration or nginx_modules or def, if it isn't set
+func (c *Config) ConfigureArgument(name, def string) string {
+	for _, line := range strings.Split(c.Configuration+"\n"+c.Modules, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, name+"=") {
+			return strings.TrimPrefix(line, name+"=")
+		}
+	}
+
+	return def
+}
+
+// UseTLSLibrary switches the TLS library, e.g. to a QUIC capable one, and validates its configuration
+func (c *Config) UseTLSLibrary(library TLSLibrary) error {
+	if c.TLSVersions[library.Name] == "" {
+		return fmt.Errorf("%s isn't configured, please set %s_version and its checksum", library.Title, library.Name)
+	}
+	c.TLSLibrary = library
+
+	components := c.Components()
+	if err := components[len(components)-1].Validate(); err != nil {
+		return err
+	}
+
+	return c.PGP.Validate(components)
+}
+
+// HasModule checks whether a third party module with the given name is declared
+func (c *Config) HasModule(name string) bool {
+	for _, m := range c.ThirdPartyModules {
+		if m.Name == name {
+			return true
+		}
+	}
+
+	return false
 }
@@ -0,0 +1,230 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// writeDeb writes the package as Debian binary package: an ar archive of debian-binary, control.tar.gz and data.tar.gz
+func (p *Package) writeDeb(w io.Writer) error {
+	control, err := p.debControlArchive()
+	if err != nil {
+		return err
+	}
+
+	data, err := p.debDataArchive()
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.WriteString(w, "!<arch>\n"); err != nil {
+		return err
+	}
+
+	members := []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", control},
+		{"data.tar.gz", data},
+	}
+
+	for _, m := range members {
+		header := fmt.Sprintf("%-16s%-12d%-6d%-6d%-8s%-10d`\n", m.name, p.BuildTime.Unix(), 0, 0, "100644", len(m.data))
+		if _, err = io.WriteString(w, header); err != nil {
+			return err
+		}
+		if _, err = w.Write(m.data); err != nil {
+			return err
+		}
+		// members are aligned to 2 bytes
+		if len(m.data)%2 != 0 {
+			if _, err = io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// debControl returns the content of the control file
+func (p *Package) debControl() string {
+	return fmt.Sprintf(`Package: %s
+Version: %s-%d
+Architecture: %s
+Maintainer: %s
+Installed-Size: %d
+Section: httpd
+Priority: optional
+Homepage: %s
+Description: %s
+ %s
+`, p.Name, p.Version, p.Release, PackageArch("deb"), p.Maintainer, (p.InstalledSize()+1023)/1024, p.URL, p.Summary,
+		p.Description)
+}
+
+// debControlArchive returns control.tar.gz, holding the control file, conffiles, md5sums and maintainer scripts
+func (p *Package) debControlArchive() ([]byte, error) {
+	md5sums := &strings.Builder{}
+	for _, f := range p.Files {
+		if !f.Mode.IsRegular() {
+			continue
+		}
+
+		digest, err := fileMD5(p.Source(f))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(md5sums, "%s  %s\n", digest, strings.TrimPrefix(f.Path, "/"))
+	}
+
+	conffiles := strings.Join(p.Conffiles(), "\n")
+	if conffiles != "" {
+		conffiles += "\n"
+	}
+
+	entries := []struct {
+		name    string
+		content string
+		mode    int64
+	}{
+		{"control", p.debControl(), 0644},
+		{"conffiles", conffiles, 0644},
+		{"md5sums", md5sums.String(), 0644},
+		{"preinst", p.PreInstall, 0755},
+		{"postinst", p.PostInstall, 0755},
+		{"postrm", p.PostRemove, 0755},
+	}
+
+	return gzipTar(func(tw *tar.Writer) error {
+		if err := tw.WriteHeader(&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755, ModTime: p.BuildTime, Uname: "root",
+			Gname: "root"}); err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if err := writeTarFile(tw, "./"+e.name, e.mode, p.BuildTime, []byte(e.content)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// debDataArchive returns data.tar.gz, holding the files of the package
+func (p *Package) debDataArchive() ([]byte, error) {
+	return gzipTar(func(tw *tar.Writer) error {
+		if err := tw.WriteHeader(&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755, ModTime: p.BuildTime, Uname: "root",
+			Gname: "root"}); err != nil {
+			return err
+		}
+
+		for _, f := range p.Files {
+			if err := p.writeTarEntry(tw, "."+f.Path, f, nil); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// writeTarEntry writes the package file as entry with the given name, owned by root
+func (p *Package) writeTarEntry(tw *tar.Writer, name string, f PackageFile, paxRecords map[string]string) error {
+	header := &tar.Header{
+		Name:       name,
+		Mode:       int64(f.Mode.Perm()),
+		ModTime:    f.ModTime,
+		Uname:      "root",
+		Gname:      "root",
+		PAXRecords: paxRecords,
+	}
+
+	switch {
+	case f.Mode.IsDir():
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+	case f.LinkTarget != "":
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = f.LinkTarget
+	default:
+		header.Typeflag = tar.TypeReg
+		header.Size = f.Size
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	file, err := os.Open(p.Source(f))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// writeTarFile writes a regular file with the given content, owned by root
+func writeTarFile(tw *tar.Writer, name string, mode int64, modTime time.Time, content []byte) error {
+	header := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: mode, Size: int64(len(content)), ModTime: modTime,
+		Uname: "root", Gname: "root"}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err := tw.Write(content)
+	return err
+}
+
+// gzipTar returns the gzip compressed tar archive written by the given function
+func gzipTar(write func(tw *tar.Writer) error) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	if err := write(tw); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// fileMD5 returns the hex encoded MD5 digest of the given file, as used by dpkg
+func fileMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := md5.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,187 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+// downloadRetries is the amount of attempts per URL, before the next mirror is tried
+const downloadRetries = 3
+
+// HTTPStatusError is returned, if the download server responds with an unexpected status code
+type HTTPStatusError struct {
+	URL  string
+	Code int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("Download Server returned HTTP Status Code %d for %s", e.Code, e.URL)
+}
+
+// DownloadFile downloads a file and saves it to the given path
+func DownloadFile(url string, target string) error {
+	os.Remove(target)
+	return DownloadFileContext(context.Background(), url, target)
+}
+
+// DownloadFileContext downloads a file and saves it to the given path. The download can be cancelled
+// using ctx. An existing (partial) file at target is resumed, if the server supports range requests
+func DownloadFileContext(ctx context.Context, url string, target string) error {
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	offset, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		log.Printf("Resuming download of %s at %s", path.Base(target), formatBytes(offset))
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// the partial file is already complete
+		return nil
+	case resp.StatusCode == http.StatusOK:
+		// server doesn't support range requests, start over
+		offset = 0
+		if err = out.Truncate(0); err != nil {
+			return err
+		}
+		if _, err = out.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	default:
+		return &HTTPStatusError{url, resp.StatusCode}
+	}
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+
+	progress := &progressWriter{name: path.Base(target), done: offset, total: total, last: time.Now()}
+	_, err = io.Copy(out, io.TeeReader(resp.Body, progress))
+
+	return err
+}
+
+// DownloadWithRetry downloads the file, retrying failed attempts with exponential backoff.
+// Client errors like 404 aren't retried
+func DownloadWithRetry(ctx context.Context, url string, target string) error {
+	return Retry(ctx, downloadRetries, func() error {
+		err := DownloadFileContext(ctx, url, target)
+		if statusErr, ok := err.(*HTTPStatusError); ok && statusErr.Code < 500 {
+			return Permanent(err)
+		}
+
+		return err
+	})
+}
+
+// permanentError marks errors, which must not be retried
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Permanent wraps the given error, so that Retry stops immediately
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// Retry calls fn up to the given amount of attempts, waiting 1s, 2s, 4s, ... in between
+func Retry(ctx context.Context, attempts int, fn func() error) error {
+	backoff := time.Second
+	var err error
+
+	for i := 0; i < attempts; i++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+
+		if permanent, ok := err.(permanentError); ok {
+			return permanent.err
+		}
+
+		if ctx.Err() != nil || i == attempts-1 {
+			break
+		}
+
+		log.Printf("Attempt %d of %d failed, retrying in %s: %s", i+1, attempts, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// progressWriter logs the download progress every 5 seconds
+type progressWriter struct {
+	name        string
+	done, total int64
+	last        time.Time
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+
+	if time.Since(p.last) >= 5*time.Second {
+		p.last = time.Now()
+		if p.total > 0 {
+			log.Printf("Downloading %s: %d%% (%s of %s)", p.name, p.done*100/p.total, formatBytes(p.done), formatBytes(p.total))
+		} else {
+			log.Printf("Downloading %s: %s", p.name, formatBytes(p.done))
+		}
+	}
+
+	return len(b), nil
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
@@ -0,0 +1,164 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ModulesConfName is the file below the NginX configuration directory, which holds the load_module directives
+const ModulesConfName = "modules.conf"
+
+const modulesConfHeader = `# Generated by SecNginX, included by nginx.conf.
+# Toggle modules via 'secnginx modules enable|disable <name>' instead of editing this file.
+`
+
+var (
+	shellAssignment = regexp.MustCompile(`^\s*(\w+)=(.*)$`)
+	moduleMarker    = regexp.MustCompile(`^# module (\S+)( \(disabled\))?$`)
+	loadModule      = regexp.MustCompile(`^(# )?load_module (.+);$`)
+)
+
+// DynamicModule groups the shared objects of a third party module, which is built via --add-dynamic-module
+type DynamicModule struct {
+	Name    string
+	Files   []string
+	Enabled bool
+}
+
+// ModulesConf is the parsed modules.conf
+type ModulesConf struct {
+	Modules []DynamicModule
+}
+
+// SharedObjects returns the file names of the shared objects, which have been built for the module.
+// They are derived from the ngx_module_name assignments of the module's config script
+func (m Module) SharedObjects(buildDir, objsDir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(m.Path(buildDir), "config"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// track plain variable assignments, as module names are often set via $ngx_addon_name
+	vars := map[string]string{}
+	files := []string{}
+	seen := map[string]bool{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		match := shellAssignment.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+
+		value := os.Expand(strings.Trim(strings.TrimSpace(match[2]), `"'`), func(name string) string { return vars[name] })
+		vars[match[1]] = value
+
+		if match[1] != "ngx_module_name" {
+			continue
+		}
+
+		// modules consisting of several NginX modules are named after the first one
+		names := strings.Fields(value)
+		if len(names) == 0 || seen[names[0]] {
+			continue
+		}
+		seen[names[0]] = true
+
+		if fileExists(filepath.Join(objsDir, names[0]+".so")) {
+			files = append(files, names[0]+".so")
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no shared objects of module %s found in %s", m.Name, objsDir)
+	}
+
+	return files, nil
+}
+
+// ReadModulesConf parses the modules.conf at the given path. A missing file results in an empty config
+func ReadModulesConf(path string) (*ModulesConf, error) {
+	conf := &ModulesConf{}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return conf, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var current *DynamicModule
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+
+		if match := moduleMarker.FindStringSubmatch(line); match != nil {
+			conf.Modules = append(conf.Modules, DynamicModule{Name: match[1], Enabled: match[2] == ""})
+			current = &conf.Modules[len(conf.Modules)-1]
+			continue
+		}
+
+		if match := loadModule.FindStringSubmatch(line); match != nil {
+			if current == nil {
+				return nil, fmt.Errorf("%s: load_module directive outside of a module section: %s", path, line)
+			}
+			current.Files = append(current.Files, match[2])
+		}
+	}
+
+	return conf, nil
+}
+
+// Write stores the config at the given path, the load_module directives of disabled modules are commented out
+func (c *ModulesConf) Write(path string) error {
+	var b strings.Builder
+	b.WriteString(modulesConfHeader)
+
+	for _, m := range c.Modules {
+		b.WriteString("\n# module " + m.Name)
+		prefix := ""
+		if !m.Enabled {
+			b.WriteString(" (disabled)")
+			prefix = "# "
+		}
+		b.WriteString("\n")
+
+		for _, file := range m.Files {
+			b.WriteString(prefix + "load_module " + file + ";\n")
+		}
+	}
+
+	return ioutil.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// Module returns the module with the given name
+func (c *ModulesConf) Module(name string) (*DynamicModule, bool) {
+	for i := range c.Modules {
+		if c.Modules[i].Name == name {
+			return &c.Modules[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// Update replaces the modules of the config by the given ones, modules which have been disabled before stay disabled
+func (c *ModulesConf) Update(modules []DynamicModule) {
+	for i, m := range modules {
+		if previous, ok := c.Module(m.Name); ok && !previous.Enabled {
+			modules[i].Enabled = false
+		}
+	}
+
+	c.Modules = modules
+}
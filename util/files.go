@@ -1,59 +1,187 @@
 package util
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mholt/archiver"
 )
 
-// DownloadFile downloads a file and saves it to the given path
-func DownloadFile(url string, target string) error {
+// CopyFile copies a file from the source to the provided destination
+func CopyFile(source, dest string) {
+	from, err := os.Open(source)
+	if err != nil {
+		log.Fatalf("Failed copying file %s to %s Error: %s", source, dest, err)
+	}
+	defer from.Close()
 
-	// Create the file
-	out, err := os.Create(target)
+	to, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
-		return err
+		log.Fatalf("Failed copying file %s to %s Error: %s", source, dest, err)
 	}
-	defer out.Close()
+	defer to.Close()
 
-	// Get the data
-	resp, err := http.Get(url)
+	_, err = io.Copy(to, from)
+	if err != nil {
+		log.Fatalf("Failed copying file %s to %s Error: %s", source, dest, err)
+	}
+}
+
+// archiveExtensions are the file extensions of all supported archive formats
+var archiveExtensions = []string{".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar.xz", ".txz", ".tar", ".zip"}
+
+// ExtractArchive extracts the given archive into dest. If the archive contains a single top level
+// directory (e.g. nginx-1.16.0/), its content is placed directly into dest
+func ExtractArchive(archive, dest string) error {
+	format := archiver.MatchingFormat(archive)
+	if format == nil {
+		return fmt.Errorf("unsupported archive format: %s", archive)
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Dir(dest), ".extract-")
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	defer os.RemoveAll(tmp)
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("NginX Download Server returned HTTP Status Code %d", resp.StatusCode)
+	if err = format.Open(archive, tmp); err != nil {
+		return err
 	}
 
-	// Write the body to file
-	_, err = io.Copy(out, resp.Body)
+	entries, err := ioutil.ReadDir(tmp)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if len(entries) == 1 && entries[0].IsDir() {
+		return os.Rename(filepath.Join(tmp, entries[0].Name()), dest)
+	}
+
+	return os.Rename(tmp, dest)
 }
 
-// CopyFile copies a file from the source to the provided destination
-func CopyFile(source, dest string) {
-	from, err := os.Open(source)
+// FileSHA256 returns the hex encoded SHA-256 digest of the given file
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		log.Fatalf("Failed copying file %s to %s Error: %s", source, dest, err)
+		return "", err
 	}
-	defer from.Close()
+	defer f.Close()
 
-	to, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE, 0666)
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// VerifySHA256 checks the given file against the expected hex encoded SHA-256 digest and returns the actual digest
+func VerifySHA256(path, expected string) (string, error) {
+	digest, err := FileSHA256(path)
 	if err != nil {
-		log.Fatalf("Failed copying file %s to %s Error: %s", source, dest, err)
+		return "", err
 	}
-	defer to.Close()
 
-	_, err = io.Copy(to, from)
+	if !strings.EqualFold(digest, expected) {
+		return digest, fmt.Errorf("SHA-256 mismatch for %s: expected %s, got %s", filepath.Base(path), expected, digest)
+	}
+
+	return digest, nil
+}
+
+// FetchSHA256 downloads a published checksum file (e.g. openssl-1.1.1c.tar.gz.sha256) and returns the contained digest
+func FetchSHA256(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		log.Fatalf("Failed copying file %s to %s Error: %s", source, dest, err)
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("checksum server returned HTTP Status Code %d for %s", resp.StatusCode, url)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
 	}
+
+	// checksum files contain either the plain digest or "<digest>  <filename>"
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 || !IsSHA256(fields[0]) {
+		return "", fmt.Errorf("no SHA-256 digest found in %s", url)
+	}
+
+	return strings.ToLower(fields[0]), nil
+}
+
+// IsSHA256 checks whether the given string is a hex encoded SHA-256 digest
+func IsSHA256(digest string) bool {
+	decoded, err := hex.DecodeString(digest)
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// MergeTree copies the files, directories and symlinks below src into dst. Existing files are never
+// overwritten, like 'make install' keeps existing configuration files
+func MergeTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+
+		if _, err = os.Lstat(target); err == nil {
+			return nil
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+
+		from, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer from.Close()
+
+		to, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+
+		if _, err = io.Copy(to, from); err != nil {
+			to.Close()
+			return err
+		}
+
+		return to.Close()
+	})
 }
@@ -0,0 +1,336 @@
+package util
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Hardening holds the [hardening] table: the compiler and linker hardening flags NginX is built with.
+// Every enabled property is verified on the built binary
+type Hardening struct {
+	// PIE builds a position independent executable, required for full ASLR
+	PIE bool `mapstructure:"pie" json:"pie"`
+	// RELRO is either full, partial or none
+	RELRO          string `mapstructure:"relro" json:"relro"`
+	StackProtector bool   `mapstructure:"stack_protector" json:"stack_protector"`
+	FortifySource  bool   `mapstructure:"fortify_source" json:"fortify_source"`
+	// CET enables Intel's control-flow enforcement technology (IBT and shadow stacks), x86 only
+	CET bool `mapstructure:"cet" json:"cet"`
+	// NX marks the stack as not executable
+	NX bool `mapstructure:"nx" json:"nx"`
+}
+
+// String returns a summary of the enabled properties
+func (h Hardening) String() string {
+	properties := []string{}
+	if h.PIE {
+		properties = append(properties, "PIE")
+	}
+	if h.RELRO != "none" {
+		properties = append(properties, h.RELRO+" RELRO")
+	}
+	if h.StackProtector {
+		properties = append(properties, "stack protector")
+	}
+	if h.FortifySource {
+		properties = append(properties, "FORTIFY_SOURCE")
+	}
+	if h.CET {
+		properties = append(properties, "CET")
+	}
+	if h.NX {
+		properties = append(properties, "NX")
+	}
+
+	if len(properties) == 0 {
+		return "disabled"
+	}
+
+	return strings.Join(properties, ", ")
+}
+
+// ELFSecurity holds the security properties of an ELF binary, as reported by checksec
+type ELFSecurity struct {
+	PIE     bool
+	RELRO   string
+	Canary  bool
+	Fortify bool
+	CET     bool
+	NX      bool
+}
+
+const (
+	// ntGNUPropertyType0 is the type of the .note.gnu.property note
+	ntGNUPropertyType0 = 5
+	// gnuPropertyX86Feature1And holds the x86 features all objects of the binary have been compiled with
+	gnuPropertyX86Feature1And = 0xc0000002
+	x86FeatureIBT             = 1
+	x86FeatureSHSTK           = 2
+)
+
+// Validate checks the hardening settings
+func (h Hardening) Validate() error {
+	if h.RELRO != "full" && h.RELRO != "partial" && h.RELRO != "none" {
+		return fmt.Errorf("invalid relro %s in [hardening] table, supported are: full, partial, none", h.RELRO)
+	}
+
+	return nil
+}
+
+// CCOptions returns the compiler flags of the enabled properties
+func (h Hardening) CCOptions() []string {
+	opts := []string{}
+
+	if h.PIE {
+		opts = append(opts, "-fPIE")
+	}
+	if h.StackProtector {
+		opts = append(opts, "-fstack-protector-strong")
+	}
+	if h.FortifySource {
+		// FORTIFY_SOURCE requires optimization, some compilers predefine it
+		opts = append(opts, "-O2", "-U_FORTIFY_SOURCE", "-D_FORTIFY_SOURCE=2")
+	}
+	if h.CET {
+		opts = append(opts, "-fcf-protection=full")
+	}
+
+	return opts
+}
+
+// LDOptions returns the linker flags of the enabled properties
+func (h Hardening) LDOptions() []string {
+	opts := []string{}
+
+	if h.PIE {
+		opts = append(opts, "-pie")
+	}
+	switch h.RELRO {
+	case "full":
+		opts = append(opts, "-Wl,-z,relro", "-Wl,-z,now")
+	case "partial":
+		opts = append(opts, "-Wl,-z,relro")
+	}
+	if h.NX {
+		opts = append(opts, "-Wl,-z,noexecstack")
+	}
+
+	return opts
+}
+
+// LibraryOptions returns the compiler flags of the libraries statically linked into NginX (PCRE, ZLib and OpenSSL).
+// They replace the default flags of the libraries, so the optimization level is kept
+func (h Hardening) LibraryOptions() []string {
+	if h.PIE {
+		return []string{"-O2", "-fPIC"}
+	}
+
+	return []string{}
+}
+
+// Verify checks the binary at the given path for all enabled properties
+func (h Hardening) Verify(path string) (*ELFSecurity, error) {
+	security, err := CheckELF(path)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := []string{}
+	if h.PIE && !security.PIE {
+		missing = append(missing, "PIE")
+	}
+	if h.RELRO == "full" && security.RELRO != "full" || h.RELRO == "partial" && security.RELRO == "none" {
+		missing = append(missing, h.RELRO+" RELRO")
+	}
+	if h.StackProtector && !security.Canary {
+		missing = append(missing, "stack protector")
+	}
+	if h.FortifySource && !security.Fortify {
+		missing = append(missing, "FORTIFY_SOURCE")
+	}
+	if h.CET && !security.CET {
+		missing = append(missing, "CET")
+	}
+	if h.NX && !security.NX {
+		missing = append(missing, "NX")
+	}
+
+	if len(missing) > 0 {
+		return security, fmt.Errorf("%s lacks %s (%s)", path, strings.Join(missing, ", "), security)
+	}
+
+	return security, nil
+}
+
+// CheckELF determines the security properties of the ELF binary at the given path
+func CheckELF(path string) (*ELFSecurity, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	security := &ELFSecurity{RELRO: "none"}
+	interpreter := false
+
+	for _, p := range f.Progs {
+		switch p.Type {
+		case elf.PT_INTERP:
+			interpreter = true
+		case elf.PT_GNU_RELRO:
+			security.RELRO = "partial"
+		case elf.PT_GNU_STACK:
+			security.NX = p.Flags&elf.PF_X == 0
+		}
+	}
+
+	// shared objects are position independent as well, but lack an interpreter
+	security.PIE = f.Type == elf.ET_DYN && interpreter
+
+	tags, err := dynamicTags(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if security.RELRO == "partial" && (tags[elf.DT_BIND_NOW] != 0 || tags[elf.DT_FLAGS]&uint64(elf.DF_BIND_NOW) != 0 ||
+		tags[elf.DT_FLAGS_1]&uint64(elf.DF_1_NOW) != 0) {
+		security.RELRO = "full"
+	}
+
+	symbols, err := f.DynamicSymbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, err
+	}
+
+	for _, s := range symbols {
+		if s.Name == "__stack_chk_fail" {
+			security.Canary = true
+		}
+		if strings.HasPrefix(s.Name, "__") && strings.HasSuffix(s.Name, "_chk") && s.Name != "__stack_chk_fail" {
+			security.Fortify = true
+		}
+	}
+
+	security.CET, err = hasCET(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return security, nil
+}
+
+// String returns a checksec like summary of the properties
+func (s *ELFSecurity) String() string {
+	flag := func(name string, enabled bool) string {
+		if enabled {
+			return name + ": yes"
+		}
+		return name + ": no"
+	}
+
+	return strings.Join([]string{flag("PIE", s.PIE), "RELRO: " + s.RELRO, flag("Canary", s.Canary),
+		flag("FORTIFY", s.Fortify), flag("CET", s.CET), flag("NX", s.NX)}, ", ")
+}
+
+// dynamicTags returns the value of DT_FLAGS and DT_FLAGS_1 and marks all other present tags with 1
+func dynamicTags(f *elf.File) (map[elf.DynTag]uint64, error) {
+	tags := map[elf.DynTag]uint64{}
+
+	section := f.Section(".dynamic")
+	if section == nil {
+		return tags, nil
+	}
+
+	data, err := section.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	size := 16
+	if f.Class == elf.ELFCLASS32 {
+		size = 8
+	}
+
+	for i := 0; i+size <= len(data); i += size {
+		var tag elf.DynTag
+		var value uint64
+
+		if f.Class == elf.ELFCLASS32 {
+			tag = elf.DynTag(int32(f.ByteOrder.Uint32(data[i:])))
+			value = uint64(f.ByteOrder.Uint32(data[i+4:]))
+		} else {
+			tag = elf.DynTag(int64(f.ByteOrder.Uint64(data[i:])))
+			value = f.ByteOrder.Uint64(data[i+8:])
+		}
+
+		if tag == elf.DT_NULL {
+			break
+		}
+
+		if tag == elf.DT_FLAGS || tag == elf.DT_FLAGS_1 {
+			tags[tag] = value
+		} else {
+			tags[tag] = 1
+		}
+	}
+
+	return tags, nil
+}
+
+// hasCET checks the x86 feature property of the .note.gnu.property section for IBT and shadow stack support
+func hasCET(f *elf.File) (bool, error) {
+	section := f.Section(".note.gnu.property")
+	if section == nil {
+		return false, nil
+	}
+
+	data, err := section.Data()
+	if err != nil {
+		return false, err
+	}
+
+	align := 8
+	if f.Class == elf.ELFCLASS32 {
+		align = 4
+	}
+	pad := func(n int) int { return (n + align - 1) &^ (align - 1) }
+
+	r := bytes.NewReader(data)
+	for r.Len() >= 12 {
+		var header struct{ NameSize, DescSize, Type uint32 }
+		if err = binary.Read(r, f.ByteOrder, &header); err != nil {
+			return false, nil
+		}
+
+		// names are padded to 4 bytes only
+		name := make([]byte, (header.NameSize+3)&^3)
+		desc := make([]byte, pad(int(header.DescSize)))
+		if _, err = r.Read(name); err != nil {
+			return false, nil
+		}
+		if _, err = r.Read(desc); err != nil {
+			return false, nil
+		}
+
+		if header.Type != ntGNUPropertyType0 || !bytes.HasPrefix(name, []byte("GNU\x00")) {
+			continue
+		}
+
+		// properties: pr_type, pr_datasz, data padded to the alignment
+		desc = desc[:header.DescSize]
+		for i := 0; i+8 <= len(desc); {
+			propType := f.ByteOrder.Uint32(desc[i:])
+			size := int(f.ByteOrder.Uint32(desc[i+4:]))
+			if propType == gnuPropertyX86Feature1And && size >= 4 && i+12 <= len(desc) {
+				features := f.ByteOrder.Uint32(desc[i+8:])
+				return features&x86FeatureIBT != 0 && features&x86FeatureSHSTK != 0, nil
+			}
+			i += 8 + pad(size)
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,114 @@
+package util
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// testProgram needs a stack canary (local buffer) and fortified functions (strcpy, printf)
+const testProgram = `#include <stdio.h>
+#include <string.h>
+
+int main(int argc, char **argv) {
+	char buf[32];
+	strcpy(buf, argc > 1 ? argv[1] : "nginx");
+	printf("%s\n", buf);
+	return 0;
+}
+`
+
+// compile builds the source with gcc and the given flags and returns the path of the output
+func compile(t *testing.T, source string, flags ...string) string {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc isn't installed")
+	}
+
+	dir := t.TempDir()
+	src, out := filepath.Join(dir, "test.c"), filepath.Join(dir, "test")
+	if err := ioutil.WriteFile(src, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	args := append(append([]string{}, flags...), "-o", out, src)
+	if output, err := exec.Command("gcc", args...).CombinedOutput(); err != nil {
+		t.Fatalf("gcc %s failed: %s %s", strings.Join(args, " "), err, output)
+	}
+
+	return out
+}
+
+func TestCheckELF(t *testing.T) {
+	hardened := compile(t, testProgram, "-fPIE", "-pie", "-fstack-protector-strong", "-U_FORTIFY_SOURCE",
+		"-D_FORTIFY_SOURCE=2", "-O2", "-Wl,-z,relro,-z,now", "-Wl,-z,noexecstack")
+	weak := compile(t, testProgram, "-no-pie", "-fno-stack-protector", "-U_FORTIFY_SOURCE", "-O2", "-Wl,-z,norelro",
+		"-Wl,-z,noexecstack")
+
+	tests := []struct {
+		name   string
+		binary string
+		want   ELFSecurity
+	}{
+		{"hardened", hardened, ELFSecurity{PIE: true, RELRO: "full", Canary: true, Fortify: true, NX: true}},
+		{"weak", weak, ELFSecurity{PIE: false, RELRO: "none", Canary: false, Fortify: false, NX: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			security, err := CheckELF(tt.binary)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// CET depends on the start files of the toolchain, it's tested separately
+			security.CET = false
+			if *security != tt.want {
+				t.Fatalf("CheckELF() = %s, want %s", security, &tt.want)
+			}
+		})
+	}
+
+	all := Hardening{PIE: true, RELRO: "full", StackProtector: true, FortifySource: true, NX: true}
+	if _, err := all.Verify(hardened); err != nil {
+		t.Fatalf("Verify() of the hardened binary failed: %s", err)
+	}
+
+	_, err := all.Verify(weak)
+	if err == nil {
+		t.Fatal("Verify() of the weak binary succeeded")
+	}
+	if !strings.Contains(err.Error(), " lacks PIE, full RELRO, stack protector, FORTIFY_SOURCE (") {
+		t.Fatalf("Verify() error %q doesn't report exactly the missing properties", err)
+	}
+
+	partial := compile(t, testProgram, "-no-pie", "-Wl,-z,relro,-z,lazy")
+	if security, err := CheckELF(partial); err != nil || security.RELRO != "partial" {
+		t.Fatalf("CheckELF() of a lazily bound binary = %v, %v, want partial RELRO", security, err)
+	}
+
+	execstack := compile(t, testProgram, "-Wl,-z,execstack")
+	if security, err := CheckELF(execstack); err != nil || security.NX {
+		t.Fatalf("CheckELF() of a binary with executable stack = %v, %v, want no NX", security, err)
+	}
+}
+
+func TestCheckELFCET(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("CET is only available on x86")
+	}
+
+	// the start files of most toolchains lack the CET property, which would clear it for the whole binary
+	const object = "int nginx(int x) { return x * 2; }\n"
+	cet := compile(t, object, "-shared", "-fPIC", "-nostdlib", "-fcf-protection=full")
+	noCET := compile(t, object, "-shared", "-fPIC", "-nostdlib", "-fcf-protection=none")
+
+	if security, err := CheckELF(cet); err != nil || !security.CET {
+		t.Fatalf("CheckELF() with -fcf-protection=full = %v, %v, want CET", security, err)
+	}
+	if security, err := CheckELF(noCET); err != nil || security.CET {
+		t.Fatalf("CheckELF() with -fcf-protection=none = %v, %v, want no CET", security, err)
+	}
+}
@@ -0,0 +1,220 @@
+package util
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// oldBinarySuffix is appended to the pid file of the old master by NginX during a binary upgrade
+const oldBinarySuffix = ".oldbin"
+
+// LiveUpgrade replaces the running NginX master by the installed binary without dropping connections, using the
+// USR2, WINCH and QUIT signal sequence described in https://nginx.org/en/docs/control.html#upgrade
+type LiveUpgrade struct {
+	// PidPath is the --pid-path of NginX
+	PidPath string
+	// Timeout limits waiting for the new master, the health check and the exit of a master
+	Timeout time.Duration
+	// HealthCheck is called repeatedly once the old workers are shut down, until it succeeds or Timeout elapses
+	HealthCheck func() error
+}
+
+// ErrNginXNotRunning is returned if there is no NginX master to upgrade
+var ErrNginXNotRunning = errors.New("NginX isn't running")
+
+// Check verifies that a master is running and no other binary upgrade is in progress. It returns the pid of
+// the master
+func (u *LiveUpgrade) Check() (int, error) {
+	pid, err := readPid(u.PidPath)
+	if os.IsNotExist(err) {
+		return 0, ErrNginXNotRunning
+	}
+	if err != nil {
+		return 0, fmt.Errorf("can't determine the running NginX master: %s", err)
+	}
+
+	if !processAlive(pid) {
+		return 0, ErrNginXNotRunning
+	}
+
+	if fileExists(u.PidPath + oldBinarySuffix) {
+		return 0, fmt.Errorf("%s exists, another binary upgrade is in progress", u.PidPath+oldBinarySuffix)
+	}
+
+	return pid, nil
+}
+
+// Run performs the upgrade. If the new master doesn't come up or isn't healthy, the old master is restored
+// and an error is returned
+func (u *LiveUpgrade) Run() error {
+	oldPid, err := u.Check()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Sending USR2 to the NginX master (pid %d) to start the new binary", oldPid)
+	if err = syscall.Kill(oldPid, syscall.SIGUSR2); err != nil {
+		return err
+	}
+
+	newPid, err := u.waitForNewMaster(oldPid)
+	if err != nil {
+		return fmt.Errorf("the new NginX master didn't start, the old master keeps serving: %s", err)
+	}
+
+	log.Printf("New NginX master is running (pid %d), sending WINCH to shut down the old workers", newPid)
+	if err = syscall.Kill(oldPid, syscall.SIGWINCH); err != nil {
+		return err
+	}
+
+	if err = u.waitHealthy(newPid); err != nil {
+		log.Printf("Health check of the new binary failed: %s", err)
+		if revertErr := u.revert(oldPid, newPid); revertErr != nil {
+			return fmt.Errorf("health check failed (%s) and reverting failed: %s", err, revertErr)
+		}
+
+		return fmt.Errorf("health check of the new binary failed, the old master has been restored: %s", err)
+	}
+
+	log.Printf("Health check passed, sending QUIT to the old master (pid %d)", oldPid)
+	if err = syscall.Kill(oldPid, syscall.SIGQUIT); err != nil {
+		return err
+	}
+
+	return u.waitForExit(oldPid)
+}
+
+// waitForNewMaster waits until the old master renamed its pid file to nginx.pid.oldbin and the new master wrote
+// its pid into nginx.pid
+func (u *LiveUpgrade) waitForNewMaster(oldPid int) (int, error) {
+	deadline := time.Now().Add(u.Timeout)
+
+	for time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+
+		if pid, err := readPid(u.PidPath + oldBinarySuffix); err != nil || pid != oldPid {
+			continue
+		}
+
+		if pid, err := readPid(u.PidPath); err == nil && pid != oldPid && processAlive(pid) {
+			return pid, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no new master after %s, check the NginX error log", u.Timeout)
+}
+
+// waitHealthy runs the health check until it succeeds, as long as the new master is alive
+func (u *LiveUpgrade) waitHealthy(newPid int) error {
+	deadline := time.Now().Add(u.Timeout)
+	err := fmt.Errorf("no health check run within %s", u.Timeout)
+
+	for time.Now().Before(deadline) {
+		if !processAlive(newPid) {
+			return fmt.Errorf("the new NginX master (pid %d) exited", newPid)
+		}
+
+		if err = u.HealthCheck(); err == nil {
+			return nil
+		}
+
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	return err
+}
+
+// revert restarts the workers of the old master without re-reading the configuration and shuts down the new master.
+// The old master restores the pid file afterwards
+func (u *LiveUpgrade) revert(oldPid, newPid int) error {
+	log.Printf("Sending HUP to the old master (pid %d) and QUIT to the new master (pid %d)", oldPid, newPid)
+
+	if err := syscall.Kill(oldPid, syscall.SIGHUP); err != nil {
+		return err
+	}
+
+	if err := syscall.Kill(newPid, syscall.SIGQUIT); err != nil {
+		return err
+	}
+
+	return u.waitForExit(newPid)
+}
+
+// waitForExit waits until the process exited
+func (u *LiveUpgrade) waitForExit(pid int) error {
+	deadline := time.Now().Add(u.Timeout)
+
+	for time.Now().Before(deadline) {
+		if !processAlive(pid) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return fmt.Errorf("NginX master %d didn't exit within %s", pid, u.Timeout)
+}
+
+// HTTPHealthCheck returns a health check, which requires the URL to answer with a status code below 500.
+// Redirects aren't followed and certificates aren't verified, as only the new workers are checked
+func HTTPHealthCheck(url string) func() error {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			// every check has to reach a new worker instead of reusing a connection to an old one
+			DisableKeepAlives: true,
+		},
+	}
+
+	return func() error {
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("%s returned HTTP Status Code %d", url, resp.StatusCode)
+		}
+
+		return nil
+	}
+}
+
+// ProcessBinary returns the path of the executable a process runs, also if it has been removed since
+func ProcessBinary(pid int) (string, error) {
+	binary, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(binary, " (deleted)"), nil
+}
+
+// readPid reads the pid file of an NginX master
+func readPid(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// processAlive checks whether the process exists, processes of other users are reported as alive as well
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
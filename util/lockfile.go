@@ -0,0 +1,177 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// LockfileName is the name of the lockfile, written next to config.toml after each build
+const LockfileName = "secnginx.lock"
+
+// LockedSource holds the resolved origin of a single downloaded source
+type LockedSource struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	URL     string `json:"url"`
+	Ref     string `json:"ref,omitempty"`
+	Commit  string `json:"commit,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+	// SignedBy is the fingerprint of the PGP key, which signed the source
+	SignedBy string `json:"signed_by,omitempty"`
+}
+
+// Lockfile records all resolved sources, applied patches and the final configure arguments of a build
+type Lockfile struct {
+	Sources            []LockedSource `json:"sources"`
+	Patches            []AppliedPatch `json:"patches"`
+	ConfigureArguments []string       `json:"configure_arguments"`
+
+	mutex sync.Mutex
+}
+
+// ReadLockfile parses the lockfile at the given path
+func ReadLockfile(path string) (*Lockfile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &Lockfile{}
+	if err = json.Unmarshal(data, lock); err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %s", path, err)
+	}
+
+	return lock, nil
+}
+
+// Write stores the lockfile at the given path, sources are sorted by name
+func (l *Lockfile) Write(path string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	sort.Slice(l.Sources, func(i, j int) bool { return l.Sources[i].Name < l.Sources[j].Name })
+
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// AddSource records a resolved source, it is safe to be called from multiple goroutines
+func (l *Lockfile) AddSource(source LockedSource) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.Sources = append(l.Sources, source)
+}
+
+// Source returns the locked source with the given name
+func (l *Lockfile) Source(name string) (LockedSource, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, s := range l.Sources {
+		if s.Name == name {
+			return s, true
+		}
+	}
+
+	return LockedSource{}, false
+}
+
+// VerifySources checks whether the given resolved sources match the locked ones
+func (l *Lockfile) VerifySources(resolved *Lockfile) error {
+	deviations := []string{}
+
+	for _, want := range l.Sources {
+		got, ok := resolved.Source(want.Name)
+		if !ok {
+			deviations = append(deviations, fmt.Sprintf("%s: locked, but not part of this build", want.Name))
+			continue
+		}
+
+		if got != want {
+			deviations = append(deviations, fmt.Sprintf("%s: locked %s, got %s", want.Name, want, got))
+		}
+	}
+
+	for _, got := range resolved.Sources {
+		if _, ok := l.Source(got.Name); !ok {
+			deviations = append(deviations, fmt.Sprintf("%s: not part of the lockfile", got.Name))
+		}
+	}
+
+	if len(deviations) > 0 {
+		return fmt.Errorf("sources deviate from %s:\n  %s", LockfileName, strings.Join(deviations, "\n  "))
+	}
+
+	return nil
+}
+
+// VerifyConfigureArguments checks whether the configure arguments match the locked ones
+func (l *Lockfile) VerifyConfigureArguments(resolved *Lockfile) error {
+	// compared element by element, arguments may contain spaces
+	equal := len(l.ConfigureArguments) == len(resolved.ConfigureArguments)
+	for i := 0; equal && i < len(l.ConfigureArguments); i++ {
+		equal = l.ConfigureArguments[i] == resolved.ConfigureArguments[i]
+	}
+
+	if !equal {
+		return fmt.Errorf("configure arguments deviate from %s:\n  locked: %s\n  got:    %s", LockfileName,
+			strings.Join(l.ConfigureArguments, " "), strings.Join(resolved.ConfigureArguments, " "))
+	}
+
+	return nil
+}
+
+// VerifyPatches checks whether the given applied patches match the locked ones, including their order
+func (l *Lockfile) VerifyPatches(resolved *Lockfile) error {
+	describe := func(patches []AppliedPatch) string {
+		parts := []string{}
+		for _, p := range patches {
+			parts = append(parts, fmt.Sprintf("%s (%s, sha256 %s)", p.Name, p.Component, p.SHA256))
+		}
+		return strings.Join(parts, ", ")
+	}
+
+	equal := len(l.Patches) == len(resolved.Patches)
+	for i := 0; equal && i < len(l.Patches); i++ {
+		want, got := l.Patches[i], resolved.Patches[i]
+		equal = want.Name == got.Name && want.Component == got.Component && want.SHA256 == got.SHA256
+	}
+
+	if !equal {
+		return fmt.Errorf("patches deviate from %s:\n  locked: %s\n  got:    %s", LockfileName, describe(l.Patches), describe(resolved.Patches))
+	}
+
+	return nil
+}
+
+// String returns a short description of the locked source
+func (s LockedSource) String() string {
+	parts := []string{}
+
+	if s.Version != "" {
+		parts = append(parts, "version "+s.Version)
+	}
+	if s.Ref != "" {
+		parts = append(parts, "ref "+s.Ref)
+	}
+	if s.Commit != "" {
+		parts = append(parts, "commit "+s.Commit)
+	}
+	if s.SHA256 != "" {
+		parts = append(parts, "sha256 "+s.SHA256)
+	}
+	if s.SignedBy != "" {
+		parts = append(parts, "signed by "+s.SignedBy)
+	}
+
+	return fmt.Sprintf("%s (%s)", s.URL, strings.Join(parts, ", "))
+}
@@ -0,0 +1,54 @@
+package util
+
+import "testing"
+
+func TestVerifyConfigureArguments(t *testing.T) {
+	tests := []struct {
+		name          string
+		locked, got   []string
+		wantDeviation bool
+	}{
+		{"equal", []string{"--with-http_ssl_module", "--with-cc-opt=-O2 -fPIE"}, []string{"--with-http_ssl_module", "--with-cc-opt=-O2 -fPIE"}, false},
+		{"none", nil, []string{}, false},
+		{"split differently", []string{"--with-cc-opt=-O2 -fPIE"}, []string{"--with-cc-opt=-O2", "-fPIE"}, true},
+		{"reordered", []string{"--a", "--b"}, []string{"--b", "--a"}, true},
+		{"missing", []string{"--a", "--b"}, []string{"--a"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			locked, resolved := &Lockfile{ConfigureArguments: tt.locked}, &Lockfile{ConfigureArguments: tt.got}
+			if err := locked.VerifyConfigureArguments(resolved); (err != nil) != tt.wantDeviation {
+				t.Fatalf("VerifyConfigureArguments() error = %v, wantDeviation %v", err, tt.wantDeviation)
+			}
+		})
+	}
+}
+
+func TestVerifyPatches(t *testing.T) {
+	a := AppliedPatch{Name: "a", Component: "nginx", SHA256: "aa"}
+	b := AppliedPatch{Name: "b", Component: "openssl", SHA256: "bb"}
+	// describes itself like a and b joined in a single patch
+	ab := AppliedPatch{Name: "a (nginx, sha256 aa), b", Component: "openssl", SHA256: "bb"}
+
+	tests := []struct {
+		name          string
+		locked, got   []AppliedPatch
+		wantDeviation bool
+	}{
+		{"equal", []AppliedPatch{a, b}, []AppliedPatch{a, b}, false},
+		{"reordered", []AppliedPatch{a, b}, []AppliedPatch{b, a}, true},
+		{"changed digest", []AppliedPatch{a}, []AppliedPatch{{Name: "a", Component: "nginx", SHA256: "ff"}}, true},
+		{"same description", []AppliedPatch{a, b}, []AppliedPatch{ab}, true},
+		{"missing", []AppliedPatch{a, b}, []AppliedPatch{a}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			locked, resolved := &Lockfile{Patches: tt.locked}, &Lockfile{Patches: tt.got}
+			if err := locked.VerifyPatches(resolved); (err != nil) != tt.wantDeviation {
+				t.Fatalf("VerifyPatches() error = %v, wantDeviation %v", err, tt.wantDeviation)
+			}
+		})
+	}
+}
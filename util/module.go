@@ -0,0 +1,106 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+)
+
+var moduleName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Module describes a third party NginX module, declared as [[module]] table in the toml config
+type Module struct {
+	Name       string `mapstructure:"name" json:"name"`
+	Git        string `mapstructure:"git" json:"git,omitempty"`
+	Tarball    string `mapstructure:"tarball" json:"tarball,omitempty"`
+	Ref        string `mapstructure:"ref" json:"ref,omitempty"`
+	SHA256     string `mapstructure:"sha256" json:"sha256,omitempty"`
+	Dynamic    bool   `mapstructure:"dynamic" json:"dynamic"`
+	Submodules bool   `mapstructure:"submodules" json:"submodules"`
+}
+
+// Validate checks whether the module declaration is complete
+func (m Module) Validate() error {
+	if m.Name == "" {
+		return errors.New("module without name found")
+	}
+
+	// the name is used as directory below the build directory
+	if !moduleName.MatchString(m.Name) || m.Name == "." || m.Name == ".." {
+		return fmt.Errorf("invalid module name %q, only letters, digits, '.', '_' and '-' are allowed", m.Name)
+	}
+
+	if m.Git == "" && m.Tarball == "" {
+		return fmt.Errorf("module %s needs either a git or a tarball URL", m.Name)
+	}
+
+	if m.Git != "" && m.Tarball != "" {
+		return fmt.Errorf("module %s can't have both a git and a tarball URL", m.Name)
+	}
+
+	if m.Tarball != "" && (m.Ref != "" || m.Submodules) {
+		return fmt.Errorf("module %s: ref and submodules are only supported for git modules", m.Name)
+	}
+
+	if m.Tarball != "" && !IsSHA256(m.SHA256) {
+		return fmt.Errorf("module %s needs a valid sha256 checksum of its tarball", m.Name)
+	}
+
+	if m.Git != "" && m.SHA256 != "" {
+		return fmt.Errorf("module %s: sha256 is only supported for tarball modules, pin git modules via ref", m.Name)
+	}
+
+	if m.Git != "" && m.Ref == "" {
+		return fmt.Errorf("module %s isn't pinned, please set ref to a tag or commit", m.Name)
+	}
+
+	if m.Git != "" && isBranchRef(m.Ref) {
+		return fmt.Errorf("module %s: ref %s is a branch, please pin a tag or the full commit hash", m.Name, m.Ref)
+	}
+
+	return nil
+}
+
+// Path returns the directory the module source is placed in, relative to the given build directory
+func (m Module) Path(buildDir string) string {
+	return filepath.Join(buildDir, "modules", m.Name)
+}
+
+// ConfigureFlag returns the NginX configure flag, which adds the module located in the given build directory
+func (m Module) ConfigureFlag(buildDir string) string {
+	if m.Dynamic {
+		return "--add-dynamic-module=" + m.Path(buildDir)
+	}
+
+	return "--add-module=" + m.Path(buildDir)
+}
+
+// Fetch loads the module source from the cache (or downloads it) into its directory below the given build directory.
+// If commit is set, it is checked out instead of the configured ref
+func (m Module) Fetch(ctx context.Context, buildDir, commit string, cache *Cache) (LockedSource, error) {
+	dir := m.Path(buildDir)
+
+	if m.Tarball != "" {
+		source := LockedSource{Name: m.Name, URL: m.Tarball, SHA256: m.SHA256}
+
+		archive, err := cache.Archive(ctx, m.Name, "tarball", m.SHA256, path.Base(m.Tarball), []string{m.Tarball})
+		if err != nil {
+			return source, err
+		}
+
+		return source, ExtractArchive(archive, dir)
+	}
+
+	source := LockedSource{Name: m.Name, URL: m.Git, Ref: m.Ref}
+	if commit == "" {
+		commit = m.Ref
+	}
+
+	var err error
+	source.Commit, err = cache.GitCheckout(ctx, m.Name, m.Git, commit, dir, m.Submodules)
+
+	return source, err
+}
@@ -0,0 +1,53 @@
+package util
+
+import "testing"
+
+func TestModuleValidateRef(t *testing.T) {
+	tests := []struct {
+		ref     string
+		wantErr bool
+	}{
+		{"v1.0.0", false},
+		{"0123456789abcdef0123456789abcdef01234567", false},
+		{"master", true},
+		{"main", true},
+		{"refs/heads/release", true},
+		{"origin/develop", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			m := Module{Name: "ngx_test", Git: "https://example.org/ngx_test.git", Ref: tt.ref}
+			if err := m.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestModuleValidateName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"ngx_brotli", false},
+		{"headers-more-nginx-module", false},
+		{"naxsi.1", false},
+		{"", true},
+		{".", true},
+		{"..", true},
+		{"../../etc", true},
+		{"modules/ngx_brotli", true},
+		{"/tmp", true},
+		{"ngx brotli", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := Module{Name: tt.name, Git: "https://example.org/ngx_test.git", Ref: "v1.0.0"}
+			if err := m.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// PackageName is the name of the native packages built by 'secnginx package'
+const PackageName = "secnginx"
+
+// PackageFormats are the supported native package formats
+var PackageFormats = []string{"deb", "rpm", "apk"}
+
+// SystemdUnitPath is the location of the systemd unit inside the packages
+const SystemdUnitPath = "/usr/lib/systemd/system/nginx.service"
+
+// systemDirectories are shared with the base system and thus not owned by the packages
+var systemDirectories = map[string]bool{
+	"/": true, "/etc": true, "/usr": true, "/usr/bin": true, "/usr/sbin": true, "/usr/lib": true, "/usr/lib64": true,
+	"/usr/lib/systemd": true, "/usr/lib/systemd/system": true, "/usr/share": true, "/usr/local": true, "/var": true,
+	"/var/log": true, "/var/cache": true, "/var/lib": true, "/var/run": true, "/var/www": true, "/run": true,
+}
+
+// Package is a native package built from a staging directory, which NginX has been installed into via DESTDIR
+type Package struct {
+	Name        string
+	Version     string
+	Release     int
+	Maintainer  string
+	Summary     string
+	Description string
+	URL         string
+	License     string
+	BuildTime   time.Time
+	// Root is the staging directory
+	Root  string
+	Files []PackageFile
+	// PreInstall, PostInstall and PostRemove are POSIX shell scripts
+	PreInstall, PostInstall, PostRemove string
+}
+
+// PackageFile is a file, directory or symlink of a package
+type PackageFile struct {
+	// Path is the absolute path on the target system, e.g. /usr/sbin/nginx
+	Path    string
+	Mode    os.FileMode
+	Size    int64
+	ModTime time.Time
+	// LinkTarget is the target of symlinks
+	LinkTarget string
+	// Conffile marks files, which must not be overwritten on upgrades once changed by the administrator
+	Conffile bool
+}
+
+// NewPackage collects the content of the staging directory. All files below /etc are treated as conffiles
+func NewPackage(root, version string, release int, maintainer string) (*Package, error) {
+	p := &Package{
+		Name:        PackageName,
+		Version:     version,
+		Release:     release,
+		Maintainer:  maintainer,
+		Summary:     "Secure and minimal NginX webserver",
+		Description: "NginX built from source by secnginx with hardened compiler flags, a statically linked TLS library and a secure default configuration.",
+		URL:         "https://github.com/phenomax/secnginx",
+		License:     "BSD-2-Clause",
+		BuildTime:   time.Now(),
+		Root:        root,
+		PreInstall:  preInstallScript(),
+		PostInstall: postInstallScript(),
+		PostRemove:  postRemoveScript(),
+	}
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		file := PackageFile{Path: "/" + filepath.ToSlash(rel), Mode: info.Mode(), ModTime: info.ModTime()}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if file.LinkTarget, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			file.Size = info.Size()
+			file.Conffile = strings.HasPrefix(file.Path, "/etc/")
+		case !info.IsDir():
+			return fmt.Errorf("unsupported file type of %s", path)
+		}
+
+		p.Files = append(p.Files, file)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Source returns the path of the file inside the staging directory
+func (p *Package) Source(f PackageFile) string {
+	return filepath.Join(p.Root, filepath.FromSlash(f.Path))
+}
+
+// InstalledSize returns the sum of the size of all regular files
+func (p *Package) InstalledSize() int64 {
+	var size int64
+	for _, f := range p.Files {
+		size += f.Size
+	}
+
+	return size
+}
+
+// Conffiles returns the paths of all conffiles
+func (p *Package) Conffiles() []string {
+	conffiles := []string{}
+	for _, f := range p.Files {
+		if f.Conffile {
+			conffiles = append(conffiles, f.Path)
+		}
+	}
+
+	return conffiles
+}
+
+// FileName returns the conventional file name of the package in the given format
+func (p *Package) FileName(format string) string {
+	switch format {
+	case "deb":
+		return fmt.Sprintf("%s_%s-%d_%s.deb", p.Name, p.Version, p.Release, PackageArch(format))
+	case "rpm":
+		return fmt.Sprintf("%s-%s-%d.%s.rpm", p.Name, p.Version, p.Release, PackageArch(format))
+	default:
+		return fmt.Sprintf("%s-%s-r%d.%s", p.Name, p.Version, p.Release, format)
+	}
+}
+
+// Write writes the package in the given format (deb, rpm or apk) to the writer
+func (p *Package) Write(format string, w io.Writer) error {
+	switch format {
+	case "deb":
+		return p.writeDeb(w)
+	case "rpm":
+		return p.writeRPM(w)
+	case "apk":
+		return p.writeAPK(w)
+	}
+
+	return fmt.Errorf("unsupported package format %s, supported are: %s", format, strings.Join(PackageFormats, ", "))
+}
+
+// NativePackageFormat returns the package format of the distribution family, empty if unsupported
+func NativePackageFormat(family string) string {
+	switch family {
+	case "debian":
+		return "deb"
+	case "rhel", "suse":
+		return "rpm"
+	case "alpine":
+		return "apk"
+	}
+
+	return ""
+}
+
+// PackageArch returns the architecture name of the running platform, as used by the package format
+func PackageArch(format string) string {
+	arch := map[string]map[string]string{
+		"deb": {"amd64": "amd64", "386": "i386", "arm64": "arm64", "arm": "armhf", "ppc64le": "ppc64el", "s390x": "s390x"},
+		"rpm": {"amd64": "x86_64", "386": "i686", "arm64": "aarch64", "arm": "armv7hl", "ppc64le": "ppc64le", "s390x": "s390x"},
+		"apk": {"amd64": "x86_64", "386": "x86", "arm64": "aarch64", "arm": "armv7", "ppc64le": "ppc64le", "s390x": "s390x"},
+	}
+
+	if name, ok := arch[format][runtime.GOARCH]; ok {
+		return name
+	}
+
+	return runtime.GOARCH
+}
+
+// preInstallScript creates the nginx group and user, using the tools of either shadow or busybox (Alpine)
+func preInstallScript() string {
+	return fmt.Sprintf(`#!/bin/sh
+set -e
+if ! grep -q '^%[1]s:' /etc/group; then
+	groupadd --system %[1]s 2>/dev/null || addgroup -S %[1]s
+fi
+if ! grep -q '^%[1]s:' /etc/passwd; then
+	useradd --system --gid %[1]s --shell /bin/false --home-dir /dev/null %[1]s 2>/dev/null || adduser -S -D -H -h /dev/null -s /bin/false -G %[1]s %[1]s
+fi
+exit 0
+`, nginxUser)
+}
+
+// postInstallScript creates the NginX directories, generates the DH parameters on the first install
+// and makes systemd aware of the unit
+func postInstallScript() string {
+	return fmt.Sprintf(`#!/bin/sh
+set -e
+mkdir -p %[1]s
+if [ ! -f %[2]s ]; then
+	echo "Generating strong DHParams, this may take a while"
+	openssl dhparam -dsaparam -out %[2]s 4096 || echo "Failed generating %[2]s, run 'openssl dhparam -dsaparam -out %[2]s 4096'"
+fi
+if command -v systemctl >/dev/null 2>&1; then
+	systemctl daemon-reload || true
+fi
+exit 0
+`, strings.Join(nginxDirectories, " "), dhParamsPath)
+}
+
+// postRemoveScript makes systemd forget the removed unit. The nginx user and the data are kept
+func postRemoveScript() string {
+	return `#!/bin/sh
+if command -v systemctl >/dev/null 2>&1; then
+	systemctl daemon-reload || true
+fi
+exit 0
+`
+}
@@ -0,0 +1,519 @@
+package util
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const (
+	testBinary = "\x7fELF nginx"
+	testConf   = "worker_processes auto;\n"
+)
+
+// testPackage builds a package from a staging tree holding a binary, a conffile below /etc and a symlink
+func testPackage(t *testing.T) *Package {
+	root := t.TempDir()
+	files := []struct {
+		path, content string
+		mode          os.FileMode
+	}{
+		{"usr/sbin/nginx", testBinary, 0755},
+		{"etc/nginx/nginx.conf", testConf, 0644},
+		{"usr/lib/nginx/modules/ngx_http_brotli_filter_module.so", "module", 0644},
+	}
+	for _, f := range files {
+		path := filepath.Join(root, f.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(f.content), f.mode); err != nil {
+			t.Fatal(err)
+		}
+		// independent of the umask
+		if err := os.Chmod(path, f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("/usr/lib/nginx/modules", filepath.Join(root, "etc/nginx/modules")); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPackage(root, "1.17.0", 2, "SecNginX <test@example.org>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func writePackage(t *testing.T, p *Package, format string) []byte {
+	var buf bytes.Buffer
+	if err := p.Write(format, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// tarEntries reads all entries of a tar stream, mapping their names to the header and content
+func tarEntries(t *testing.T, r io.Reader) (map[string]*tar.Header, map[string]string) {
+	headers, contents := map[string]*tar.Header{}, map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return headers, contents
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers[header.Name], contents[header.Name] = header, string(data)
+	}
+}
+
+func gunzip(t *testing.T, data []byte) []byte {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return out
+}
+
+func TestNewPackage(t *testing.T) {
+	p := testPackage(t)
+
+	if conffiles := p.Conffiles(); strings.Join(conffiles, " ") != "/etc/nginx/nginx.conf" {
+		t.Fatalf("Conffiles() = %v, want /etc/nginx/nginx.conf only", conffiles)
+	}
+
+	if size := p.InstalledSize(); size != int64(len(testBinary)+len(testConf)+len("module")) {
+		t.Fatalf("InstalledSize() = %d", size)
+	}
+}
+
+func TestWriteDeb(t *testing.T) {
+	p := testPackage(t)
+	deb := writePackage(t, p, "deb")
+
+	if !bytes.HasPrefix(deb, []byte("!<arch>\n")) {
+		t.Fatal("missing ar magic")
+	}
+
+	// ar members: 60 byte header, data padded to 2 bytes
+	members := map[string][]byte{}
+	names := []string{}
+	for rest := deb[8:]; len(rest) > 0; {
+		if len(rest) < 60 || string(rest[58:60]) != "`\n" {
+			t.Fatalf("invalid ar member header %q", head(rest, 60))
+		}
+		name := strings.TrimSpace(string(rest[:16]))
+		size, err := strconv.Atoi(strings.TrimSpace(string(rest[48:58])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := strings.TrimSpace(string(rest[40:48])); mode != "100644" {
+			t.Fatalf("member %s has mode %s", name, mode)
+		}
+
+		members[name] = rest[60 : 60+size]
+		names = append(names, name)
+		rest = rest[60+size+size%2:]
+	}
+
+	if strings.Join(names, " ") != "debian-binary control.tar.gz data.tar.gz" {
+		t.Fatalf("ar members %v", names)
+	}
+	if string(members["debian-binary"]) != "2.0\n" {
+		t.Fatalf("debian-binary = %q", members["debian-binary"])
+	}
+
+	_, control := tarEntries(t, bytes.NewReader(gunzip(t, members["control.tar.gz"])))
+
+	fields := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(control["./control"]))
+	for scanner.Scan() {
+		if parts := strings.SplitN(scanner.Text(), ": ", 2); len(parts) == 2 && !strings.HasPrefix(parts[0], " ") {
+			fields[parts[0]] = parts[1]
+		}
+	}
+	want := map[string]string{"Package": "secnginx", "Version": "1.17.0-2", "Architecture": PackageArch("deb"),
+		"Maintainer": "SecNginX <test@example.org>", "Installed-Size": "1"}
+	for name, value := range want {
+		if fields[name] != value {
+			t.Fatalf("control field %s = %q, want %q", name, fields[name], value)
+		}
+	}
+
+	if control["./conffiles"] != "/etc/nginx/nginx.conf\n" {
+		t.Fatalf("conffiles = %q", control["./conffiles"])
+	}
+
+	md5sums := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(control["./md5sums"]), "\n") {
+		parts := strings.SplitN(line, "  ", 2)
+		md5sums[parts[1]] = parts[0]
+	}
+	for path, content := range map[string]string{"usr/sbin/nginx": testBinary, "etc/nginx/nginx.conf": testConf} {
+		digest := md5.Sum([]byte(content))
+		if md5sums[path] != hex.EncodeToString(digest[:]) {
+			t.Fatalf("md5sum of %s = %q", path, md5sums[path])
+		}
+	}
+	if _, ok := md5sums["etc/nginx/modules"]; ok || len(md5sums) != 3 {
+		t.Fatalf("md5sums has to list the regular files only: %v", md5sums)
+	}
+	for _, script := range []string{"./preinst", "./postinst", "./postrm"} {
+		if !strings.HasPrefix(control[script], "#!/bin/sh") {
+			t.Fatalf("%s = %q", script, control[script])
+		}
+	}
+
+	headers, data := tarEntries(t, bytes.NewReader(gunzip(t, members["data.tar.gz"])))
+	if data["./usr/sbin/nginx"] != testBinary || headers["./usr/sbin/nginx"].Mode != 0755 {
+		t.Fatalf("unexpected binary entry %+v", headers["./usr/sbin/nginx"])
+	}
+	if data["./etc/nginx/nginx.conf"] != testConf || headers["./etc/nginx/nginx.conf"].Uname != "root" {
+		t.Fatalf("unexpected conffile entry %+v", headers["./etc/nginx/nginx.conf"])
+	}
+	if link := headers["./etc/nginx/modules"]; link == nil || link.Typeflag != tar.TypeSymlink || link.Linkname != "/usr/lib/nginx/modules" {
+		t.Fatalf("unexpected symlink entry %+v", link)
+	}
+	if dir := headers["./usr/lib/nginx/"]; dir == nil || dir.Typeflag != tar.TypeDir {
+		t.Fatalf("unexpected directory entry %+v", dir)
+	}
+
+	// dpkg itself has to accept the package as well
+	if _, err := exec.LookPath("dpkg-deb"); err == nil {
+		file := filepath.Join(t.TempDir(), p.FileName("deb"))
+		if err = ioutil.WriteFile(file, deb, 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, flag := range []string{"--info", "--contents"} {
+			if out, err := exec.Command("dpkg-deb", flag, file).CombinedOutput(); err != nil {
+				t.Fatalf("dpkg-deb %s failed: %s %s", flag, err, out)
+			}
+		}
+	}
+}
+
+// rpmTestHeader is a parsed rpm header structure
+type rpmTestHeader struct {
+	// raw is the complete header, entries maps the tags to their type and data
+	raw     []byte
+	entries map[uint32]rpmEntry
+}
+
+func parseRPMHeader(t *testing.T, data []byte) rpmTestHeader {
+	if len(data) < 16 || !bytes.Equal(data[:8], rpmHeaderMagic) {
+		t.Fatal("missing rpm header magic")
+	}
+
+	count, size := binary.BigEndian.Uint32(data[8:]), binary.BigEndian.Uint32(data[12:])
+	length := 16 + 16*int(count) + int(size)
+	if len(data) < length {
+		t.Fatalf("rpm header of %d bytes is truncated", length)
+	}
+	store := data[16+16*count : length]
+
+	h := rpmTestHeader{raw: data[:length], entries: map[uint32]rpmEntry{}}
+	offsets := []uint32{}
+	for i := uint32(0); i < count; i++ {
+		index := data[16+16*i:]
+		e := rpmEntry{tag: binary.BigEndian.Uint32(index), typ: binary.BigEndian.Uint32(index[4:]),
+			count: binary.BigEndian.Uint32(index[12:])}
+		offsets = append(offsets, binary.BigEndian.Uint32(index[8:]))
+		h.entries[e.tag] = e
+	}
+
+	// the data of an entry ends, where the one of the next entry starts
+	for i, offset := range offsets {
+		end := uint32(len(store))
+		if i+1 < len(offsets) {
+			end = offsets[i+1]
+		}
+		tag := binary.BigEndian.Uint32(data[16+16*i:])
+		e := h.entries[tag]
+		if i == 0 {
+			// the region trailer is the last 16 bytes of the store
+			e.data = store[offset : offset+16]
+		} else {
+			e.data = store[offset:end]
+		}
+		h.entries[tag] = e
+	}
+
+	return h
+}
+
+func (h rpmTestHeader) strings(t *testing.T, tag uint32) []string {
+	e, ok := h.entries[tag]
+	if !ok {
+		t.Fatalf("rpm tag %d is missing", tag)
+	}
+	values := strings.Split(string(e.data), "\x00")
+	return values[:e.count]
+}
+
+func (h rpmTestHeader) int32s(t *testing.T, tag uint32) []uint32 {
+	e, ok := h.entries[tag]
+	if !ok || e.typ != rpmInt32 {
+		t.Fatalf("rpm tag %d is missing or no int32", tag)
+	}
+	values := []uint32{}
+	for i := uint32(0); i < e.count; i++ {
+		values = append(values, binary.BigEndian.Uint32(e.data[4*i:]))
+	}
+	return values
+}
+
+func (h rpmTestHeader) int16s(t *testing.T, tag uint32) []uint16 {
+	e, ok := h.entries[tag]
+	if !ok || e.typ != rpmInt16 {
+		t.Fatalf("rpm tag %d is missing or no int16", tag)
+	}
+	values := []uint16{}
+	for i := uint32(0); i < e.count; i++ {
+		values = append(values, binary.BigEndian.Uint16(e.data[2*i:]))
+	}
+	return values
+}
+
+// cpioEntry is a parsed entry of a newc cpio archive
+type cpioEntry struct {
+	name    string
+	mode    uint32
+	content string
+}
+
+func parseCpio(t *testing.T, data []byte) []cpioEntry {
+	entries := []cpioEntry{}
+	for {
+		if len(data) < 110 || string(data[:6]) != "070701" {
+			t.Fatalf("invalid cpio header %q", head(data, 110))
+		}
+		field := func(i int) uint32 {
+			v, err := strconv.ParseUint(string(data[6+8*i:14+8*i]), 16, 32)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return uint32(v)
+		}
+
+		mode, size, nameSize := field(1), int(field(6)), int(field(11))
+		name := string(data[110 : 110+nameSize-1])
+		if name == "TRAILER!!!" {
+			return entries
+		}
+
+		start := 110 + nameSize
+		start += (4 - start%4) % 4
+		entries = append(entries, cpioEntry{name, mode, string(data[start : start+size])})
+		end := start + size
+		data = data[end+(4-end%4)%4:]
+	}
+}
+
+func TestWriteRPM(t *testing.T) {
+	p := testPackage(t)
+	rpm := writePackage(t, p, "rpm")
+
+	// lead
+	if !bytes.Equal(rpm[:6], []byte{0xed, 0xab, 0xee, 0xdb, 3, 0}) {
+		t.Fatalf("invalid lead magic %x", rpm[:6])
+	}
+	if name := strings.TrimRight(string(rpm[10:76]), "\x00"); name != "secnginx-1.17.0-2" {
+		t.Fatalf("lead name = %q", name)
+	}
+	if binary.BigEndian.Uint16(rpm[78:]) != 5 {
+		t.Fatal("lead signature type isn't a header")
+	}
+
+	// signature header, padded to 8 bytes
+	signature := parseRPMHeader(t, rpm[96:])
+	padding := (8 - len(signature.raw)%8) % 8
+	if !bytes.Equal(rpm[96+len(signature.raw):96+len(signature.raw)+padding], make([]byte, padding)) {
+		t.Fatal("signature header isn't padded with zeros")
+	}
+	offset := 96 + len(signature.raw) + padding
+	if binary.BigEndian.Uint32(signature.entries[rpmTagHeaderSignatures].data) != rpmTagHeaderSignatures {
+		t.Fatal("signature header isn't sealed by its region tag")
+	}
+
+	header := parseRPMHeader(t, rpm[offset:])
+	payload := rpm[offset+len(header.raw):]
+
+	sha256Header := sha256.Sum256(header.raw)
+	if got := signature.strings(t, rpmSigTagSHA256)[0]; got != hex.EncodeToString(sha256Header[:]) {
+		t.Fatalf("signature SHA-256 = %s, want %x", got, sha256Header)
+	}
+	sha1Header := sha1.Sum(header.raw)
+	if got := signature.strings(t, rpmSigTagSHA1)[0]; got != hex.EncodeToString(sha1Header[:]) {
+		t.Fatalf("signature SHA-1 = %s, want %x", got, sha1Header)
+	}
+	if size := signature.int32s(t, rpmSigTagSize)[0]; int(size) != len(header.raw)+len(payload) {
+		t.Fatalf("signature size = %d, want %d", size, len(header.raw)+len(payload))
+	}
+	digest := md5.Sum(append(append([]byte{}, header.raw...), payload...))
+	if !bytes.Equal(signature.entries[rpmSigTagMD5].data, digest[:]) {
+		t.Fatal("signature MD5 doesn't match header and payload")
+	}
+
+	// main header
+	if binary.BigEndian.Uint32(header.entries[rpmTagHeaderImmutable].data) != rpmTagHeaderImmutable {
+		t.Fatal("main header isn't sealed by its region tag")
+	}
+	for tag, want := range map[uint32]string{rpmTagName: "secnginx", rpmTagVersion: "1.17.0", rpmTagRelease: "2",
+		rpmTagArch: PackageArch("rpm"), rpmTagPayloadCompressor: "gzip"} {
+		if got := header.strings(t, tag)[0]; got != want {
+			t.Fatalf("rpm tag %d = %q, want %q", tag, got, want)
+		}
+	}
+
+	payloadDigest := sha256.Sum256(payload)
+	if got := header.strings(t, rpmTagPayloadDigest)[0]; got != hex.EncodeToString(payloadDigest[:]) {
+		t.Fatalf("payload digest = %s, want %x", got, payloadDigest)
+	}
+
+	cpio := gunzip(t, payload)
+	if size := signature.int32s(t, rpmSigTagPayloadSize)[0]; int(size) != len(cpio) {
+		t.Fatalf("payload size = %d, want %d", size, len(cpio))
+	}
+
+	// file list, shared system directories aren't owned by the package
+	dirNames, baseNames := header.strings(t, rpmTagDirNames), header.strings(t, rpmTagBaseNames)
+	dirIndexes, modes, flags := header.int32s(t, rpmTagDirIndexes), header.int16s(t, rpmTagFileModes), header.int32s(t, rpmTagFileFlags)
+	paths := []string{}
+	for i, base := range baseNames {
+		paths = append(paths, dirNames[dirIndexes[i]]+base)
+	}
+
+	entries := parseCpio(t, cpio)
+	if len(entries) != len(paths) {
+		t.Fatalf("payload has %d entries, the header lists %d files", len(entries), len(paths))
+	}
+	for i, e := range entries {
+		if e.name != "."+paths[i] || uint32(modes[i]) != e.mode {
+			t.Fatalf("payload entry %s (%o) doesn't match header file %s (%o)", e.name, e.mode, paths[i], modes[i])
+		}
+		if i > 0 && paths[i-1] >= paths[i] {
+			t.Fatalf("files aren't sorted: %s before %s", paths[i-1], paths[i])
+		}
+	}
+
+	want := map[string]struct {
+		mode    uint32
+		content string
+		flags   uint32
+	}{
+		"./usr/sbin/nginx":       {0100755, testBinary, 0},
+		"./etc/nginx/nginx.conf": {0100644, testConf, rpmFileConfig | rpmFileNoReplace},
+		"./etc/nginx/modules":    {0120777, "/usr/lib/nginx/modules", 0},
+		"./usr/lib/nginx":        {040755, "", 0},
+	}
+	found := 0
+	for i, e := range entries {
+		if e.name == "./usr" || e.name == "./etc" {
+			t.Fatalf("system directory %s is owned by the package", e.name)
+		}
+		w, ok := want[e.name]
+		if !ok {
+			continue
+		}
+		found++
+		if e.mode != w.mode || e.content != w.content || flags[i] != w.flags {
+			t.Fatalf("payload entry %s = %o %q flags %d, want %o %q flags %d", e.name, e.mode, e.content, flags[i], w.mode, w.content, w.flags)
+		}
+	}
+	if found != len(want) {
+		t.Fatalf("payload lacks files, found %d of %d", found, len(want))
+	}
+}
+
+func TestWriteAPK(t *testing.T) {
+	p := testPackage(t)
+	apk := writePackage(t, p, "apk")
+
+	// the control stream is followed by the data stream, both are separate gzip streams
+	r := bytes.NewReader(apk)
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz.Multistream(false)
+	control, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := apk[len(apk)-r.Len():]
+
+	// apk expects the control stream without end of archive blocks
+	if bytes.HasSuffix(control, make([]byte, 1024)) {
+		t.Fatal("control stream ends with end of archive blocks")
+	}
+
+	_, entries := tarEntries(t, bytes.NewReader(control))
+	info := map[string]string{}
+	for _, line := range strings.Split(entries[".PKGINFO"], "\n") {
+		if parts := strings.SplitN(line, " = ", 2); len(parts) == 2 {
+			info[parts[0]] = parts[1]
+		}
+	}
+
+	dataHash := sha256.Sum256(data)
+	want := map[string]string{"pkgname": "secnginx", "pkgver": "1.17.0-r2", "arch": PackageArch("apk"),
+		"size": fmt.Sprint(p.InstalledSize()), "datahash": hex.EncodeToString(dataHash[:])}
+	for name, value := range want {
+		if info[name] != value {
+			t.Fatalf(".PKGINFO %s = %q, want %q", name, info[name], value)
+		}
+	}
+	for _, script := range []string{".pre-install", ".post-install", ".post-deinstall"} {
+		if !strings.HasPrefix(entries[script], "#!/bin/sh") {
+			t.Fatalf("%s = %q", script, entries[script])
+		}
+	}
+
+	headers, files := tarEntries(t, bytes.NewReader(gunzip(t, data)))
+	checksum := sha1.Sum([]byte(testConf))
+	if conf := headers["etc/nginx/nginx.conf"]; files["etc/nginx/nginx.conf"] != testConf ||
+		conf.PAXRecords["APK-TOOLS.checksum.SHA1"] != hex.EncodeToString(checksum[:]) {
+		t.Fatalf("unexpected conffile entry %+v", conf)
+	}
+	if link := headers["etc/nginx/modules"]; link == nil || link.Typeflag != tar.TypeSymlink || link.Linkname != "/usr/lib/nginx/modules" {
+		t.Fatalf("unexpected symlink entry %+v", link)
+	}
+}
+
+// head returns up to n leading bytes of data
+func head(data []byte, n int) []byte {
+	if len(data) < n {
+		return data
+	}
+	return data[:n]
+}
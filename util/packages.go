@@ -0,0 +1,237 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const osReleasePath = "/etc/os-release"
+
+// BuildDependencies are the distribution independent names of all packages required to build NginX.
+// PCRE isn't part of them, it is built from source. Perl runs the Configure script of OpenSSL
+var BuildDependencies = []string{"compiler", "cmake", "git", "curl", "libcurl", "zlib", "automake", "autoconf",
+	"libtool", "patch", "gpgv", "perl"}
+
+// TLSBuildDependencies returns the distribution independent names of the packages additionally required to build
+// the given TLS library version
+func TLSBuildDependencies(library TLSLibrary, version string) []string {
+	// the Configure script of OpenSSL 3 uses perl modules, which aren't part of every perl package
+	if library.Name == "quictls" || (library.Name == "openssl" && CompareVersions(version, "3.0.0") >= 0) {
+		return []string{"perl-openssl3"}
+	}
+
+	return nil
+}
+
+// packageNames maps the distribution independent package names to the ones of each distribution family
+var packageNames = map[string]map[string][]string{
+	"debian": {
+		"compiler": {"build-essential"},
+		"libcurl":  {"libcurl4-openssl-dev"},
+		"zlib":     {"zlib1g-dev"},
+		"perl":     {"perl"},
+		// the perl package ships all core modules
+		"perl-openssl3": {},
+	},
+	"rhel": {
+		"compiler":      {"gcc", "gcc-c++", "make"},
+		"libcurl":       {"libcurl-devel"},
+		"zlib":          {"zlib-devel"},
+		"gpgv":          {"gnupg2"},
+		"perl":          {"perl"},
+		"perl-openssl3": {"perl-IPC-Cmd", "perl-FindBin"},
+	},
+	"alpine": {
+		"compiler": {"build-base"},
+		"libcurl":  {"curl-dev"},
+		"zlib":     {"zlib-dev"},
+		"gpgv":     {"gnupg"},
+		// build-base doesn't pull in perl
+		"perl":          {"perl"},
+		"perl-openssl3": {},
+	},
+	"arch": {
+		"compiler":      {"base-devel"},
+		"libcurl":       {"curl"},
+		"gpgv":          {"gnupg"},
+		"perl":          {"perl"},
+		"perl-openssl3": {},
+	},
+	"suse": {
+		"compiler":      {"gcc", "gcc-c++", "make"},
+		"libcurl":       {"libcurl-devel"},
+		"zlib":          {"zlib-devel"},
+		"gpgv":          {"gpg2"},
+		"perl":          {"perl"},
+		"perl-openssl3": {},
+	},
+}
+
+// familyIDs maps the IDs of /etc/os-release to their distribution family
+var familyIDs = map[string]string{
+	"debian": "debian", "ubuntu": "debian", "raspbian": "debian", "linuxmint": "debian",
+	"rhel": "rhel", "fedora": "rhel", "centos": "rhel", "rocky": "rhel", "almalinux": "rhel", "ol": "rhel", "amzn": "rhel",
+	"alpine": "alpine",
+	"arch": "arch", "manjaro": "arch",
+	"suse": "suse", "opensuse": "suse", "opensuse-leap": "suse", "opensuse-tumbleweed": "suse", "sles": "suse",
+}
+
+// Distro holds the relevant fields of /etc/os-release
+type Distro struct {
+	ID        string
+	Like      []string
+	Name      string
+	VersionID string
+}
+
+// DetectDistro parses /etc/os-release
+func DetectDistro() (*Distro, error) {
+	f, err := os.Open(osReleasePath)
+	if err != nil {
+		return nil, fmt.Errorf("can't detect distribution: %s", err)
+	}
+	defer f.Close()
+
+	distro := &Distro{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		value := strings.Trim(parts[1], `"'`)
+		switch parts[0] {
+		case "ID":
+			distro.ID = value
+		case "ID_LIKE":
+			distro.Like = strings.Fields(value)
+		case "PRETTY_NAME":
+			distro.Name = value
+		case "VERSION_ID":
+			distro.VersionID = value
+		}
+	}
+
+	return distro, scanner.Err()
+}
+
+// Family returns the distribution family (debian, rhel, alpine, arch or suse), derived from ID and ID_LIKE
+func (d *Distro) Family() string {
+	for _, id := range append([]string{d.ID}, d.Like...) {
+		if family, ok := familyIDs[id]; ok {
+			return family
+		}
+	}
+
+	return ""
+}
+
+// PackageManager returns the package manager of the distribution
+func (d *Distro) PackageManager() (*PackageManager, error) {
+	switch d.Family() {
+	case "debian":
+		return GetPackageManager("apt")
+	case "rhel":
+		if _, err := exec.LookPath("dnf"); err == nil {
+			return GetPackageManager("dnf")
+		}
+		return GetPackageManager("yum")
+	case "alpine":
+		return GetPackageManager("apk")
+	case "arch":
+		return GetPackageManager("pacman")
+	case "suse":
+		return GetPackageManager("zypper")
+	}
+
+	return nil, fmt.Errorf("unsupported distribution %s (%s), please install the build dependencies manually", d.Name, d.ID)
+}
+
+// PackageManager installs packages of a distribution family
+type PackageManager struct {
+	Name   string
+	Family string
+	// update is run once before installing packages
+	update []string
+	// install is called with the packages appended
+	install []string
+	// query checks, whether the appended package is installed
+	query []string
+}
+
+var packageManagers = []PackageManager{
+	{"apt", "debian", []string{"apt-get", "update"}, []string{"apt-get", "install", "-y"}, []string{"dpkg", "-s"}},
+	{"dnf", "rhel", nil, []string{"dnf", "install", "-y"}, []string{"rpm", "-q"}},
+	{"yum", "rhel", nil, []string{"yum", "install", "-y"}, []string{"rpm", "-q"}},
+	{"apk", "alpine", []string{"apk", "update"}, []string{"apk", "add", "--no-cache"}, []string{"apk", "info", "-e"}},
+	// Arch doesn't support partial upgrades, so the refresh is part of a full upgrade
+	{"pacman", "arch", nil, []string{"pacman", "-Syu", "--noconfirm", "--needed"}, []string{"pacman", "-Q"}},
+	{"zypper", "suse", []string{"zypper", "--non-interactive", "refresh"}, []string{"zypper", "--non-interactive", "install"}, []string{"rpm", "-q"}},
+}
+
+// GetPackageManager returns the package manager with the given name
+func GetPackageManager(name string) (*PackageManager, error) {
+	for _, pm := range packageManagers {
+		if pm.Name == name {
+			return &pm, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown package manager %s", name)
+}
+
+// Resolve maps the distribution independent package names to the ones of the package manager's distribution family
+func (pm *PackageManager) Resolve(packages []string) []string {
+	resolved := []string{}
+	seen := map[string]bool{}
+
+	for _, p := range packages {
+		names, ok := packageNames[pm.Family][p]
+		if !ok {
+			names = []string{p}
+		}
+
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				resolved = append(resolved, name)
+			}
+		}
+	}
+
+	return resolved
+}
+
+// Missing returns the packages, which aren't installed yet
+func (pm *PackageManager) Missing(packages []string) []string {
+	missing := []string{}
+
+	for _, p := range packages {
+		args := append(append([]string{}, pm.query[1:]...), p)
+		if exec.Command(pm.query[0], args...).Run() != nil {
+			missing = append(missing, p)
+		}
+	}
+
+	return missing
+}
+
+// Install installs the given packages and returns the package manager's output on failure
+func (pm *PackageManager) Install(packages []string) error {
+	if len(pm.update) > 0 {
+		if out, err := exec.Command(pm.update[0], pm.update[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("'%s' failed: %s\n%s", strings.Join(pm.update, " "), err, out)
+		}
+	}
+
+	args := append(append([]string{}, pm.install[1:]...), packages...)
+	if out, err := exec.Command(pm.install[0], args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("'%s %s' failed: %s\n%s", strings.Join(pm.install, " "), strings.Join(packages, " "), err, out)
+	}
+
+	return nil
+}
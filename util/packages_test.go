@@ -0,0 +1,49 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveBuildDependencies(t *testing.T) {
+	openssl, quictls, libressl := TLSLibrary{Name: "openssl"}, TLSLibrary{Name: "quictls"}, TLSLibrary{Name: "libressl"}
+
+	tests := []struct {
+		manager string
+		library TLSLibrary
+		version string
+		want    []string
+		without []string
+	}{
+		{"apt", openssl, "1.1.1c", []string{"build-essential", "perl"}, []string{"perl-openssl3"}},
+		{"apk", openssl, "1.1.1c", []string{"build-base", "perl"}, nil},
+		{"dnf", openssl, "1.1.1c", []string{"perl"}, []string{"perl-IPC-Cmd", "perl-FindBin"}},
+		{"dnf", openssl, "3.0.8", []string{"perl", "perl-IPC-Cmd", "perl-FindBin"}, nil},
+		{"yum", quictls, "3.1.5-quic1", []string{"perl", "perl-IPC-Cmd", "perl-FindBin"}, nil},
+		{"dnf", libressl, "3.8.2", []string{"perl"}, []string{"perl-IPC-Cmd"}},
+		{"apk", quictls, "3.1.5-quic1", []string{"perl"}, []string{"perl-openssl3"}},
+		{"pacman", openssl, "3.0.8", []string{"base-devel", "perl"}, []string{"perl-openssl3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.manager+" "+tt.library.Name+" "+tt.version, func(t *testing.T) {
+			pm, err := GetPackageManager(tt.manager)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			packages := pm.Resolve(append(append([]string{}, BuildDependencies...), TLSBuildDependencies(tt.library, tt.version)...))
+			resolved := " " + strings.Join(packages, " ") + " "
+			for _, p := range tt.want {
+				if !strings.Contains(resolved, " "+p+" ") {
+					t.Fatalf("Resolve() = %v, missing %s", packages, p)
+				}
+			}
+			for _, p := range tt.without {
+				if strings.Contains(resolved, " "+p+" ") {
+					t.Fatalf("Resolve() = %v, unexpected %s", packages, p)
+				}
+			}
+		})
+	}
+}
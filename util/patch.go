@@ -0,0 +1,127 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PatchesDir is the directory holding the patch files, relative to the working directory
+const PatchesDir = "patches"
+
+// Patch is a patch file, declared as [[patch]] table in the toml config
+type Patch struct {
+	Name string `mapstructure:"name" json:"name"`
+	// File is the path of the patch, relative to the patches directory
+	File string `mapstructure:"file" json:"file"`
+	// Component is the name of the patched component (e.g. nginx or openssl) or third party module
+	Component string `mapstructure:"component" json:"component"`
+	// Versions restricts the patch to component versions, e.g. ">= 1.15.5, < 1.17.7"
+	Versions string `mapstructure:"versions" json:"versions,omitempty"`
+	// Order determines the order patches are applied in, lower first
+	Order int `mapstructure:"order" json:"order"`
+	// Symbols are strings (e.g. directive names) the patch adds to the NginX binary, verified after the build
+	Symbols []string `mapstructure:"symbols" json:"symbols,omitempty"`
+}
+
+// AppliedPatch records a patch applied to a build
+type AppliedPatch struct {
+	Name      string `json:"name"`
+	Component string `json:"component"`
+	File      string `json:"file"`
+	SHA256    string `json:"sha256"`
+}
+
+// Validate checks whether the patch declaration is complete
+func (p Patch) Validate() error {
+	if p.Name == "" {
+		return errors.New("patch without name found")
+	}
+
+	if p.File == "" || p.Component == "" {
+		return fmt.Errorf("patch %s needs a file and a component", p.Name)
+	}
+
+	// the file has to stay below the patches directory
+	if filepath.IsAbs(p.File) || containsDotDot(p.File) {
+		return fmt.Errorf("patch %s: file %s has to be a relative path below %s", p.Name, p.File, PatchesDir)
+	}
+
+	if !fileExists(p.Path()) {
+		return fmt.Errorf("patch %s: %s doesn't exist", p.Name, p.Path())
+	}
+
+	if _, err := MatchesVersions("0", p.Versions); err != nil {
+		return fmt.Errorf("patch %s: %s", p.Name, err)
+	}
+
+	return nil
+}
+
+// Path returns the path of the patch file, relative to the working directory
+func (p Patch) Path() string {
+	return filepath.Join(PatchesDir, p.File)
+}
+
+// Applies checks whether the patch targets the given component version
+func (p Patch) Applies(version string) bool {
+	ok, _ := MatchesVersions(version, p.Versions)
+	return ok
+}
+
+// SortPatches sorts the patches by their order, keeping the declaration order of equal ones
+func SortPatches(patches []Patch) {
+	sort.SliceStable(patches, func(i, j int) bool { return patches[i].Order < patches[j].Order })
+}
+
+// Apply checks the patch using a dry run and applies it to the source in dir afterwards.
+// If the patch doesn't apply, nothing is changed and the dry run report is returned as error
+func (p Patch) Apply(wd, dir string) (AppliedPatch, error) {
+	applied := AppliedPatch{Name: p.Name, Component: p.Component, File: p.Path()}
+
+	file, err := filepath.Abs(filepath.Join(wd, p.Path()))
+	if err != nil {
+		return applied, err
+	}
+
+	applied.SHA256, err = FileSHA256(file)
+	if err != nil {
+		return applied, err
+	}
+
+	if out, err := runPatch(dir, "--dry-run", "-p1", "--forward", "--batch", "-i", file); err != nil {
+		return applied, fmt.Errorf("patch %s doesn't apply to %s:\n%s", p.Name, p.Component, out)
+	}
+
+	if out, err := runPatch(dir, "-p1", "--forward", "--batch", "-i", file); err != nil {
+		return applied, fmt.Errorf("failed applying patch %s to %s:\n%s", p.Name, p.Component, out)
+	}
+
+	return applied, nil
+}
+
+func runPatch(dir string, args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := exec.Command("patch", args...)
+	cmd.Dir = dir
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	err := cmd.Run()
+	return strings.TrimSpace(out.String()), err
+}
+
+// containsDotDot reports whether any element of path is ".."
+func containsDotDot(path string) bool {
+	for _, element := range strings.FieldsFunc(filepath.ToSlash(path), func(r rune) bool { return r == '/' }) {
+		if element == ".." {
+			return true
+		}
+	}
+
+	return false
+}
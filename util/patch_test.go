@@ -0,0 +1,30 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPatchValidateFile(t *testing.T) {
+	tests := []struct {
+		file    string
+		wantErr string
+	}{
+		{"/etc/shadow", "relative path"},
+		{"../secret.patch", "relative path"},
+		{"nginx/../../secret.patch", "relative path"},
+		{"nginx/..", "relative path"},
+		// valid paths are checked for existence
+		{"nginx/missing.patch", "doesn't exist"},
+		{"nginx/..missing.patch", "doesn't exist"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			p := Patch{Name: "test", File: tt.file, Component: "nginx"}
+			if err := p.Validate(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// PGPConfig holds the settings of the [pgp] table, used to verify the detached signatures of the release tarballs
+type PGPConfig struct {
+	// Keyring is the path of the (binary) gpg keyring holding the release signing keys
+	Keyring string `mapstructure:"keyring" json:"keyring"`
+	// TrustedFingerprints are the only keys, whose signatures are accepted
+	TrustedFingerprints []string `mapstructure:"trusted_fingerprints" json:"trusted_fingerprints"`
+	// Signatures maps the component names to the file name template of their signature, which replaces the
+	// tarball in each mirror URL. {file} is replaced by the tarball file name, {version} by the component version.
+	// Full URLs are used as they are
+	Signatures map[string]string `mapstructure:"signatures" json:"signatures"`
+}
+
+// Enabled returns whether signature verification has been configured
+func (p *PGPConfig) Enabled() bool {
+	return p != nil && p.Keyring != ""
+}
+
+// Validate checks the PGP settings for completeness. Trusted fingerprints without keyring are refused, as
+// nothing would be verified
+func (p *PGPConfig) Validate(components []Component) error {
+	if !p.Enabled() {
+		if len(p.TrustedFingerprints) > 0 {
+			return fmt.Errorf("pgp trusted_fingerprints are configured, but no keyring: set keyring in the [pgp] table or remove the fingerprints")
+		}
+
+		// the upstream checksum is served by the same mirror as the tarball, it doesn't authenticate it
+		for _, c := range components {
+			if c.Source == nil && c.SHA256 == UpstreamChecksum {
+				return fmt.Errorf("the upstream checksum of %s only detects corrupted downloads, please configure its SHA-256 checksum or enable pgp verification", c.Title)
+			}
+		}
+		return nil
+	}
+
+	if len(p.TrustedFingerprints) == 0 {
+		return fmt.Errorf("pgp verification requires at least one trusted fingerprint")
+	}
+
+	for _, c := range components {
+		signature := p.Signatures[c.Name]
+		if signature == "" {
+			return fmt.Errorf("no pgp signature URL configured for %s, please add it to the [pgp.signatures] table", c.Title)
+		}
+
+		if !strings.Contains(signature, "{file}") && !strings.Contains(signature, "://") {
+			return fmt.Errorf("pgp signature of %s has to contain {file} (e.g. \"{file}.asc\") or be a full URL", c.Title)
+		}
+	}
+
+	return nil
+}
+
+// SignatureURLs returns the signature URLs of the given component tarball, one per mirror. The signature
+// replaces the tarball file name in the mirror URL, so e.g. .../pcre-8.43.tar.gz/download on sourceforge
+// becomes .../pcre-8.43.tar.gz.sig/download
+func (p *PGPConfig) SignatureURLs(c Component) []string {
+	file := c.FileName()
+	signature := strings.Replace(p.Signatures[c.Name], "{file}", file, -1)
+	signature = strings.Replace(signature, "{version}", c.Version, -1)
+	if strings.Contains(signature, "://") {
+		return []string{signature}
+	}
+
+	urls := []string{}
+	for _, url := range c.URLs {
+		i := strings.LastIndex(url, "/"+file)
+		if i < 0 {
+			continue
+		}
+
+		rest := url[i+1+len(file):]
+		if rest != "" && !strings.HasPrefix(rest, "/") && !strings.HasPrefix(rest, "?") {
+			continue
+		}
+		urls = append(urls, url[:i+1]+signature+rest)
+	}
+
+	return urls
+}
+
+// VerifySignature checks the detached signature of the given file using gpgv and returns the
+// fingerprint of the signing key. Only signatures of trusted keys are accepted
+func (p *PGPConfig) VerifySignature(file, signature string) (string, error) {
+	keyring, err := filepath.Abs(p.Keyring)
+	if err != nil {
+		return "", err
+	}
+
+	var status, stderr bytes.Buffer
+	cmd := exec.Command("gpgv", "--keyring", keyring, "--status-fd", "1", signature, file)
+	cmd.Stdout = &status
+	cmd.Stderr = &stderr
+
+	if err = cmd.Run(); err != nil {
+		return "", fmt.Errorf("bad or unknown signature: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	// [GNUPG:] VALIDSIG <fingerprint> <date> <timestamp> ... <primary key fingerprint>
+	scanner := bufio.NewScanner(&status)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "VALIDSIG" {
+			continue
+		}
+
+		for _, fingerprint := range []string{fields[2], fields[len(fields)-1]} {
+			if p.trusts(fingerprint) {
+				return fingerprint, nil
+			}
+		}
+
+		return "", fmt.Errorf("signature made by untrusted key %s", fields[len(fields)-1])
+	}
+
+	return "", fmt.Errorf("no valid signature found")
+}
+
+// trusts checks whether the given fingerprint belongs to the trusted ones
+func (p *PGPConfig) trusts(fingerprint string) bool {
+	for _, trusted := range p.TrustedFingerprints {
+		if strings.EqualFold(strings.Replace(trusted, " ", "", -1), fingerprint) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,188 @@
+package util
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKeyring generates a throwaway signing key below dir and returns the gpg home, a keyring for gpgv and the
+// fingerprint of the key
+func testKeyring(t *testing.T, dir string) (string, string, string) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg isn't installed")
+	}
+	if _, err := exec.LookPath("gpgv"); err != nil {
+		t.Skip("gpgv isn't installed")
+	}
+
+	home := filepath.Join(dir, "gnupg")
+	gpg := func(args ...string) string {
+		args = append([]string{"--homedir", home, "--batch", "--pinentry-mode", "loopback", "--passphrase", ""}, args...)
+		out, err := exec.Command("gpg", args...).Output()
+		if err != nil {
+			t.Fatalf("gpg %s failed: %s", strings.Join(args, " "), err)
+		}
+		return string(out)
+	}
+
+	if err := os.Mkdir(home, 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { exec.Command("gpgconf", "--homedir", home, "--kill", "gpg-agent").Run() })
+
+	gpg("--quick-gen-key", "SecNginX Test <test@example.org>", "ed25519", "sign", "never")
+
+	fingerprint := ""
+	for _, line := range strings.Split(gpg("--with-colons", "--list-keys"), "\n") {
+		if fields := strings.Split(line, ":"); fields[0] == "fpr" && fingerprint == "" {
+			fingerprint = fields[9]
+		}
+	}
+	if fingerprint == "" {
+		t.Fatal("no fingerprint of the generated key found")
+	}
+
+	keyring := filepath.Join(dir, "keyring.gpg")
+	gpg("--output", keyring, "--export", fingerprint)
+
+	return home, keyring, fingerprint
+}
+
+// testTarball writes a small release tarball
+func testTarball(t *testing.T, path string) {
+	data, err := gzipTar(func(tw *tar.Writer) error {
+		return writeTarFile(tw, "nginx-1.17.0/README", 0644, time.Now(), []byte("NginX"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	dir := t.TempDir()
+	home, keyring, fingerprint := testKeyring(t, dir)
+
+	tarball := filepath.Join(dir, "nginx-1.17.0.tar.gz")
+	testTarball(t, tarball)
+
+	signature := tarball + ".asc"
+	out, err := exec.Command("gpg", "--homedir", home, "--batch", "--pinentry-mode", "loopback", "--passphrase", "",
+		"--armor", "--output", signature, "--detach-sign", tarball).CombinedOutput()
+	if err != nil {
+		t.Fatalf("signing failed: %s %s", err, out)
+	}
+
+	tampered := filepath.Join(dir, "tampered.tar.gz")
+	if err = ioutil.WriteFile(tampered, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		trusted []string
+		file    string
+		wantErr string
+	}{
+		{"good signature", []string{fingerprint}, tarball, ""},
+		{"fingerprint with spaces", []string{strings.ToLower(fingerprint[:20]) + " " + fingerprint[20:]}, tarball, ""},
+		{"bad signature", []string{fingerprint}, tampered, "bad or unknown signature"},
+		{"untrusted fingerprint", []string{"B0F4253373F8F6F510D42178520A9993A1C052F8"}, tarball, "untrusted key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pgp := &PGPConfig{Keyring: keyring, TrustedFingerprints: tt.trusted}
+
+			signedBy, err := pgp.VerifySignature(tt.file, signature)
+			if tt.wantErr == "" {
+				if err != nil || !strings.EqualFold(signedBy, fingerprint) {
+					t.Fatalf("VerifySignature() = %q, %v, want %s", signedBy, err, fingerprint)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("VerifySignature() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPGPValidate(t *testing.T) {
+	pinned := []Component{{Name: "nginx", Title: "NginX", SHA256: "4fd376bad78797e7f18094a00f0f1088259326436b537eb5af69b01be2ca1345"}}
+	upstream := []Component{{Name: "nginx", Title: "NginX", SHA256: UpstreamChecksum}}
+	sourced := []Component{{Name: "nginx", Title: "NginX", SHA256: UpstreamChecksum, Source: &Source{Path: "nginx"}}}
+	enabled := PGPConfig{Keyring: "keys.gpg", TrustedFingerprints: []string{"ABCD"}, Signatures: map[string]string{"nginx": "{file}.asc"}}
+
+	tests := []struct {
+		name       string
+		pgp        PGPConfig
+		components []Component
+		wantErr    bool
+	}{
+		{"disabled", PGPConfig{}, pinned, false},
+		{"upstream checksum without pgp", PGPConfig{}, upstream, true},
+		{"upstream checksum with pgp", enabled, upstream, false},
+		{"upstream checksum of a source", PGPConfig{}, sourced, false},
+		{"fingerprints without keyring", PGPConfig{TrustedFingerprints: []string{"ABCD"}}, pinned, true},
+		{"keyring without fingerprints", PGPConfig{Keyring: "keys.gpg", Signatures: map[string]string{"nginx": "{file}.asc"}}, pinned, true},
+		{"file template", enabled, pinned, false},
+		{"full URL", PGPConfig{Keyring: "keys.gpg", TrustedFingerprints: []string{"ABCD"}, Signatures: map[string]string{"nginx": "https://example.org/{version}.asc"}}, pinned, false},
+		{"appended to URL", PGPConfig{Keyring: "keys.gpg", TrustedFingerprints: []string{"ABCD"}, Signatures: map[string]string{"nginx": "{url}.asc"}}, pinned, true},
+		{"missing signature", PGPConfig{Keyring: "keys.gpg", TrustedFingerprints: []string{"ABCD"}}, pinned, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.pgp.Validate(tt.components); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignatureURLs(t *testing.T) {
+	pcre := Component{Name: "pcre", Version: "8.43", URLs: []string{
+		"https://ftp.exim.org/pub/pcre/pcre-8.43.tar.gz",
+		"https://sourceforge.net/projects/pcre/files/pcre/8.43/pcre-8.43.tar.gz/download",
+		"https://mirror.example.org/pcre-8.43.tar.gz?raw=1",
+	}}
+
+	tests := []struct {
+		name      string
+		signature string
+		want      []string
+	}{
+		{"file template", "{file}.sig", []string{
+			"https://ftp.exim.org/pub/pcre/pcre-8.43.tar.gz.sig",
+			"https://sourceforge.net/projects/pcre/files/pcre/8.43/pcre-8.43.tar.gz.sig/download",
+			"https://mirror.example.org/pcre-8.43.tar.gz.sig?raw=1",
+		}},
+		{"version template", "{file}-{version}.asc", []string{
+			"https://ftp.exim.org/pub/pcre/pcre-8.43.tar.gz-8.43.asc",
+			"https://sourceforge.net/projects/pcre/files/pcre/8.43/pcre-8.43.tar.gz-8.43.asc/download",
+			"https://mirror.example.org/pcre-8.43.tar.gz-8.43.asc?raw=1",
+		}},
+		{"full URL", "https://example.org/{file}.sig", []string{"https://example.org/pcre-8.43.tar.gz.sig"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pgp := &PGPConfig{Signatures: map[string]string{"pcre": tt.signature}}
+			got := pgp.SignatureURLs(pcre)
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Fatalf("SignatureURLs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FetchJob loads a single component or module
+type FetchJob struct {
+	Name string
+	Run  func(ctx context.Context) (LockedSource, error)
+}
+
+// FetchError reports all failed jobs of a FetchAll run
+type FetchError struct {
+	// Failed maps the names of the failed jobs to their error
+	Failed map[string]error
+	// Cancelled are the jobs, which were aborted because of another failure or an interrupt
+	Cancelled []string
+}
+
+func (e *FetchError) Error() string {
+	names := []string{}
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{}
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s: %s", name, e.Failed[name]))
+	}
+
+	if len(e.Cancelled) > 0 {
+		sort.Strings(e.Cancelled)
+		lines = append(lines, "cancelled: "+strings.Join(e.Cancelled, ", "))
+	}
+
+	if len(e.Failed) == 0 {
+		return fmt.Sprintf("loading the sources has been interrupted:\n  %s", strings.Join(lines, "\n  "))
+	}
+
+	return fmt.Sprintf("%d of the sources failed to load:\n  %s", len(e.Failed), strings.Join(lines, "\n  "))
+}
+
+// FetchAll runs the jobs using a bounded pool of workers. As soon as a job fails, all others are
+// cancelled. If ctx is cancelled (e.g. on CTRL+C), the running jobs are reported as cancelled instead of failed.
+// The resolved sources are recorded in the returned lockfile
+func FetchAll(parent context.Context, workers int, jobs []FetchJob) (*Lockfile, error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	resolved := &Lockfile{}
+	fetchErr := &FetchError{Failed: map[string]error{}}
+	var mutex sync.Mutex
+
+	queue := make(chan FetchJob)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+
+			for job := range queue {
+				if ctx.Err() != nil {
+					mutex.Lock()
+					fetchErr.Cancelled = append(fetchErr.Cancelled, job.Name)
+					mutex.Unlock()
+					continue
+				}
+
+				source, err := job.Run(ctx)
+				if err == nil {
+					resolved.AddSource(source)
+					continue
+				}
+
+				mutex.Lock()
+				if parent.Err() != nil || (ctx.Err() != nil && len(fetchErr.Failed) > 0) {
+					fetchErr.Cancelled = append(fetchErr.Cancelled, job.Name)
+				} else {
+					fetchErr.Failed[job.Name] = err
+				}
+				mutex.Unlock()
+
+				cancel()
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+
+	wg.Wait()
+	sort.Strings(fetchErr.Cancelled)
+
+	if len(fetchErr.Failed) > 0 {
+		return resolved, fetchErr
+	}
+
+	// the parent context was cancelled
+	if len(fetchErr.Cancelled) > 0 {
+		return resolved, fetchErr
+	}
+
+	return resolved, nil
+}
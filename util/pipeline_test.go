@@ -0,0 +1,92 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingJob waits until it's cancelled
+func blockingJob(name string, started chan<- string) FetchJob {
+	return FetchJob{Name: name, Run: func(ctx context.Context) (LockedSource, error) {
+		started <- name
+		<-ctx.Done()
+		return LockedSource{}, fmt.Errorf("download of %s aborted: %s", name, ctx.Err())
+	}}
+}
+
+func TestFetchAll(t *testing.T) {
+	jobs := []FetchJob{}
+	for _, name := range []string{"nginx", "openssl", "pcre"} {
+		name := name
+		jobs = append(jobs, FetchJob{Name: name, Run: func(ctx context.Context) (LockedSource, error) {
+			return LockedSource{Name: name}, nil
+		}})
+	}
+
+	resolved, err := FetchAll(context.Background(), 2, jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resolved.Sources) != 3 {
+		t.Fatalf("resolved %v, want all sources", resolved.Sources)
+	}
+}
+
+func TestFetchAllFailure(t *testing.T) {
+	started := make(chan string, 3)
+	jobs := []FetchJob{blockingJob("nginx", started), blockingJob("openssl", started), {Name: "pcre", Run: func(ctx context.Context) (LockedSource, error) {
+		// fail once the others are running
+		<-started
+		<-started
+		return LockedSource{}, errors.New("checksum mismatch")
+	}}}
+
+	_, err := FetchAll(context.Background(), 3, jobs)
+
+	fetchErr, ok := err.(*FetchError)
+	if !ok {
+		t.Fatalf("FetchAll() error = %v, want a FetchError", err)
+	}
+	if len(fetchErr.Failed) != 1 || fetchErr.Failed["pcre"] == nil {
+		t.Fatalf("failed %v, want pcre only", fetchErr.Failed)
+	}
+	if strings.Join(fetchErr.Cancelled, " ") != "nginx openssl" {
+		t.Fatalf("cancelled %v, want nginx and openssl", fetchErr.Cancelled)
+	}
+}
+
+func TestFetchAllInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan string, 2)
+	jobs := []FetchJob{blockingJob("nginx", started), blockingJob("openssl", started), blockingJob("pcre", started)}
+
+	// CTRL+C once the first two jobs are running, the third one is never started
+	go func() {
+		<-started
+		<-started
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := FetchAll(ctx, 2, jobs)
+
+	fetchErr, ok := err.(*FetchError)
+	if !ok {
+		t.Fatalf("FetchAll() error = %v, want a FetchError", err)
+	}
+	if len(fetchErr.Failed) != 0 {
+		t.Fatalf("failed %v, want none on an interrupt", fetchErr.Failed)
+	}
+	if strings.Join(fetchErr.Cancelled, " ") != "nginx openssl pcre" {
+		t.Fatalf("cancelled %v, want all jobs", fetchErr.Cancelled)
+	}
+	if !strings.HasPrefix(err.Error(), "loading the sources has been interrupted") {
+		t.Fatalf("unexpected error message %q", err)
+	}
+}
@@ -0,0 +1,178 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// Plan holds everything an install is going to do. It is created by 'secnginx plan' and executed by 'secnginx apply'
+type Plan struct {
+	// PackageManager is the package manager of the target distribution, empty if packages are installed manually
+	PackageManager string `json:"package_manager,omitempty"`
+	// Packages are the build dependencies to install via the package manager
+	Packages   []string    `json:"packages"`
+	Components []Component `json:"components"`
+	// TLSLibrary is the library NginX is linked against, its source is one of the components
+	TLSLibrary TLSLibrary `json:"tls_library"`
+	Modules    []Module   `json:"modules"`
+	PGP        PGPConfig  `json:"pgp"`
+	Cache      Cache      `json:"cache"`
+	// DownloadWorkers is the maximum amount of parallel downloads
+	DownloadWorkers int `json:"download_workers"`
+	// KeepReleases is the number of versioned installs kept after the install, 0 disables pruning
+	KeepReleases int `json:"keep_releases"`
+	// Lock is set for locked builds, all sources have to match it
+	Lock    *Lockfile    `json:"lock,omitempty"`
+	Profile BuildProfile `json:"build_profile"`
+	// Hardening properties are verified on the built binary
+	Hardening Hardening `json:"hardening"`
+	// ConfigureArguments are passed to NginX's configure script, $WD is replaced by the working directory
+	ConfigureArguments []string `json:"configure_arguments"`
+	// Patches are applied to their components in order
+	Patches []Patch `json:"patches"`
+	Upgrade bool    `json:"upgrade"`
+	// Canary verifies the new build with the live configuration on loopback ports before it is activated
+	Canary bool `json:"canary"`
+	// Provisioning is only set for fresh installs
+	Provisioning *Provisioning `json:"provisioning,omitempty"`
+}
+
+// ReadPlan parses the plan file at the given path
+func ReadPlan(path string) (*Plan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{}
+	if err = json.Unmarshal(data, plan); err != nil {
+		return nil, fmt.Errorf("failed parsing plan %s: %s", path, err)
+	}
+
+	// components share the PGP settings of the plan
+	for i := range plan.Components {
+		plan.Components[i].PGP = &plan.PGP
+	}
+
+	return plan, nil
+}
+
+// Write stores the plan as JSON file at the given path
+func (p *Plan) Write(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Arguments returns the configure arguments for the given working directory
+func (p *Plan) Arguments(wd string) []string {
+	args := make([]string, len(p.ConfigureArguments))
+	for i, arg := range p.ConfigureArguments {
+		args[i] = strings.Replace(arg, "$WD", wd, -1)
+	}
+
+	return args
+}
+
+// PatchTarget returns the source directory below buildDir and the version of the component or module with the given name
+func (p *Plan) PatchTarget(name, buildDir string) (string, string, bool) {
+	for _, c := range p.Components {
+		if c.Name == name {
+			return c.Path(buildDir), c.Version, true
+		}
+	}
+
+	for _, m := range p.Modules {
+		if m.Name == name {
+			return m.Path(buildDir), m.Ref, true
+		}
+	}
+
+	return "", "", false
+}
+
+// ConfigureArgument returns the value of the configure argument with the given name (e.g. --conf-path) or def, if it isn't set
+func (p *Plan) ConfigureArgument(name, def string) string {
+	for _, arg := range p.ConfigureArguments {
+		if strings.HasPrefix(arg, name+"=") {
+			return strings.TrimPrefix(arg, name+"=")
+		}
+	}
+
+	return def
+}
+
+// Print logs a human readable summary of the plan
+func (p *Plan) Print() {
+	if len(p.Packages) > 0 {
+		log.Printf("Required packages (%s): %s", p.PackageManager, strings.Join(p.Packages, " "))
+	}
+
+	log.Printf("TLS library: %s", p.TLSLibrary.Title)
+
+	log.Println("Sources to load:")
+	for _, c := range p.Components {
+		if c.Source != nil {
+			log.Printf("  %s %s from %s%s", c.Title, c.Version, c.Source.Path, c.Source.Git)
+		} else {
+			log.Printf("  %s %s from %s (sha256 %s)", c.Title, c.Version, strings.Join(c.URLs, ", "), c.SHA256)
+		}
+	}
+	for _, m := range p.Modules {
+		kind := "module"
+		if m.Dynamic {
+			kind = "dynamic module"
+		}
+
+		if m.Tarball != "" {
+			log.Printf("  %s %s from %s (sha256 %s)", kind, m.Name, m.Tarball, m.SHA256)
+		} else {
+			log.Printf("  %s %s from %s at %s", kind, m.Name, m.Git, m.Ref)
+		}
+	}
+
+	if p.Lock != nil {
+		log.Printf("All sources have to match %s", LockfileName)
+	}
+
+	for _, patch := range p.Patches {
+		log.Printf("Patch to apply: %s (%s) to %s", patch.Name, patch.Path(), patch.Component)
+	}
+
+	log.Printf("Build profile: %s", p.Profile)
+	log.Printf("Hardening: %s", p.Hardening)
+	log.Printf("Configure arguments:\n  ./configure %s", strings.Join(p.ConfigureArguments, " \\\n    "))
+
+	if p.KeepReleases > 0 {
+		log.Printf("NginX is installed as new release below %s, keeping the %d newest releases", ReleasesDir, p.KeepReleases)
+	} else {
+		log.Printf("NginX is installed as new release below %s, old releases are kept", ReleasesDir)
+	}
+
+	if p.Canary {
+		log.Println("The new build has to pass a canary with the live configuration before it is activated")
+	}
+
+	if p.Provisioning == nil {
+		log.Println("Upgrade only, the NginX file structure remains untouched")
+		return
+	}
+
+	log.Printf("Users to create: %s", strings.Join(p.Provisioning.Users, ", "))
+	log.Printf("Directories to create: %s", strings.Join(p.Provisioning.Directories, ", "))
+	for _, f := range p.Provisioning.Files {
+		log.Printf("File to install: %s -> %s", f.Source, f.Destination)
+	}
+	for _, cmd := range p.Provisioning.Commands {
+		log.Printf("Command to run: %s", cmd)
+	}
+	if p.Provisioning.HTTP3 {
+		log.Println("QUIC listeners and Alt-Svc headers are enabled in the delivered configuration")
+	}
+}
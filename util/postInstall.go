@@ -1,67 +1,100 @@
 package util
 
 import (
-	"log"
+	"io/ioutil"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strings"
 )
 
-// SetupNginxUser creates the nginx group and user and assigns ownership to nginx directories
-func SetupNginxUser() {
-	err := exec.Command("useradd", "--shell", "/bin/false", "--home", "/dev/null", "nginx").Run()
+const nginxUser = "nginx"
+const initDScriptURL = "https://raw.githubusercontent.com/Fleshgrinder/nginx-sysvinit-script/master/init"
+const dhParamsPath = "/etc/nginx/ssl/dhparam.pem"
+const http3Marker = "# http3"
 
-	if err != nil {
-		log.Printf("Failed creating 'nginx' user. Does he already exist? Error: %s", err)
-	}
-}
+// installedUnitPath is the location of the systemd unit for installs, packages use SystemdUnitPath
+const installedUnitPath = "/lib/systemd/system/nginx.service"
 
-// SetupSystemd sets up the recommended nginx.service file
-func SetupSystemd() {
-	CopyFile("files/nginx.service", "/lib/systemd/system/nginx.service")
+var nginxDirectories = []string{"/var/www/", "/var/cache/nginx", "/var/log/nginx"}
 
-	// reload systemd daemon
-	err := exec.Command("systemctl", "daemon-reload").Run()
-	if err != nil {
-		log.Printf("Failed reloading systemctl daemon Error: %s", err)
-	}
+// FileCopy describes a file or directory installed by the post install steps
+type FileCopy struct {
+	// Source is a local path or URL
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
 }
 
-// SetupInitD downloads the recommended LSB compliant init.d script for NginX
-func SetupInitD() {
-	DownloadFile("https://raw.githubusercontent.com/Fleshgrinder/nginx-sysvinit-script/master/init", "/etc/init.d/nginx")
-	err := exec.Command("chmod", "+x", "/etc/init.d/nginx").Run()
-	if err != nil {
-		log.Printf("Failed assigning write privilege to /etc/init.d/nginx Error: %s", err)
-	}
+// Provisioning describes the changes the post install steps apply to the system
+type Provisioning struct {
+	Users       []string   `json:"users"`
+	Directories []string   `json:"directories"`
+	Files       []FileCopy `json:"files"`
+	Commands    []string   `json:"commands"`
+	// HTTP3 enables the QUIC listeners and Alt-Svc headers of the delivered configuration
+	HTTP3 bool `json:"http3"`
 }
 
-// SetupFileStructure creates all required folder for NginX and moves the delivered nginx file structure to /etc/nginx
-func SetupFileStructure() {
-	err := os.MkdirAll("/var/www/", os.ModeDir)
+// PostInstallProvisioning returns the changes made by the post install steps
+func PostInstallProvisioning() *Provisioning {
+	return &Provisioning{
+		Users:       []string{nginxUser},
+		Directories: nginxDirectories,
+		Files: []FileCopy{
+			{"files/nginx.service", installedUnitPath},
+			{initDScriptURL, "/etc/init.d/nginx"},
+			{"nginx", "/etc/nginx"},
+		},
+		Commands: []string{
+			"archive /etc/nginx, " + installedUnitPath + " and /etc/init.d/nginx below " + BackupsDir + " (before replacing or moving them)",
+			"mv /etc/nginx /etc/nginx-default (if /etc/nginx hasn't been installed by SecNginX)",
+			"systemctl daemon-reload (if nginx.service changed)",
+			"openssl dhparam -dsaparam -out " + dhParamsPath + " 4096 (if missing)",
+		},
+	}
+}
 
-	// only check for error once, because it's most probable a problem of missing access rights
-	if err != nil {
-		log.Printf("Failed creating /var/www/ directory Error: %s", err)
+// Resources returns the resources reconciled by the post install steps, the delivered files are taken from dir
+func (p *Provisioning) Resources(dir string) []Resource {
+	resources := []Resource{}
+	for _, user := range p.Users {
+		resources = append(resources, &UserResource{User: user})
+	}
+	for _, dir := range p.Directories {
+		resources = append(resources, &DirectoryResource{Path: dir, Mode: 0755})
 	}
 
-	os.MkdirAll("/var/cache/nginx", os.ModeDir)
-	os.MkdirAll("/var/log/nginx", os.ModeDir)
-	err = exec.Command("mv", "/etc/nginx", "/etc/nginx-default").Run()
+	return append(resources,
+		&FileResource{Path: installedUnitPath, Source: filepath.Join(dir, "files/nginx.service"), Mode: 0644, OnChange: []string{"systemctl", "daemon-reload"}},
+		&FileResource{Path: "/etc/init.d/nginx", Source: initDScriptURL, Mode: 0755},
+		&ConfigResource{Path: "/etc/nginx", Source: filepath.Join(dir, "nginx"), Backup: "/etc/nginx-default", HTTP3: p.HTTP3},
+		&DHParamsResource{Path: dhParamsPath, Bits: 4096},
+	)
+}
 
-	// copy our nginx template folder to /etc/nginx
-	err = exec.Command("cp", "-r", "nginx", "/etc/nginx").Run()
+// RenderConfigTemplates prepares the delivered configuration below dir: lines marked with '# http3' are kept
+// (without marker) for HTTP/3 builds and removed otherwise
+func RenderConfigTemplates(dir string, http3 bool) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) != ".conf" {
+			return err
+		}
 
-	if err != nil {
-		log.Printf("Failed copying 'nginx' folder to /etc/nginx Error: %s", err)
-	}
-}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
 
-// GenerateDHParams for NginX DHE key exchange (strength of 4096bit)
-// using -dsaparam to disable prime number check => speedup (but not less secure!)
-func GenerateDHParams() {
-	err := exec.Command("openssl", "dhparam", "-dsaparam", "-out", "/etc/nginx/ssl/dhparam.pem", "4096").Run()
+		lines := []string{}
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasSuffix(line, http3Marker) {
+				if !http3 {
+					continue
+				}
+				line = strings.TrimRight(strings.TrimSuffix(line, http3Marker), " ")
+			}
+			lines = append(lines, line)
+		}
 
-	if err != nil {
-		log.Printf("Failed creating OpenSSL DHParam Error: %s", err)
-	}
+		return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), info.Mode())
+	})
 }
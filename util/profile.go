@@ -0,0 +1,87 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BuildProfile holds the optimization settings NginX and its libraries are built with, set via build_profile
+// and the [performance] table in the toml config
+type BuildProfile struct {
+	// Name is either default or performance
+	Name string `json:"name"`
+	// March is passed as -march, e.g. native. Binaries built with native aren't portable to other CPUs
+	March string `mapstructure:"march" json:"march,omitempty"`
+	// LTO enables link time optimization of NginX
+	LTO bool `mapstructure:"lto" json:"lto"`
+	// OpenSSLOptions are passed to OpenSSL's configure script, e.g. enable-ktls or no-weak-ssl-ciphers
+	OpenSSLOptions []string `mapstructure:"openssl_options" json:"openssl_options,omitempty"`
+	// Jobs is the parallelism of make
+	Jobs int `json:"jobs"`
+}
+
+// Validate checks the profile settings
+func (p BuildProfile) Validate() error {
+	if p.Name != "default" && p.Name != "performance" {
+		return fmt.Errorf("unknown build_profile %s, supported are: default, performance", p.Name)
+	}
+
+	if p.Jobs < 1 {
+		return fmt.Errorf("make_jobs has to be at least 1")
+	}
+
+	return nil
+}
+
+// Performance checks whether the performance profile has been selected
+func (p BuildProfile) Performance() bool {
+	return p.Name == "performance"
+}
+
+// LibraryOptions returns the compiler flags of NginX and the libraries it builds (PCRE, ZLib and OpenSSL)
+func (p BuildProfile) LibraryOptions() []string {
+	if !p.Performance() {
+		return []string{}
+	}
+
+	opts := []string{"-O3"}
+	if p.March != "" {
+		opts = append(opts, "-march="+p.March)
+	}
+
+	return opts
+}
+
+// CCOptions returns the compiler flags of NginX
+func (p BuildProfile) CCOptions() []string {
+	opts := p.LibraryOptions()
+	if p.Performance() && p.LTO {
+		opts = append(opts, "-flto")
+	}
+
+	return opts
+}
+
+// LDOptions returns the linker flags of NginX
+func (p BuildProfile) LDOptions() []string {
+	if p.Performance() && p.LTO {
+		return []string{"-flto"}
+	}
+
+	return []string{}
+}
+
+// String returns a summary of the chosen options
+func (p BuildProfile) String() string {
+	if !p.Performance() {
+		return fmt.Sprintf("default (make -j%d)", p.Jobs)
+	}
+
+	opts := p.CCOptions()
+	if len(p.OpenSSLOptions) > 0 {
+		opts = append(opts, "OpenSSL: "+strings.Join(p.OpenSSLOptions, " "))
+	}
+	opts = append(opts, fmt.Sprintf("make -j%d", p.Jobs))
+
+	return "performance (" + strings.Join(opts, ", ") + ")"
+}
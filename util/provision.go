@@ -0,0 +1,484 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Resource is a piece of system state managed by the post install steps
+type Resource interface {
+	// Name identifies the resource in reports, e.g. "user nginx"
+	Name() string
+	// Check compares the system with the desired state and returns the differences, none if it is in sync
+	Check() ([]string, error)
+	// Apply brings the system into the desired state
+	Apply() error
+}
+
+// destructive is implemented by resources, which may replace or move existing files
+type destructive interface {
+	// Affects returns the existing paths Apply would replace or move
+	Affects() []string
+}
+
+// Reconcile checks every resource and applies the ones, which aren't in sync. With check set, the differences
+// are only reported. Before the first destructive change, the BackupPaths are archived once. It returns whether
+// any resource has drifted from its desired state
+func Reconcile(resources []Resource, check bool) (bool, error) {
+	drifted := false
+	backedUp := false
+	failed := []string{}
+
+	for _, r := range resources {
+		diff, err := r.Check()
+		if err != nil {
+			log.Printf("%s: check failed Error: %s", r.Name(), err)
+			failed = append(failed, r.Name())
+			continue
+		}
+
+		if len(diff) == 0 {
+			log.Printf("%s: in sync", r.Name())
+			continue
+		}
+
+		drifted = true
+		log.Printf("%s:\n  %s", r.Name(), strings.Join(diff, "\n  "))
+		if check {
+			continue
+		}
+
+		if d, ok := r.(destructive); ok && !backedUp && len(d.Affects()) > 0 {
+			b, err := CreateBackup("provisioning "+r.Name(), BackupPaths)
+			if err != nil {
+				log.Printf("%s: backup failed, not applied Error: %s", r.Name(), err)
+				failed = append(failed, r.Name())
+				continue
+			}
+			if b != nil {
+				log.Printf("Backed up %s as %s", strings.Join(b.Paths, ", "), b.ID)
+				pruneBackups()
+			}
+			backedUp = true
+		}
+
+		if err = r.Apply(); err != nil {
+			log.Printf("%s: apply failed Error: %s", r.Name(), err)
+			failed = append(failed, r.Name())
+			continue
+		}
+		log.Printf("%s: applied", r.Name())
+	}
+
+	if len(failed) > 0 {
+		return drifted, fmt.Errorf("failed provisioning %s", strings.Join(failed, ", "))
+	}
+
+	return drifted, nil
+}
+
+// UserResource is a system user with a group of the same name and without login shell
+type UserResource struct {
+	User string
+}
+
+// Name returns the name of the resource
+func (r *UserResource) Name() string {
+	return "user " + r.User
+}
+
+// Check looks the user and the group up in /etc/passwd and /etc/group
+func (r *UserResource) Check() ([]string, error) {
+	diff := []string{}
+
+	group, err := databaseEntry("/etc/group", r.User)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		diff = append(diff, "group "+r.User+" is missing")
+	}
+
+	user, err := databaseEntry("/etc/passwd", r.User)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return append(diff, "user "+r.User+" is missing"), nil
+	}
+
+	if len(user) == 7 && !noLoginShell(user[6]) {
+		diff = append(diff, fmt.Sprintf("user %s has the login shell %s", r.User, user[6]))
+	}
+
+	return diff, nil
+}
+
+// Apply creates the missing group and user using the tools of either shadow or busybox (Alpine) and
+// removes the login shell
+func (r *UserResource) Apply() error {
+	if group, err := databaseEntry("/etc/group", r.User); err != nil {
+		return err
+	} else if group == nil {
+		if err = runFirst([]string{"groupadd", "--system", r.User}, []string{"addgroup", "-S", r.User}); err != nil {
+			return err
+		}
+	}
+
+	user, err := databaseEntry("/etc/passwd", r.User)
+	if err != nil {
+		return err
+	}
+
+	if user == nil {
+		return runFirst(
+			[]string{"useradd", "--system", "--gid", r.User, "--shell", "/bin/false", "--home-dir", "/dev/null", r.User},
+			[]string{"adduser", "-S", "-D", "-H", "-h", "/dev/null", "-s", "/bin/false", "-G", r.User, r.User},
+		)
+	}
+
+	if len(user) == 7 && !noLoginShell(user[6]) {
+		return runFirst([]string{"usermod", "--shell", "/bin/false", r.User})
+	}
+
+	return nil
+}
+
+// databaseEntry returns the fields of the entry with the given name in /etc/passwd or /etc/group, nil if missing
+func databaseEntry(path, name string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Split(line, ":"); fields[0] == name {
+			return fields, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func noLoginShell(shell string) bool {
+	return shell == "/bin/false" || shell == "/sbin/nologin" || shell == "/usr/sbin/nologin"
+}
+
+// runFirst runs the first of the commands, which is installed
+func runFirst(commands ...[]string) error {
+	for _, cmd := range commands {
+		if _, err := exec.LookPath(cmd[0]); err != nil {
+			continue
+		}
+
+		if out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s failed: %s %s", cmd[0], err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%s isn't installed", commands[0][0])
+}
+
+// DirectoryResource is a directory, which has to exist
+type DirectoryResource struct {
+	Path string
+	Mode os.FileMode
+}
+
+// Name returns the name of the resource
+func (r *DirectoryResource) Name() string {
+	return "directory " + r.Path
+}
+
+// Check tests whether the directory exists, its mode is left to the administrator
+func (r *DirectoryResource) Check() ([]string, error) {
+	info, err := os.Stat(r.Path)
+	if os.IsNotExist(err) {
+		return []string{r.Path + " is missing"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s exists, but isn't a directory", r.Path)
+	}
+
+	return nil, nil
+}
+
+// Apply creates the directory and its parents
+func (r *DirectoryResource) Apply() error {
+	return os.MkdirAll(r.Path, r.Mode)
+}
+
+// FileResource is a file installed from a local file or a URL
+type FileResource struct {
+	Path string
+	// Source is a local path or a URL. The content of downloaded files isn't compared, checks don't access the network
+	Source string
+	Mode   os.FileMode
+	// OnChange is run after the content has been written, if it's installed
+	OnChange []string
+}
+
+// Name returns the name of the resource
+func (r *FileResource) Name() string {
+	return "file " + r.Path
+}
+
+func (r *FileResource) remote() bool {
+	return strings.HasPrefix(r.Source, "http://") || strings.HasPrefix(r.Source, "https://")
+}
+
+// Check compares the content with the local source and the mode
+func (r *FileResource) Check() ([]string, error) {
+	info, err := os.Stat(r.Path)
+	if os.IsNotExist(err) {
+		return []string{r.Path + " is missing"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	diff := []string{}
+	if changed, err := r.changed(); err != nil {
+		return nil, err
+	} else if changed {
+		diff = append(diff, fmt.Sprintf("%s differs from %s", r.Path, r.Source))
+	}
+
+	if info.Mode().Perm() != r.Mode {
+		diff = append(diff, fmt.Sprintf("%s has mode %04o, expected %04o", r.Path, info.Mode().Perm(), r.Mode))
+	}
+
+	return diff, nil
+}
+
+// changed reports whether the content has to be written
+func (r *FileResource) changed() (bool, error) {
+	if r.remote() {
+		return !fileExists(r.Path), nil
+	}
+
+	want, err := ioutil.ReadFile(r.Source)
+	if err != nil {
+		return false, err
+	}
+
+	have, err := ioutil.ReadFile(r.Path)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+
+	return !bytes.Equal(want, have), err
+}
+
+// Affects returns the file, if it exists and its content is going to be replaced
+func (r *FileResource) Affects() []string {
+	if changed, err := r.changed(); err != nil || !changed || !pathExists(r.Path) {
+		return nil
+	}
+
+	return []string{r.Path}
+}
+
+// Apply writes the content, if it changed, and sets the mode
+func (r *FileResource) Apply() error {
+	changed, err := r.changed()
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		if err = os.MkdirAll(filepath.Dir(r.Path), 0755); err != nil {
+			return err
+		}
+
+		if r.remote() {
+			err = DownloadFile(r.Source, r.Path)
+		} else {
+			var data []byte
+			if data, err = ioutil.ReadFile(r.Source); err == nil {
+				err = ioutil.WriteFile(r.Path, data, r.Mode)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = os.Chmod(r.Path, r.Mode); err != nil {
+		return err
+	}
+
+	// e.g. systemctl isn't available on every system
+	if changed && len(r.OnChange) > 0 {
+		if _, err = exec.LookPath(r.OnChange[0]); err == nil {
+			return runFirst(r.OnChange)
+		}
+	}
+
+	return nil
+}
+
+// ConfigResource is the NginX configuration directory, installed from the delivered configuration. Existing
+// files are never overwritten, a configuration not installed by SecNginX is moved to Backup first
+type ConfigResource struct {
+	Path   string
+	Source string
+	Backup string
+	HTTP3  bool
+}
+
+// Name returns the name of the resource
+func (r *ConfigResource) Name() string {
+	return "configuration " + r.Path
+}
+
+// managed reports whether the configuration directory has been installed by SecNginX
+func (r *ConfigResource) managed() bool {
+	return fileExists(filepath.Join(r.Path, sslBasicConf))
+}
+
+// Check lists the delivered files missing in the configuration directory. Changes of existing files belong to
+// the administrator and aren't reported
+func (r *ConfigResource) Check() ([]string, error) {
+	if !pathExists(r.Path) {
+		return []string{r.Path + " is missing"}, nil
+	}
+
+	if !r.managed() {
+		return []string{fmt.Sprintf("%s hasn't been installed by SecNginX and is moved to %s", r.Path, r.backup())}, nil
+	}
+
+	diff := []string{}
+	err := filepath.Walk(r.Source, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.Name() == ".gitkeep" {
+			return err
+		}
+
+		rel, err := filepath.Rel(r.Source, path)
+		if err != nil {
+			return err
+		}
+
+		if _, err = os.Lstat(filepath.Join(r.Path, rel)); os.IsNotExist(err) {
+			diff = append(diff, filepath.Join(r.Path, rel)+" is missing")
+		}
+		return nil
+	})
+
+	return diff, err
+}
+
+// backup returns the path foreign configurations are moved to, existing backups are never replaced
+func (r *ConfigResource) backup() string {
+	if !pathExists(r.Backup) {
+		return r.Backup
+	}
+
+	return r.Backup + "-" + time.Now().Format("20060102150405")
+}
+
+// Affects returns the configuration directory, if it is a foreign one. Managed ones are only added to
+func (r *ConfigResource) Affects() []string {
+	if !pathExists(r.Path) || r.managed() {
+		return nil
+	}
+
+	return []string{r.Path}
+}
+
+// Apply moves a foreign configuration away and adds the missing delivered files, rendered for the HTTP/3 setting
+func (r *ConfigResource) Apply() error {
+	if pathExists(r.Path) && !r.managed() {
+		backup := r.backup()
+		if err := os.Rename(r.Path, backup); err != nil {
+			return err
+		}
+		log.Printf("Moved the existing configuration %s to %s", r.Path, backup)
+	}
+
+	rendered, err := ioutil.TempDir("", "secnginx-conf")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(rendered)
+
+	if out, err := exec.Command("cp", "-a", r.Source+"/.", rendered).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed copying %s: %s %s", r.Source, err, strings.TrimSpace(string(out)))
+	}
+
+	if err = RenderConfigTemplates(rendered, r.HTTP3); err != nil {
+		return err
+	}
+
+	return MergeTree(rendered, r.Path)
+}
+
+// pathExists reports whether a file, directory or symlink exists at path
+func pathExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// DHParamsResource are the DH parameters for the DHE key exchange
+type DHParamsResource struct {
+	Path string
+	Bits int
+}
+
+// Name returns the name of the resource
+func (r *DHParamsResource) Name() string {
+	return "DH parameters " + r.Path
+}
+
+// Check tests whether the parameters exist, they are never regenerated
+func (r *DHParamsResource) Check() ([]string, error) {
+	info, err := os.Stat(r.Path)
+	if os.IsNotExist(err) {
+		return []string{r.Path + " is missing"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Size() == 0 {
+		return []string{r.Path + " is empty"}, nil
+	}
+
+	return nil, nil
+}
+
+// Apply generates the parameters using -dsaparam, which skips the prime number check. It's considerably faster,
+// but not less secure
+func (r *DHParamsResource) Apply() error {
+	log.Println("Generating strong DHParams, this may take a while")
+
+	if err := os.MkdirAll(filepath.Dir(r.Path), 0755); err != nil {
+		return err
+	}
+
+	return runFirst([]string{"openssl", "dhparam", "-dsaparam", "-out", r.Path, fmt.Sprint(r.Bits)})
+}
+
+// pruneBackups removes the backups exceeding KeepBackups
+func pruneBackups() {
+	removed, err := PruneBackups(KeepBackups)
+	if err != nil {
+		log.Printf("Failed pruning old backups Error: %s", err)
+	}
+
+	for _, id := range removed {
+		log.Printf("Removed old backup %s", id)
+	}
+}
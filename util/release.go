@@ -0,0 +1,273 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ReleasesDir holds the versioned installs, one directory per release
+const ReleasesDir = "/opt/secnginx"
+
+// DefaultKeepReleases is the number of releases kept when pruning, if keep_releases isn't set
+const DefaultKeepReleases = 3
+
+const (
+	releaseManifestName = "release.json"
+	// currentLink and previousLink below ReleasesDir point to the active and the previously active release
+	currentLink  = "current"
+	previousLink = "previous"
+)
+
+// Release is a versioned install of NginX below ReleasesDir, holding the NginX binary and the dynamic modules.
+// The sbin and modules path of NginX are symlinks into the active release
+type Release struct {
+	// ID is <nginx version>-<tls library>-<tls version>-<hash of the binary>
+	ID           string    `json:"id"`
+	Created      time.Time `json:"created"`
+	NginXVersion string    `json:"nginx_version"`
+	TLSLibrary   string    `json:"tls_library"`
+	TLSVersion   string    `json:"tls_version"`
+	// SbinPath, ModulesPath and ConfPath are the --sbin-path, --modules-path and --conf-path of NginX
+	SbinPath       string          `json:"sbin_path"`
+	ModulesPath    string          `json:"modules_path"`
+	ConfPath       string          `json:"conf_path"`
+	DynamicModules []DynamicModule `json:"dynamic_modules"`
+}
+
+// SetID derives the release ID from the versions and the digest of the given NginX binary
+func (r *Release) SetID(binary string) error {
+	digest, err := FileSHA256(binary)
+	if err != nil {
+		return err
+	}
+
+	r.ID = fmt.Sprintf("%s-%s-%s-%s", r.NginXVersion, r.TLSLibrary, r.TLSVersion, digest[:8])
+	return nil
+}
+
+// Dir returns the directory of the release
+func (r *Release) Dir() string {
+	return filepath.Join(ReleasesDir, r.ID)
+}
+
+// Binary returns the path of the NginX binary inside the release
+func (r *Release) Binary() string {
+	return filepath.Join(r.Dir(), "sbin", filepath.Base(r.SbinPath))
+}
+
+// Modules returns the directory of the dynamic modules inside the release
+func (r *Release) Modules() string {
+	return filepath.Join(r.Dir(), "modules")
+}
+
+// Write stores the release description in the release directory
+func (r *Release) Write() error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(r.Dir(), releaseManifestName), data, 0644)
+}
+
+// Releases returns all installed releases, oldest first
+func Releases() ([]*Release, error) {
+	entries, err := ioutil.ReadDir(ReleasesDir)
+	if os.IsNotExist(err) {
+		return []*Release{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	releases := []*Release{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(ReleasesDir, e.Name(), releaseManifestName))
+		if err != nil {
+			continue
+		}
+
+		r := &Release{}
+		if err = json.Unmarshal(data, r); err != nil {
+			return nil, fmt.Errorf("invalid %s of release %s: %s", releaseManifestName, e.Name(), err)
+		}
+		releases = append(releases, r)
+	}
+
+	sort.SliceStable(releases, func(i, j int) bool { return releases[i].Created.Before(releases[j].Created) })
+	return releases, nil
+}
+
+// GetRelease returns the installed release with the given ID
+func GetRelease(id string) (*Release, error) {
+	releases, err := Releases()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range releases {
+		if r.ID == id {
+			return r, nil
+		}
+	}
+
+	return nil, fmt.Errorf("release %s isn't installed, see 'secnginx versions'", id)
+}
+
+// CurrentRelease returns the ID of the active release, empty if none is active
+func CurrentRelease() string {
+	return releaseLink(currentLink)
+}
+
+// PreviousRelease returns the ID of the previously active release, empty if there is none
+func PreviousRelease() string {
+	return releaseLink(previousLink)
+}
+
+func releaseLink(name string) string {
+	target, err := os.Readlink(filepath.Join(ReleasesDir, name))
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Base(target)
+}
+
+// ReleaseOfBinary returns the ID of the release containing the binary, empty if it isn't part of a release
+func ReleaseOfBinary(binary string) string {
+	rel, err := filepath.Rel(ReleasesDir, binary)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+
+	id := strings.Split(rel, string(filepath.Separator))[0]
+	if id == currentLink || id == previousLink {
+		return releaseLink(id)
+	}
+
+	return id
+}
+
+// Activate makes the release the active one. The current link is replaced atomically, the previously active
+// release is remembered for rollbacks. On the first activation, the sbin and modules path of NginX are replaced
+// by symlinks into the current link, existing files are kept with the suffix .old
+func (r *Release) Activate() error {
+	current := filepath.Join(ReleasesDir, currentLink)
+
+	if err := linkInto(r.SbinPath, filepath.Join(current, "sbin", filepath.Base(r.SbinPath))); err != nil {
+		return err
+	}
+	if err := linkInto(r.ModulesPath, filepath.Join(current, "modules")); err != nil {
+		return err
+	}
+
+	previous := CurrentRelease()
+	if previous == r.ID {
+		return nil
+	}
+
+	if err := replaceSymlink(r.ID, current); err != nil {
+		return err
+	}
+
+	if previous != "" {
+		return replaceSymlink(previous, filepath.Join(ReleasesDir, previousLink))
+	}
+
+	return nil
+}
+
+// Remove deletes the release directory. The active and the previous release can't be removed
+func (r *Release) Remove() error {
+	if r.ID == CurrentRelease() || r.ID == PreviousRelease() {
+		return fmt.Errorf("release %s is in use and can't be removed", r.ID)
+	}
+
+	return os.RemoveAll(r.Dir())
+}
+
+// PruneReleases removes the oldest releases, keeping the given number of releases as well as the active
+// and the previous release. It returns the IDs of the removed releases
+func PruneReleases(keep int) ([]string, error) {
+	releases, err := Releases()
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+	current, previous := CurrentRelease(), PreviousRelease()
+	for i := 0; i < len(releases)-keep; i++ {
+		if releases[i].ID == current || releases[i].ID == previous {
+			continue
+		}
+
+		if err = releases[i].Remove(); err != nil {
+			return removed, err
+		}
+		removed = append(removed, releases[i].ID)
+	}
+
+	return removed, nil
+}
+
+// linkInto replaces path by a symlink to target, unless it already is one. Existing files are renamed to path.old
+func linkInto(path, target string) error {
+	if existing, err := os.Readlink(path); err == nil && existing == target {
+		return nil
+	}
+
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSymlink != 0 {
+			if err = os.Remove(path); err != nil {
+				return err
+			}
+		} else if err = os.Rename(path, path+".old"); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return os.Symlink(target, path)
+}
+
+// replaceSymlink atomically points the symlink at path to target
+func replaceSymlink(target, path string) error {
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// RestoreReleases points the current and previous link to the given releases, e.g. to revert a failed switch
+func RestoreReleases(current, previous string) error {
+	if err := replaceSymlink(current, filepath.Join(ReleasesDir, currentLink)); err != nil {
+		return err
+	}
+
+	if previous == "" {
+		err := os.Remove(filepath.Join(ReleasesDir, previousLink))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return replaceSymlink(previous, filepath.Join(ReleasesDir, previousLink))
+}
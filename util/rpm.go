@@ -0,0 +1,458 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+// rpm header data types
+const (
+	rpmInt16       = 3
+	rpmInt32       = 4
+	rpmString      = 6
+	rpmBinary      = 7
+	rpmStringArray = 8
+	rpmI18NString  = 9
+)
+
+// rpm header tags, see rpmtag.h
+const (
+	rpmTagHeaderSignatures  = 62
+	rpmTagHeaderImmutable   = 63
+	rpmTagI18NTable         = 100
+	rpmSigTagSHA1           = 269
+	rpmSigTagSHA256         = 273
+	rpmSigTagSize           = 1000
+	rpmSigTagMD5            = 1004
+	rpmSigTagPayloadSize    = 1007
+	rpmTagName              = 1000
+	rpmTagVersion           = 1001
+	rpmTagRelease           = 1002
+	rpmTagSummary           = 1004
+	rpmTagDescription       = 1005
+	rpmTagBuildTime         = 1006
+	rpmTagBuildHost         = 1007
+	rpmTagSize              = 1009
+	rpmTagLicense           = 1014
+	rpmTagPackager          = 1015
+	rpmTagGroup             = 1016
+	rpmTagURL               = 1020
+	rpmTagOS                = 1021
+	rpmTagArch              = 1022
+	rpmTagPreIn             = 1023
+	rpmTagPostIn            = 1024
+	rpmTagPostUn            = 1026
+	rpmTagFileSizes         = 1028
+	rpmTagFileModes         = 1030
+	rpmTagFileRDevs         = 1033
+	rpmTagFileMTimes        = 1034
+	rpmTagFileDigests       = 1035
+	rpmTagFileLinkTos       = 1036
+	rpmTagFileFlags         = 1037
+	rpmTagFileUserName      = 1039
+	rpmTagFileGroupName     = 1040
+	rpmTagSourceRPM         = 1044
+	rpmTagProvideName       = 1047
+	rpmTagRequireFlags      = 1048
+	rpmTagRequireName       = 1049
+	rpmTagRequireVersion    = 1050
+	rpmTagPreInProg         = 1085
+	rpmTagPostInProg        = 1086
+	rpmTagPostUnProg        = 1088
+	rpmTagFileDevices       = 1095
+	rpmTagFileINodes        = 1096
+	rpmTagFileLangs         = 1097
+	rpmTagProvideFlags      = 1112
+	rpmTagProvideVersion    = 1113
+	rpmTagDirIndexes        = 1116
+	rpmTagBaseNames         = 1117
+	rpmTagDirNames          = 1118
+	rpmTagPayloadFormat     = 1124
+	rpmTagPayloadCompressor = 1125
+	rpmTagPayloadFlags      = 1126
+	rpmTagFileDigestAlgo    = 5011
+	rpmTagPayloadDigest     = 5092
+	rpmTagPayloadDigestAlgo = 5093
+)
+
+const (
+	rpmFileConfig    = 1 << 0
+	rpmFileNoReplace = 1 << 4
+
+	rpmSenseLess         = 1 << 1
+	rpmSenseEqual        = 1 << 3
+	rpmSenseInterp       = 1 << 8
+	rpmSenseScriptPre    = 1 << 9
+	rpmSenseScriptPost   = 1 << 10
+	rpmSenseScriptPostUn = 1 << 12
+	rpmSenseRPMLib       = 1 << 24
+
+	// rpmHashSHA256 is PGPHASHALGO_SHA256
+	rpmHashSHA256 = 8
+)
+
+var rpmHeaderMagic = []byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0}
+
+type rpmEntry struct {
+	tag, typ, count uint32
+	data            []byte
+}
+
+// rpmHeader is a header structure, as used for the signature and the main header of rpm packages
+type rpmHeader struct {
+	entries []rpmEntry
+}
+
+func (h *rpmHeader) add(tag, typ uint32, count int, data []byte) {
+	h.entries = append(h.entries, rpmEntry{tag, typ, uint32(count), data})
+}
+
+func (h *rpmHeader) addString(tag uint32, value string) {
+	h.add(tag, rpmString, 1, append([]byte(value), 0))
+}
+
+func (h *rpmHeader) addI18NString(tag uint32, value string) {
+	h.add(tag, rpmI18NString, 1, append([]byte(value), 0))
+}
+
+func (h *rpmHeader) addStrings(tag uint32, values []string) {
+	var data []byte
+	for _, v := range values {
+		data = append(append(data, v...), 0)
+	}
+	h.add(tag, rpmStringArray, len(values), data)
+}
+
+func (h *rpmHeader) addBinary(tag uint32, data []byte) {
+	h.add(tag, rpmBinary, len(data), data)
+}
+
+func (h *rpmHeader) addInt32(tag uint32, values ...uint32) {
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(data[4*i:], v)
+	}
+	h.add(tag, rpmInt32, len(values), data)
+}
+
+func (h *rpmHeader) addInt16(tag uint32, values ...uint16) {
+	data := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint16(data[2*i:], v)
+	}
+	h.add(tag, rpmInt16, len(values), data)
+}
+
+// marshal returns the binary header, sealed by the given region tag
+func (h *rpmHeader) marshal(regionTag uint32) []byte {
+	sort.SliceStable(h.entries, func(i, j int) bool { return h.entries[i].tag < h.entries[j].tag })
+
+	alignment := map[uint32]int{rpmInt16: 2, rpmInt32: 4}
+	index := &bytes.Buffer{}
+	store := &bytes.Buffer{}
+
+	writeIndex := func(tag, typ uint32, offset int32, count uint32) {
+		binary.Write(index, binary.BigEndian, []uint32{tag, typ, uint32(offset), count})
+	}
+
+	entries := uint32(len(h.entries) + 1)
+	for _, e := range h.entries {
+		if align := alignment[e.typ]; align > 0 {
+			for store.Len()%align != 0 {
+				store.WriteByte(0)
+			}
+		}
+		writeIndex(e.tag, e.typ, int32(store.Len()), e.count)
+		store.Write(e.data)
+	}
+
+	// the region trailer references all index entries by a negative offset and is referenced by the first entry
+	region := &bytes.Buffer{}
+	binary.Write(region, binary.BigEndian, []uint32{regionTag, rpmBinary, uint32(-int32(entries * 16)), 16})
+	regionIndex := &bytes.Buffer{}
+	binary.Write(regionIndex, binary.BigEndian, []uint32{regionTag, rpmBinary, uint32(store.Len()), 16})
+	store.Write(region.Bytes())
+
+	out := &bytes.Buffer{}
+	out.Write(rpmHeaderMagic)
+	binary.Write(out, binary.BigEndian, []uint32{entries, uint32(store.Len())})
+	out.Write(regionIndex.Bytes())
+	out.Write(index.Bytes())
+	out.Write(store.Bytes())
+
+	return out.Bytes()
+}
+
+// writeRPM writes the package as rpm: lead, signature header, header and a gzip compressed cpio payload
+func (p *Package) writeRPM(w io.Writer) error {
+	files := make([]PackageFile, 0, len(p.Files))
+	for _, f := range p.Files {
+		if !f.Mode.IsDir() || !systemDirectories[f.Path] {
+			files = append(files, f)
+		}
+	}
+	// rpm looks up files by a binary search over the full paths
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	payload, payloadSize, err := p.rpmPayload(files)
+	if err != nil {
+		return err
+	}
+
+	header, err := p.rpmHeader(files, payload)
+	if err != nil {
+		return err
+	}
+
+	digest := md5.New()
+	digest.Write(header)
+	digest.Write(payload)
+	sha1Header := sha1.Sum(header)
+	sha256Header := sha256.Sum256(header)
+
+	signature := &rpmHeader{}
+	signature.addString(rpmSigTagSHA1, hex.EncodeToString(sha1Header[:]))
+	signature.addString(rpmSigTagSHA256, hex.EncodeToString(sha256Header[:]))
+	signature.addInt32(rpmSigTagSize, uint32(len(header)+len(payload)))
+	signature.addBinary(rpmSigTagMD5, digest.Sum(nil))
+	signature.addInt32(rpmSigTagPayloadSize, uint32(payloadSize))
+	sig := signature.marshal(rpmTagHeaderSignatures)
+	// the signature header is padded to 8 bytes
+	sig = append(sig, make([]byte, (8-len(sig)%8)%8)...)
+
+	for _, part := range [][]byte{p.rpmLead(), sig, header, payload} {
+		if _, err = w.Write(part); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rpmLead returns the legacy lead, which is ignored by current rpm versions besides the magic
+func (p *Package) rpmLead() []byte {
+	lead := make([]byte, 96)
+	copy(lead, []byte{0xed, 0xab, 0xee, 0xdb, 3, 0})
+	// type binary, architecture number
+	archnum := uint16(1)
+	if PackageArch("rpm") == "aarch64" {
+		archnum = 19
+	}
+	binary.BigEndian.PutUint16(lead[8:], archnum)
+	copy(lead[10:75], fmt.Sprintf("%s-%s-%d", p.Name, p.Version, p.Release))
+	// os linux, signature type header
+	binary.BigEndian.PutUint16(lead[76:], 1)
+	binary.BigEndian.PutUint16(lead[78:], 5)
+
+	return lead
+}
+
+// rpmHeader returns the main header describing the package, its files and scripts
+func (p *Package) rpmHeader(files []PackageFile, payload []byte) ([]byte, error) {
+	h := &rpmHeader{}
+	release := fmt.Sprint(p.Release)
+	hostname, _ := os.Hostname()
+
+	h.addStrings(rpmTagI18NTable, []string{"C"})
+	h.addString(rpmTagName, p.Name)
+	h.addString(rpmTagVersion, p.Version)
+	h.addString(rpmTagRelease, release)
+	h.addI18NString(rpmTagSummary, p.Summary)
+	h.addI18NString(rpmTagDescription, p.Description)
+	h.addInt32(rpmTagBuildTime, uint32(p.BuildTime.Unix()))
+	h.addString(rpmTagBuildHost, hostname)
+	h.addInt32(rpmTagSize, uint32(p.InstalledSize()))
+	h.addString(rpmTagLicense, p.License)
+	h.addString(rpmTagPackager, p.Maintainer)
+	h.addI18NString(rpmTagGroup, "System Environment/Daemons")
+	h.addString(rpmTagURL, p.URL)
+	h.addString(rpmTagOS, "linux")
+	h.addString(rpmTagArch, PackageArch("rpm"))
+	// rpm treats packages without source rpm as source packages
+	h.addString(rpmTagSourceRPM, fmt.Sprintf("%s-%s-%s.src.rpm", p.Name, p.Version, release))
+
+	h.addString(rpmTagPreIn, p.PreInstall)
+	h.addString(rpmTagPreInProg, "/bin/sh")
+	h.addString(rpmTagPostIn, p.PostInstall)
+	h.addString(rpmTagPostInProg, "/bin/sh")
+	h.addString(rpmTagPostUn, p.PostRemove)
+	h.addString(rpmTagPostUnProg, "/bin/sh")
+
+	h.addStrings(rpmTagProvideName, []string{p.Name})
+	h.addInt32(rpmTagProvideFlags, rpmSenseEqual)
+	h.addStrings(rpmTagProvideVersion, []string{p.Version + "-" + release})
+
+	h.addStrings(rpmTagRequireName, []string{"/bin/sh", "rpmlib(CompressedFileNames)", "rpmlib(FileDigests)",
+		"rpmlib(PayloadFilesHavePrefix)"})
+	rpmlib := uint32(rpmSenseRPMLib | rpmSenseLess | rpmSenseEqual)
+	h.addInt32(rpmTagRequireFlags, rpmSenseInterp|rpmSenseScriptPre|rpmSenseScriptPost|rpmSenseScriptPostUn, rpmlib,
+		rpmlib, rpmlib)
+	h.addStrings(rpmTagRequireVersion, []string{"", "3.0.4-1", "4.6.0-1", "4.0-1"})
+
+	var sizes, mtimes, flags, devices, inodes, dirIndexes []uint32
+	var modes, rdevs []uint16
+	var digests, links, users, groups, langs, baseNames, dirNames []string
+	dirs := map[string]uint32{}
+
+	for i, f := range files {
+		digest := ""
+		if f.Mode.IsRegular() {
+			var err error
+			if digest, err = FileSHA256(p.Source(f)); err != nil {
+				return nil, err
+			}
+		}
+
+		var flag uint32
+		if f.Conffile {
+			flag = rpmFileConfig | rpmFileNoReplace
+		}
+
+		dir := path.Dir(f.Path)
+		if dir != "/" {
+			dir += "/"
+		}
+		if _, ok := dirs[dir]; !ok {
+			dirs[dir] = uint32(len(dirNames))
+			dirNames = append(dirNames, dir)
+		}
+
+		size := uint32(f.Size)
+		if f.LinkTarget != "" {
+			size = uint32(len(f.LinkTarget))
+		}
+
+		sizes = append(sizes, size)
+		modes = append(modes, uint16(cpioMode(f)))
+		rdevs = append(rdevs, 0)
+		mtimes = append(mtimes, uint32(f.ModTime.Unix()))
+		digests = append(digests, digest)
+		links = append(links, f.LinkTarget)
+		flags = append(flags, flag)
+		users = append(users, "root")
+		groups = append(groups, "root")
+		devices = append(devices, 1)
+		inodes = append(inodes, uint32(i+1))
+		langs = append(langs, "")
+		dirIndexes = append(dirIndexes, dirs[dir])
+		baseNames = append(baseNames, path.Base(f.Path))
+	}
+
+	h.addInt32(rpmTagFileSizes, sizes...)
+	h.addInt16(rpmTagFileModes, modes...)
+	h.addInt16(rpmTagFileRDevs, rdevs...)
+	h.addInt32(rpmTagFileMTimes, mtimes...)
+	h.addStrings(rpmTagFileDigests, digests)
+	h.addStrings(rpmTagFileLinkTos, links)
+	h.addInt32(rpmTagFileFlags, flags...)
+	h.addStrings(rpmTagFileUserName, users)
+	h.addStrings(rpmTagFileGroupName, groups)
+	h.addInt32(rpmTagFileDevices, devices...)
+	h.addInt32(rpmTagFileINodes, inodes...)
+	h.addStrings(rpmTagFileLangs, langs)
+	h.addInt32(rpmTagDirIndexes, dirIndexes...)
+	h.addStrings(rpmTagBaseNames, baseNames)
+	h.addStrings(rpmTagDirNames, dirNames)
+	h.addInt32(rpmTagFileDigestAlgo, rpmHashSHA256)
+
+	payloadDigest := sha256.Sum256(payload)
+	h.addString(rpmTagPayloadFormat, "cpio")
+	h.addString(rpmTagPayloadCompressor, "gzip")
+	h.addString(rpmTagPayloadFlags, "9")
+	h.addStrings(rpmTagPayloadDigest, []string{hex.EncodeToString(payloadDigest[:])})
+	h.addInt32(rpmTagPayloadDigestAlgo, rpmHashSHA256)
+
+	return h.marshal(rpmTagHeaderImmutable), nil
+}
+
+// rpmPayload returns the gzip compressed cpio (newc) archive of the files and its uncompressed size
+func (p *Package) rpmPayload(files []PackageFile) ([]byte, int, error) {
+	var buf bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	cpio := &countingWriter{w: gz}
+
+	for i, f := range files {
+		var content []byte
+		var err error
+
+		switch {
+		case f.LinkTarget != "":
+			content = []byte(f.LinkTarget)
+		case f.Mode.IsRegular():
+			if content, err = ioutil.ReadFile(p.Source(f)); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		nlink := 1
+		if f.Mode.IsDir() {
+			nlink = 2
+		}
+
+		if err = writeCpioEntry(cpio, "."+f.Path, uint32(i+1), cpioMode(f), nlink, f.ModTime.Unix(), content); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if err := writeCpioEntry(cpio, "TRAILER!!!", 0, 0, 1, 0, nil); err != nil {
+		return nil, 0, err
+	}
+
+	if err := gz.Close(); err != nil {
+		return nil, 0, err
+	}
+
+	return buf.Bytes(), cpio.n, nil
+}
+
+// writeCpioEntry writes a cpio entry in the "new ASCII" format, names and data are padded to 4 bytes
+func writeCpioEntry(w io.Writer, name string, inode, mode uint32, nlink int, mtime int64, content []byte) error {
+	header := fmt.Sprintf("070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x", inode, mode, 0, 0, nlink,
+		mtime, len(content), 0, 0, 0, 0, len(name)+1, 0)
+
+	entry := append([]byte(header+name), 0)
+	entry = append(entry, make([]byte, (4-len(entry)%4)%4)...)
+	entry = append(entry, content...)
+	entry = append(entry, make([]byte, (4-len(content)%4)%4)...)
+
+	_, err := w.Write(entry)
+	return err
+}
+
+// cpioMode returns the unix file mode, including the file type bits
+func cpioMode(f PackageFile) uint32 {
+	mode := uint32(f.Mode.Perm())
+	switch {
+	case f.Mode.IsDir():
+		mode |= 0040000
+	case f.LinkTarget != "":
+		mode |= 0120000
+	default:
+		mode |= 0100000
+	}
+
+	return mode
+}
+
+// countingWriter counts the bytes written to the underlying writer
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += n
+	return n, err
+}
@@ -0,0 +1,148 @@
+package util
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Source replaces the release tarball of a component, declared as [sources.<component>] table in the toml config.
+// It is either a local directory, a local archive or a git repository
+type Source struct {
+	Path       string `mapstructure:"path" json:"path,omitempty"`
+	Git        string `mapstructure:"git" json:"git,omitempty"`
+	Ref        string `mapstructure:"ref" json:"ref,omitempty"`
+	Submodules bool   `mapstructure:"submodules" json:"submodules"`
+}
+
+// Validate checks whether the source declaration is complete
+func (s *Source) Validate() error {
+	if s.Path == "" && s.Git == "" {
+		return errors.New("either path or git has to be set")
+	}
+
+	if s.Path != "" && s.Git != "" {
+		return errors.New("path and git can't be used together")
+	}
+
+	if s.Git != "" && s.Ref == "" {
+		return errors.New("git sources have to be pinned, please set ref to a tag or commit")
+	}
+
+	if s.Git != "" && isBranchRef(s.Ref) {
+		return fmt.Errorf("ref %s is a branch, please pin a tag or commit", s.Ref)
+	}
+
+	if s.Path != "" && (s.Ref != "" || s.Submodules) {
+		return errors.New("ref and submodules are only supported for git sources")
+	}
+
+	return nil
+}
+
+// Fetch places the source into dest. Git checkouts are cached like git modules
+func (s *Source) Fetch(ctx context.Context, name, dest string, cache *Cache) (LockedSource, error) {
+	if s.Git != "" {
+		source := LockedSource{Name: name, URL: s.Git, Ref: s.Ref}
+
+		var err error
+		source.Commit, err = cache.GitCheckout(ctx, name, s.Git, s.Ref, dest, s.Submodules)
+
+		return source, err
+	}
+
+	path, err := filepath.Abs(s.Path)
+	if err != nil {
+		return LockedSource{}, err
+	}
+	source := LockedSource{Name: name, URL: "file://" + path}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return source, err
+	}
+
+	// copy local source trees, because they are modified by the build
+	if info.IsDir() {
+		return source, exec.Command("cp", "-a", path, dest).Run()
+	}
+
+	source.SHA256, err = FileSHA256(path)
+	if err != nil {
+		return source, err
+	}
+
+	return source, ExtractArchive(path, dest)
+}
+
+// gitCheckout clones the repository into dir, checks out ref and returns the resolved commit.
+// Failed clones are retried with exponential backoff
+func gitCheckout(ctx context.Context, repository, ref, dir string, submodules bool) (string, error) {
+	err := Retry(ctx, downloadRetries, func() error {
+		os.RemoveAll(dir)
+		return exec.CommandContext(ctx, "git", "clone", "--quiet", repository, dir).Run()
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed cloning %s: %s", repository, err)
+	}
+
+	// branches move, only tags and full commit hashes pin the source
+	if !isCommitHash(ref) {
+		cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", "refs/tags/"+ref)
+		cmd.Dir = dir
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("%s is neither a tag nor a full commit hash of %s, please pin a tag or commit", ref, repository)
+		}
+	}
+
+	cmd := exec.Command("git", "checkout", "--quiet", ref)
+	cmd.Dir = dir
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed checking out %s: %s", ref, err)
+	}
+
+	if submodules {
+		err = Retry(ctx, downloadRetries, func() error {
+			cmd := exec.CommandContext(ctx, "git", "submodule", "update", "--init")
+			cmd.Dir = dir
+			return cmd.Run()
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed updating submodules: %s", err)
+		}
+	}
+
+	cmd = exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed resolving commit: %s", err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// branchRefs are well-known branch names, which never pin a source
+var branchRefs = []string{"master", "main", "develop", "trunk", "HEAD"}
+
+// isBranchRef reports whether ref obviously names a branch instead of a tag or commit
+func isBranchRef(ref string) bool {
+	for _, branch := range branchRefs {
+		if ref == branch {
+			return true
+		}
+	}
+
+	return strings.HasPrefix(ref, "refs/heads/") || strings.HasPrefix(ref, "origin/")
+}
+
+// isCommitHash reports whether ref is a full, hex encoded SHA-1 commit hash
+func isCommitHash(ref string) bool {
+	decoded, err := hex.DecodeString(ref)
+	return err == nil && len(decoded) == 20
+}
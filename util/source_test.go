@@ -0,0 +1,70 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRepository creates a git repository with a tagged commit and a branch and returns its path and the commit
+func testRepository(t *testing.T, dir string) (string, string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+
+	repo := filepath.Join(dir, "repo")
+	git := func(args ...string) string {
+		args = append([]string{"-C", repo, "-c", "user.name=SecNginX", "-c", "user.email=test@example.org"}, args...)
+		out, err := exec.Command("git", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s failed: %s %s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	if out, err := exec.Command("git", "init", "--quiet", repo).CombinedOutput(); err != nil {
+		t.Fatalf("git init failed: %s %s", err, out)
+	}
+	if err := ioutil.WriteFile(filepath.Join(repo, "config"), []byte("ngx_addon_name=ngx_test\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("add", "config")
+	git("commit", "--quiet", "-m", "release")
+	git("tag", "v1.0.0")
+	git("branch", "feature")
+
+	return repo, git("rev-parse", "HEAD")
+}
+
+func TestGitCheckout(t *testing.T) {
+	dir := t.TempDir()
+	repo, commit := testRepository(t, dir)
+
+	tests := []struct {
+		name    string
+		ref     string
+		wantErr bool
+	}{
+		{"tag", "v1.0.0", false},
+		{"commit", commit, false},
+		{"branch", "feature", true},
+		{"abbreviated commit", commit[:12], true},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolved, err := gitCheckout(context.Background(), repo, tt.ref, filepath.Join(dir, fmt.Sprint("checkout", i)), false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("gitCheckout() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err == nil && resolved != commit {
+				t.Fatalf("gitCheckout() resolved %s, want %s", resolved, commit)
+			}
+		})
+	}
+}
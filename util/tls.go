@@ -0,0 +1,148 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TLSLibrary is a TLS library NginX can be built with via --with-openssl
+type TLSLibrary struct {
+	// Name of the library, also used as component name, e.g. in the [checksums] table and as <name>_version key
+	Name  string `json:"name"`
+	Title string `json:"title"`
+	// Prebuilt libraries aren't built by NginX's make, but before configuring NginX
+	Prebuilt bool `json:"prebuilt"`
+}
+
+// TLSLibraries are the supported TLS libraries, set via tls_library in the toml config
+var TLSLibraries = []TLSLibrary{
+	{Name: "openssl", Title: "OpenSSL"},
+	{Name: "quictls", Title: "QuicTLS"},
+	{Name: "libressl", Title: "LibreSSL"},
+	{Name: "boringssl", Title: "BoringSSL", Prebuilt: true},
+}
+
+// FeatureDHE is used, if the NginX configuration enables the DHE key exchange
+const FeatureDHE = "dhe"
+
+// FeatureHTTP3 is used, if NginX is built with HTTP/3 support
+const FeatureHTTP3 = "http3"
+
+// tlsIncompatibility describes a module or feature, which can't be used together with a TLS library
+type tlsIncompatibility struct {
+	Library string
+	Module  string
+	Feature string
+	Reason  string
+}
+
+// tlsIncompatibilities is the compatibility matrix of the supported TLS libraries
+var tlsIncompatibilities = []tlsIncompatibility{
+	{Library: "libressl", Module: "nginx-ct", Reason: "LibreSSL doesn't support Certificate Transparency timestamps"},
+	{Library: "openssl", Feature: FeatureHTTP3, Reason: "OpenSSL lacks the QUIC API required by HTTP/3, use quictls, libressl or boringssl"},
+	{Library: "boringssl", Feature: FeatureDHE, Reason: "BoringSSL doesn't support the DHE key exchange, remove ssl_dhparam and all DHE ciphers from the NginX configuration"},
+}
+
+// GetTLSLibrary returns the supported TLS library with the given name
+func GetTLSLibrary(name string) (TLSLibrary, error) {
+	names := []string{}
+	for _, l := range TLSLibraries {
+		if l.Name == name {
+			return l, nil
+		}
+		names = append(names, l.Name)
+	}
+
+	return TLSLibrary{}, fmt.Errorf("unknown tls_library %s, supported are: %s", name, strings.Join(names, ", "))
+}
+
+// CheckTLSCompatibility rejects modules and features, which can't be used together with the given TLS library
+func CheckTLSCompatibility(library TLSLibrary, modules []Module, features []string) error {
+	used := map[string]bool{}
+	for _, f := range features {
+		used[f] = true
+	}
+
+	conflicts := []string{}
+	for _, i := range tlsIncompatibilities {
+		if i.Library != library.Name {
+			continue
+		}
+
+		if i.Feature != "" && used[i.Feature] {
+			conflicts = append(conflicts, i.Reason)
+		}
+
+		for _, m := range modules {
+			if i.Module != "" && m.Name == i.Module {
+				conflicts = append(conflicts, fmt.Sprintf("module %s can't be used: %s. Skip it via --without-module %s", m.Name, i.Reason, m.Name))
+			}
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%s is incompatible with the current configuration:\n  %s", library.Title, strings.Join(conflicts, "\n  "))
+	}
+
+	return nil
+}
+
+// CompatibleTLSLibrary returns the first TLS library with a configured version, which supports all given modules and features
+func (c *Config) CompatibleTLSLibrary(modules []Module, features []string) (TLSLibrary, bool) {
+	for _, l := range TLSLibraries {
+		if c.TLSVersions[l.Name] != "" && CheckTLSCompatibility(l, modules, features) == nil {
+			return l, true
+		}
+	}
+
+	return TLSLibrary{}, false
+}
+
+// UsesDHE checks whether any .conf file below the given NginX configuration directory enables the DHE key exchange,
+// either via ssl_dhparam or by a DHE cipher suite
+func UsesDHE(dir string) bool {
+	found := false
+
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || found || info.IsDir() || filepath.Ext(path) != ".conf" {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 {
+				continue
+			}
+
+			if fields[0] == "ssl_dhparam" || (fields[0] == "ssl_ciphers" && containsPlainDHE(fields[1])) {
+				found = true
+				break
+			}
+		}
+
+		return nil
+	})
+
+	return found
+}
+
+// containsPlainDHE checks whether the cipher list contains DHE suites, ECDHE suites aren't affected
+func containsPlainDHE(ciphers string) bool {
+	for _, cipher := range strings.Split(strings.TrimSuffix(ciphers, ";"), ":") {
+		if strings.HasPrefix(cipher, "DHE-") {
+			return true
+		}
+	}
+
+	return false
+}
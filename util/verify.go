@@ -0,0 +1,113 @@
+package util
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// NginXBuild holds the build information reported by 'nginx -V'
+type NginXBuild struct {
+	Version string
+	// TLSLibrary is the "built with" line, e.g. "OpenSSL 1.1.1c  28 May 2019"
+	TLSLibrary         string
+	ConfigureArguments []string
+}
+
+// InspectNginX runs the given NginX binary with -V and parses its output
+func InspectNginX(binary string) (*NginXBuild, error) {
+	// nginx -V prints to stderr
+	out, err := exec.Command(binary, "-V").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("'%s -V' failed: %s\n%s", binary, err, out)
+	}
+
+	build := &NginXBuild{}
+	for _, line := range strings.Split(string(out), "\n") {
+		switch {
+		case strings.HasPrefix(line, "nginx version: nginx/"):
+			build.Version = strings.Fields(strings.TrimPrefix(line, "nginx version: nginx/"))[0]
+		case strings.HasPrefix(line, "built with "):
+			build.TLSLibrary = strings.TrimSpace(strings.TrimPrefix(line, "built with "))
+		case strings.HasPrefix(line, "configure arguments: "):
+			build.ConfigureArguments = splitConfigureArguments(strings.TrimPrefix(line, "configure arguments: "))
+		}
+	}
+
+	if build.Version == "" {
+		return nil, fmt.Errorf("unexpected output of '%s -V':\n%s", binary, out)
+	}
+
+	return build, nil
+}
+
+// HasArgument checks whether NginX has been configured with the given argument
+func (b *NginXBuild) HasArgument(arg string) bool {
+	for _, a := range b.ConfigureArguments {
+		if a == arg {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitConfigureArguments splits the configure arguments printed by NginX. Values containing spaces are
+// quoted by NginX, e.g. --with-cc-opt='-O2 -fPIE'
+func splitConfigureArguments(line string) []string {
+	args := []string{}
+	var current strings.Builder
+	quoted := false
+
+	for _, r := range line {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if current.Len() > 0 {
+				args = append(args, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+
+	if current.Len() > 0 {
+		args = append(args, current.String())
+	}
+
+	return args
+}
+
+// MissingStrings returns the given strings, which aren't contained in the read-only data of the ELF binary,
+// e.g. the directive names added by a patch
+func MissingStrings(binary string, strs []string) ([]string, error) {
+	f, err := elf.Open(binary)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	section := f.Section(".rodata")
+	if section == nil {
+		return nil, fmt.Errorf("%s has no .rodata section", binary)
+	}
+
+	data, err := section.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	missing := []string{}
+	for _, s := range strs {
+		// strings are NUL terminated
+		if !bytes.Contains(data, append([]byte(s), 0)) {
+			missing = append(missing, s)
+		}
+	}
+
+	return missing, nil
+}
@@ -0,0 +1,157 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// preReleases are suffixes marking versions before the release, e.g. 1.1.1-pre9 or 3.0.0-beta2
+var preReleases = []string{"alpha", "beta", "pre", "rc"}
+
+// CompareVersions compares two dotted version numbers like 1.21.5 numerically and returns -1, 0 or 1.
+// Suffixes of a part are compared as well: letters and builds (e.g. 1.1.1c or 3.1.5-quic1) follow the plain
+// version, pre-releases (e.g. 1.1.1-pre9) precede it
+func CompareVersions(a, b string) int {
+	// tags are often prefixed, e.g. v0.33
+	as, bs := strings.Split(strings.TrimPrefix(a, "v"), "."), strings.Split(strings.TrimPrefix(b, "v"), ".")
+
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, xs := versionPart(as, i)
+		y, ys := versionPart(bs, i)
+		if x != y {
+			return compareInts(x, y)
+		}
+
+		if cmp := compareSuffixes(xs, ys); cmp != 0 {
+			return cmp
+		}
+	}
+
+	return 0
+}
+
+// versionPart splits the i-th part into its number and suffix, missing parts are 0
+func versionPart(parts []string, i int) (int, string) {
+	if i >= len(parts) {
+		return 0, ""
+	}
+
+	suffix := strings.TrimLeft(parts[i], "0123456789")
+	n, _ := strconv.Atoi(strings.TrimSuffix(parts[i], suffix))
+	return n, suffix
+}
+
+func compareSuffixes(a, b string) int {
+	if a == b {
+		return 0
+	}
+
+	// the plain version follows its pre-releases, but precedes letter and build suffixes
+	if a == "" || b == "" {
+		rank := func(s string) int {
+			if s == "" {
+				return 0
+			}
+			if isPreRelease(s) {
+				return -1
+			}
+			return 1
+		}
+		return compareInts(rank(a), rank(b))
+	}
+
+	if isPreRelease(a) != isPreRelease(b) {
+		if isPreRelease(a) {
+			return -1
+		}
+		return 1
+	}
+
+	return compareNatural(a, b)
+}
+
+func isPreRelease(suffix string) bool {
+	suffix = strings.ToLower(strings.TrimLeft(suffix, "-_+~"))
+	for _, pre := range preReleases {
+		if strings.HasPrefix(suffix, pre) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compareNatural compares strings, runs of digits are compared numerically (quic9 < quic10)
+func compareNatural(a, b string) int {
+	for a != "" && b != "" {
+		ad, bd := leadingDigits(a), leadingDigits(b)
+		if ad != "" && bd != "" {
+			x, _ := strconv.Atoi(ad)
+			y, _ := strconv.Atoi(bd)
+			if x != y {
+				return compareInts(x, y)
+			}
+			a, b = a[len(ad):], b[len(bd):]
+			continue
+		}
+
+		if a[0] != b[0] {
+			return compareInts(int(a[0]), int(b[0]))
+		}
+		a, b = a[1:], b[1:]
+	}
+
+	return compareInts(len(a), len(b))
+}
+
+func leadingDigits(s string) string {
+	return strings.TrimSuffix(s, strings.TrimLeft(s, "0123456789"))
+}
+
+func compareInts(x, y int) int {
+	if x < y {
+		return -1
+	}
+	if x > y {
+		return 1
+	}
+	return 0
+}
+
+// MatchesVersions checks whether the version satisfies all comma separated constraints, e.g. ">= 1.15.5, < 1.17.7".
+// Supported operators are =, >=, >, <= and <, empty constraints match every version
+func MatchesVersions(version, constraints string) (bool, error) {
+	matches := true
+
+	for _, constraint := range strings.Split(constraints, ",") {
+		constraint = strings.TrimSpace(constraint)
+		if constraint == "" {
+			continue
+		}
+
+		other := strings.TrimSpace(strings.TrimLeft(constraint, "<>=!"))
+		op := strings.TrimSpace(strings.TrimSuffix(constraint, other))
+		if other == "" || strings.ContainsAny(other, "<>=! ") {
+			return false, fmt.Errorf("invalid version constraint %s", constraint)
+		}
+
+		cmp := CompareVersions(version, other)
+		switch op {
+		case "=", "==":
+			matches = matches && cmp == 0
+		case ">=":
+			matches = matches && cmp >= 0
+		case ">":
+			matches = matches && cmp > 0
+		case "<=":
+			matches = matches && cmp <= 0
+		case "<":
+			matches = matches && cmp < 0
+		default:
+			return false, fmt.Errorf("invalid version constraint %s, supported operators are =, >=, >, <= and <", constraint)
+		}
+	}
+
+	return matches, nil
+}
@@ -0,0 +1,83 @@
+package util
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.17.0", "1.17.0", 0},
+		{"1.17", "1.17.0", 0},
+		{"v0.33", "0.33", 0},
+		{"1.9.0", "1.10.0", -1},
+		{"1.21.5", "1.21.4", 1},
+		{"2.31", "2.28", 1},
+		{"1.1.1c", "1.1.1", 1},
+		{"1.1.1c", "1.1.1b", 1},
+		{"1.1.1c", "1.1.1c", 0},
+		{"1.1.1", "1.1.1a", -1},
+		{"1.1.1c", "1.1.2", -1},
+		{"1.1.1-pre9", "1.1.1", -1},
+		{"1.1.1-pre9", "1.1.1-pre10", -1},
+		{"3.0.0-beta2", "3.0.0-alpha17", 1},
+		{"3.0.0-rc1", "3.0.0", -1},
+		{"3.1.5-quic1", "3.1.5", 1},
+		{"3.1.5-quic1", "3.1.4", 1},
+		{"3.1.5-quic1", "3.1.5-quic2", -1},
+		{"3.1.5-quic10", "3.1.5-quic9", 1},
+		{"3.1.5-quic1", "3.1.5-rc1", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			if got := CompareVersions(tt.a, tt.b); got != tt.want {
+				t.Fatalf("CompareVersions(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+			if got := CompareVersions(tt.b, tt.a); got != -tt.want {
+				t.Fatalf("CompareVersions(%s, %s) = %d, want %d", tt.b, tt.a, got, -tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchesVersions(t *testing.T) {
+	tests := []struct {
+		version     string
+		constraints string
+		want        bool
+		wantErr     bool
+	}{
+		{"1.17.0", "", true, false},
+		{"1.17.0", ">= 1.15.5, < 1.17.7", true, false},
+		{"1.17.7", ">= 1.15.5, < 1.17.7", false, false},
+		{"1.15.4", ">=1.15.5,<1.17.7", false, false},
+		{"1.16.1", "= 1.16.1", true, false},
+		{"1.16.1", "== 1.16.1", true, false},
+		{"1.16.1", "> 1.16.1", false, false},
+		{"1.16.1", "<= 1.16.1", true, false},
+		{"1.1.1c", ">= 1.1.1b", true, false},
+		{"1.1.1c", "< 1.1.1d", true, false},
+		{"1.1.1c", "= 1.1.1", false, false},
+		{"3.1.5-quic1", ">= 3.1.5", true, false},
+		{"3.1.5-quic1", "= 3.1.5-quic1", true, false},
+		{"3.1.5_quic1", "= 3.1.5_quic1", true, false},
+		{"1.17.0", "1.17.0", false, true},
+		{"1.17.0", "=> 1.17.0", false, true},
+		{"1.17.0", "!= 1.17.0", false, true},
+		{"1.17.0", ">=", false, true},
+		{"1.17.0", ">= 1.15 1.16", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.version+" "+tt.constraints, func(t *testing.T) {
+			got, err := MatchesVersions(tt.version, tt.constraints)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MatchesVersions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("MatchesVersions(%s, %q) = %v, want %v", tt.version, tt.constraints, got, tt.want)
+			}
+		})
+	}
+}